@@ -142,7 +142,7 @@ func (cmd *adminCmd) saramaConfig() *sarama.Config {
 
 	cfg.Version = cmd.version
 	if usr, err = user.Current(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+		warnf("Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-admin-" + sanitizeUsername(usr.Username)
 
@@ -179,6 +179,8 @@ func (cmd *adminCmd) parseFlags(as []string) adminArgs {
 
 	flags.StringVar(&args.deleteTopic, "deletetopic", "", "Name of the topic that should be deleted.")
 
+	addErrorsFlag(flags)
+
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of admin:")
 		flags.PrintDefaults()
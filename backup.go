@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	backupFormat        = "kt-backup"
+	backupFormatVersion = 1
+)
+
+// backupHeader is the first entry of a backup archive and describes the topic
+// the records that follow belong to.
+type backupHeader struct {
+	Format            string             `json:"format"`
+	Version           int                `json:"version"`
+	Topic             string             `json:"topic"`
+	Partitions        int32              `json:"partitions"`
+	ReplicationFactor int16              `json:"replicationFactor"`
+	Configs           map[string]*string `json:"configs,omitempty"`
+	Created           time.Time          `json:"created"`
+}
+
+// backupRecord is a single message in a backup archive. Keys, values and
+// headers are stored as base64 encoded bytes so that binary data survives the
+// round trip unchanged.
+type backupRecord struct {
+	Partition int32                `json:"partition"`
+	Offset    int64                `json:"offset"`
+	Timestamp *time.Time           `json:"timestamp,omitempty"`
+	Key       []byte               `json:"key"`
+	Value     []byte               `json:"value"`
+	Headers   []backupRecordHeader `json:"headers,omitempty"`
+}
+
+type backupRecordHeader struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func newBackupRecord(m *sarama.ConsumerMessage) backupRecord {
+	rec := backupRecord{
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+	}
+
+	if !m.Timestamp.IsZero() {
+		rec.Timestamp = &m.Timestamp
+	}
+
+	for _, h := range m.Headers {
+		rec.Headers = append(rec.Headers, backupRecordHeader{Key: h.Key, Value: h.Value})
+	}
+
+	return rec
+}
+
+// backupWriter writes a gzip compressed archive consisting of one JSON encoded
+// backupHeader followed by one JSON encoded backupRecord per line.
+type backupWriter struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func newBackupWriter(w io.Writer, header backupHeader) (*backupWriter, error) {
+	gz := gzip.NewWriter(w)
+	bw := &backupWriter{gz: gz, enc: json.NewEncoder(gz)}
+
+	header.Format = backupFormat
+	header.Version = backupFormatVersion
+	if err := bw.enc.Encode(header); err != nil {
+		return nil, err
+	}
+
+	return bw, nil
+}
+
+func (w *backupWriter) write(rec backupRecord) error {
+	return w.enc.Encode(rec)
+}
+
+func (w *backupWriter) Close() error {
+	return w.gz.Close()
+}
+
+type backupReader struct {
+	gz     *gzip.Reader
+	dec    *json.Decoder
+	header backupHeader
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup archive err=%v", err)
+	}
+
+	br := &backupReader{gz: gz, dec: json.NewDecoder(gz)}
+	if err = br.dec.Decode(&br.header); err != nil {
+		return nil, fmt.Errorf("failed to read backup header err=%v", err)
+	}
+
+	if br.header.Format != backupFormat {
+		return nil, fmt.Errorf("unexpected archive format %#v", br.header.Format)
+	}
+
+	if br.header.Version != backupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version %v", br.header.Version)
+	}
+
+	return br, nil
+}
+
+// read returns the next record in the archive, or io.EOF once all records
+// were read.
+func (r *backupReader) read() (backupRecord, error) {
+	var rec backupRecord
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
+
+func (r *backupReader) Close() error {
+	return r.gz.Close()
+}
+
+type backupCmd struct {
+	topic      string
+	brokers    []string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	file       string
+	verbose    bool
+	version    sarama.KafkaVersion
+
+	client   sarama.Client
+	consumer sarama.Consumer
+	admin    sarama.ClusterAdmin
+}
+
+type backupArgs struct {
+	topic      string
+	brokers    string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	file       string
+	verbose    bool
+	version    string
+}
+
+func (cmd *backupCmd) parseFlags(as []string) backupArgs {
+	var args backupArgs
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.StringVar(&args.topic, "topic", "", "Topic to back up (required).")
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.file, "file", "", "Path of the archive to write (required, - for stdout).")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of backup:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, backupDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *backupCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt backup -help\" for more information")
+}
+
+func (cmd *backupCmd) parseArgs(as []string) {
+	args := cmd.parseFlags(as)
+
+	envTopic := os.Getenv("KT_TOPIC")
+	if args.topic == "" {
+		if envTopic == "" {
+			cmd.failStartup("Topic name is required.")
+			return
+		}
+		args.topic = envTopic
+	}
+
+	if args.file == "" {
+		cmd.failStartup("Archive file is required.")
+		return
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	cmd.topic = args.topic
+	cmd.brokers = parseBrokers(args.brokers)
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.file = args.file
+	cmd.verbose = args.verbose
+	cmd.version = kafkaVersion(args.version)
+}
+
+func (cmd *backupCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-backup-" + sanitizeUsername(usr.Username)
+	cfg.Consumer.Return.Errors = true
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+func (cmd *backupCmd) run(as []string) {
+	var err error
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	cfg := cmd.saramaConfig()
+	if cmd.client, err = sarama.NewClient(cmd.brokers, cfg); err != nil {
+		failf("failed to create client err=%v", err)
+	}
+	defer logClose("client", cmd.client)
+
+	if cmd.admin, err = sarama.NewClusterAdmin(cmd.brokers, cfg); err != nil {
+		failf("failed to create cluster admin err=%v", err)
+	}
+	defer logClose("cluster admin", cmd.admin)
+
+	if cmd.consumer, err = sarama.NewConsumerFromClient(cmd.client); err != nil {
+		failf("failed to create consumer err=%v", err)
+	}
+	defer logClose("consumer", cmd.consumer)
+
+	header := cmd.readHeader()
+
+	var w io.Writer = os.Stdout
+	if cmd.file != "-" {
+		f, err := os.Create(cmd.file)
+		if err != nil {
+			failf("failed to create archive file err=%v", err)
+		}
+		defer logClose("archive file", f)
+		w = f
+	}
+
+	bw, err := newBackupWriter(w, header)
+	if err != nil {
+		failf("failed to write backup header err=%v", err)
+	}
+
+	count := cmd.backup(bw, header.Partitions)
+	if err = bw.Close(); err != nil {
+		failf("failed to finish backup archive err=%v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "backed up %v messages from %v partitions of topic %v\n", count, header.Partitions, cmd.topic)
+}
+
+func (cmd *backupCmd) readHeader() backupHeader {
+	partitions, err := cmd.client.Partitions(cmd.topic)
+	if err != nil {
+		failf("failed to read partitions for topic %v err=%v", cmd.topic, err)
+	}
+
+	header := backupHeader{
+		Topic:      cmd.topic,
+		Partitions: int32(len(partitions)),
+		Created:    time.Now(),
+		Configs:    map[string]*string{},
+	}
+
+	if len(partitions) > 0 {
+		replicas, err := cmd.client.Replicas(cmd.topic, partitions[0])
+		if err != nil {
+			failf("failed to read replicas for topic %v err=%v", cmd.topic, err)
+		}
+		header.ReplicationFactor = int16(len(replicas))
+	}
+
+	entries, err := cmd.admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: cmd.topic})
+	if err != nil {
+		failf("failed to read configs for topic %v err=%v", cmd.topic, err)
+	}
+
+	for _, e := range entries {
+		if e.Default || e.ReadOnly || e.Sensitive {
+			continue
+		}
+		value := e.Value
+		header.Configs[e.Name] = &value
+	}
+
+	return header
+}
+
+// backup writes all messages that are in the topic when backup is called and
+// returns the number of messages written.
+func (cmd *backupCmd) backup(w *backupWriter, partitions int32) int64 {
+	var (
+		wg       sync.WaitGroup
+		count    int64
+		messages = make(chan *sarama.ConsumerMessage)
+		done     = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+		for m := range messages {
+			if err := w.write(newBackupRecord(m)); err != nil {
+				failf("failed to write message to archive err=%v", err)
+			}
+			count++
+		}
+	}()
+
+	wg.Add(int(partitions))
+	for p := int32(0); p < partitions; p++ {
+		go func(p int32) { defer wg.Done(); cmd.backupPartition(messages, p) }(p)
+	}
+	wg.Wait()
+	close(messages)
+	<-done
+
+	return count
+}
+
+func (cmd *backupCmd) backupPartition(out chan<- *sarama.ConsumerMessage, partition int32) {
+	oldest, err := cmd.client.GetOffset(cmd.topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		failf("failed to read oldest offset for partition %v err=%v", partition, err)
+	}
+
+	newest, err := cmd.client.GetOffset(cmd.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		failf("failed to read newest offset for partition %v err=%v", partition, err)
+	}
+
+	if oldest >= newest {
+		return
+	}
+
+	pc, err := cmd.consumer.ConsumePartition(cmd.topic, partition, oldest)
+	if err != nil {
+		failf("failed to consume partition %v err=%v", partition, err)
+	}
+	defer logClose(fmt.Sprintf("partition consumer %v", partition), pc)
+
+	next := oldest
+	for {
+		probe := time.NewTimer(caughtUpProbeInterval)
+		select {
+		case <-probe.C:
+			// a partition ending in transaction markers never delivers a
+			// message at newest-1.
+			if onlyControlRecords(cmd.client, cmd.version, topicPartition{cmd.topic, partition}, next, newest) {
+				return
+			}
+		case err, ok := <-pc.Errors():
+			probe.Stop()
+			if !ok {
+				failf("failed to consume partition %v err=%v", partition, errPartitionConsumerClosed)
+			}
+			if err.Err == sarama.ErrOffsetOutOfRange {
+				failf("failed to consume partition %v err=%v", partition, err.Err)
+			}
+			warnf("partition %v consumer encountered err=%v", partition, err.Err)
+		case msg, ok := <-pc.Messages():
+			probe.Stop()
+			if !ok {
+				failf("failed to consume partition %v err=%v", partition, errPartitionConsumerClosed)
+			}
+			if msg.Offset >= newest {
+				return
+			}
+			out <- msg
+			next = msg.Offset + 1
+			if next >= newest {
+				return
+			}
+		}
+	}
+}
+
+var backupDocString = `
+The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
+The values supplied on the command line win over environment variable values.
+
+Backup writes all messages that are in the topic when the command starts to a
+gzip compressed archive. Next to each message's key, value, headers,
+timestamp, partition and offset, the archive records the topic's partition
+count, replication factor and non-default configs so that "kt restore" can
+recreate it.
+
+The archive consists of JSON lines: a header object followed by one object
+per message with keys, values and headers base64 encoded.
+
+Example:
+
+  kt backup -topic orders -file orders.ktb
+  kt restore -file orders.ktb -topic orders-restored
+`
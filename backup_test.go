@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupArchiveRoundTrip(t *testing.T) {
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	compact := "compact"
+	header := backupHeader{
+		Topic:             "orders",
+		Partitions:        2,
+		ReplicationFactor: 3,
+		Configs:           map[string]*string{"cleanup.policy": &compact},
+		Created:           ts,
+	}
+	messages := []*sarama.ConsumerMessage{
+		{
+			Partition: 0,
+			Offset:    7,
+			Key:       []byte{0x00, 0xff, 0x10},
+			Value:     []byte("value"),
+			Timestamp: ts,
+			Headers:   []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte{0x01}}},
+		},
+		{
+			Partition: 1,
+			Offset:    3,
+			Key:       []byte("tombstone"),
+			Value:     nil,
+		},
+	}
+
+	var buf bytes.Buffer
+	w, err := newBackupWriter(&buf, header)
+	require.NoError(t, err)
+	for _, m := range messages {
+		require.NoError(t, w.write(newBackupRecord(m)))
+	}
+	require.NoError(t, w.Close())
+
+	r, err := newBackupReader(&buf)
+	require.NoError(t, err)
+	require.Equal(t, backupFormat, r.header.Format)
+	require.Equal(t, backupFormatVersion, r.header.Version)
+	require.Equal(t, "orders", r.header.Topic)
+	require.Equal(t, int32(2), r.header.Partitions)
+	require.Equal(t, int16(3), r.header.ReplicationFactor)
+	require.Equal(t, "compact", *r.header.Configs["cleanup.policy"])
+
+	first, err := r.read()
+	require.NoError(t, err)
+	require.Equal(t, int32(0), first.Partition)
+	require.Equal(t, int64(7), first.Offset)
+	require.Equal(t, []byte{0x00, 0xff, 0x10}, first.Key)
+	require.Equal(t, []byte("value"), first.Value)
+	require.True(t, ts.Equal(*first.Timestamp))
+	require.Equal(t, []backupRecordHeader{{Key: []byte("h"), Value: []byte{0x01}}}, first.Headers)
+
+	second, err := r.read()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), second.Partition)
+	require.Nil(t, second.Value)
+	require.Nil(t, second.Timestamp)
+
+	_, err = r.read()
+	require.Equal(t, io.EOF, err)
+
+	target := &restoreCmd{topic: "orders-restored", replicationFactor: 1}
+	detail := target.topicDetail(r.header)
+	require.Equal(t, int32(2), detail.NumPartitions)
+	require.Equal(t, int16(1), detail.ReplicationFactor)
+
+	pm := target.producerMessage(first)
+	require.Equal(t, "orders-restored", pm.Topic)
+	require.Equal(t, int32(0), pm.Partition)
+	require.Equal(t, []sarama.RecordHeader{{Key: []byte("h"), Value: []byte{0x01}}}, pm.Headers)
+}
+
+func TestBackupReaderRejectsOtherFormats(t *testing.T) {
+	_, err := newBackupReader(bytes.NewBufferString(`{"format":"other"}`))
+	require.Error(t, err)
+}
+
+func TestBackupPartitionEndingInCommitMarker(t *testing.T) {
+	defer func(d time.Duration) { caughtUpProbeInterval = d }(caughtUpProbeInterval)
+	caughtUpProbeInterval = 10 * time.Millisecond
+
+	fetch := &sarama.FetchResponse{Version: 4}
+	fetch.AddRecord("orders", 0, nil, sarama.StringEncoder("marker"), 0)
+	batch := fetch.GetBlock("orders", 0).RecordsSet[0].RecordBatch
+	batch.FirstOffset = 7
+	batch.Control = true
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("orders", 0, sarama.OffsetOldest, 5).
+			SetOffset("orders", 0, sarama.OffsetNewest, 8),
+		"FetchRequest": sarama.NewMockWrapper(fetch),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// offsets 5 and 6 are messages, offset 7 is the commit marker that the
+	// consumer never delivers.
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	messages <- &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: 5, Value: []byte("a")}
+	messages <- &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: 6, Value: []byte("b")}
+
+	target := &backupCmd{
+		topic:   "orders",
+		version: cfg.Version,
+		client:  client,
+		consumer: tConsumer{
+			calls: make(chan tConsumePartition, 1),
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"orders", 0, 5}: {messages: messages},
+			},
+		},
+	}
+
+	out := make(chan *sarama.ConsumerMessage, 3)
+	done := make(chan struct{})
+	go func() { target.backupPartition(out, 0); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("backup of partition ending in a commit marker did not finish")
+	}
+
+	close(out)
+	var offsets []int64
+	for m := range out {
+		offsets = append(offsets, m.Offset)
+	}
+	require.Equal(t, []int64{5, 6}, offsets)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// committedFetchSize is how many bytes of a partition a read_committed fetch
+// asks for. It's doubled while a single batch doesn't fit.
+const committedFetchSize = 1 << 20
+
+// committedMaxWait is how long the broker holds a read_committed fetch when
+// there are no new committed records.
+var committedMaxWait = 500 * time.Millisecond
+
+// committedPartitionConsumer consumes a partition with read_committed
+// isolation, which sarama's consumer doesn't support. It only reads up to the
+// last stable offset and drops transaction markers and the records of aborted
+// transactions. Like sarama's partition consumer it stops after reporting
+// ErrOffsetOutOfRange.
+type committedPartitionConsumer struct {
+	client    sarama.Client
+	tp        topicPartition
+	offset    int64
+	fetchSize int32
+	hwm       int64
+
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+	closing  chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newCommittedPartitionConsumer(client sarama.Client, tp topicPartition, offset int64) *committedPartitionConsumer {
+	pc := &committedPartitionConsumer{
+		client:    client,
+		tp:        tp,
+		offset:    offset,
+		fetchSize: committedFetchSize,
+		messages:  make(chan *sarama.ConsumerMessage),
+		errors:    make(chan *sarama.ConsumerError),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go pc.run()
+	return pc
+}
+
+func (pc *committedPartitionConsumer) AsyncClose() {
+	pc.once.Do(func() { close(pc.closing) })
+}
+
+func (pc *committedPartitionConsumer) Close() error {
+	pc.AsyncClose()
+	<-pc.done
+	return nil
+}
+
+func (pc *committedPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return pc.messages
+}
+
+func (pc *committedPartitionConsumer) Errors() <-chan *sarama.ConsumerError {
+	return pc.errors
+}
+
+func (pc *committedPartitionConsumer) HighWaterMarkOffset() int64 {
+	return atomic.LoadInt64(&pc.hwm)
+}
+
+func (pc *committedPartitionConsumer) run() {
+	defer close(pc.done)
+	defer close(pc.errors)
+	defer close(pc.messages)
+
+	for {
+		select {
+		case <-pc.closing:
+			return
+		default:
+		}
+
+		block, err := fetchCommitted(pc.client, pc.tp, pc.offset, pc.fetchSize, committedMaxWait)
+		if err != nil {
+			if !pc.sendError(err) {
+				return
+			}
+			if err == sarama.ErrOffsetOutOfRange {
+				return
+			}
+			if err := pc.client.RefreshMetadata(pc.tp.topic); err != nil {
+				warnf("failed to refresh metadata for topic %v err=%v", pc.tp.topic, err)
+			}
+			select {
+			case <-pc.closing:
+				return
+			case <-time.After(consumeRetryBackoff):
+			}
+			continue
+		}
+		atomic.StoreInt64(&pc.hwm, block.HighWaterMarkOffset)
+
+		msgs, next := committedMessages(pc.tp, block, pc.offset)
+		if next == pc.offset && (len(block.RecordsSet) > 0 || block.Partial) {
+			// the next batch is larger than the fetch size.
+			if pc.fetchSize < sarama.MaxResponseSize/2 {
+				pc.fetchSize *= 2
+				continue
+			}
+			if !pc.sendError(sarama.ErrMessageTooLarge) {
+				return
+			}
+			next = pc.offset + 1
+		}
+		pc.fetchSize = committedFetchSize
+		pc.offset = next
+
+		for _, msg := range msgs {
+			if !pc.sendMessage(msg) {
+				return
+			}
+		}
+	}
+}
+
+// sendMessage delivers msg, it reports false when the consumer is closed
+// while waiting.
+func (pc *committedPartitionConsumer) sendMessage(msg *sarama.ConsumerMessage) bool {
+	select {
+	case pc.messages <- msg:
+		return true
+	case <-pc.closing:
+		return false
+	}
+}
+
+// sendError reports err, it reports false when the consumer is closed while
+// waiting.
+func (pc *committedPartitionConsumer) sendError(err error) bool {
+	select {
+	case pc.errors <- &sarama.ConsumerError{Topic: pc.tp.topic, Partition: pc.tp.partition, Err: err}:
+		return true
+	case <-pc.closing:
+		return false
+	}
+}
+
+// fetchCommitted fetches the given partition from offset with read_committed
+// isolation. The broker holds the request for up to maxWait when there are no
+// committed records after offset.
+func fetchCommitted(client sarama.Client, tp topicPartition, offset int64, size int32, maxWait time.Duration) (*sarama.FetchResponseBlock, error) {
+	broker, err := client.Leader(tp.topic, tp.partition)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &sarama.FetchRequest{
+		Version:     4,
+		MaxWaitTime: int32(maxWait / time.Millisecond),
+		MinBytes:    1,
+		MaxBytes:    sarama.MaxResponseSize,
+		Isolation:   sarama.ReadCommitted,
+	}
+	req.AddBlock(tp.topic, tp.partition, offset, size)
+	resp, err := broker.Fetch(req)
+	if err != nil {
+		return nil, err
+	}
+
+	block := resp.GetBlock(tp.topic, tp.partition)
+	if block == nil {
+		return nil, sarama.ErrIncompleteResponse
+	}
+	if block.Err != sarama.ErrNoError {
+		return nil, block.Err
+	}
+	return block, nil
+}
+
+// lastStableOffset returns the given partition's last stable offset, the
+// first offset of a transaction that is still open or the high water mark
+// when there is none.
+func lastStableOffset(client sarama.Client, tp topicPartition) (int64, error) {
+	hwm, err := client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	block, err := fetchCommitted(client, tp, hwm, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	return block.LastStableOffset, nil
+}
+
+// committedMessages returns the messages of block from offset on without
+// transaction markers and the records of aborted transactions, and the offset
+// to fetch next.
+func committedMessages(tp topicPartition, block *sarama.FetchResponseBlock, offset int64) ([]*sarama.ConsumerMessage, int64) {
+	aborted := append([]*sarama.AbortedTransaction{}, block.AbortedTransactions...)
+	sort.Slice(aborted, func(i, j int) bool { return aborted[i].FirstOffset < aborted[j].FirstOffset })
+
+	var (
+		msgs     []*sarama.ConsumerMessage
+		aborting = map[int64]bool{}
+		next     = offset
+	)
+	for _, records := range block.RecordsSet {
+		if set := records.MsgSet; set != nil {
+			// message sets predate transactions.
+			for _, mb := range set.Messages {
+				inner := mb.Messages()
+				for _, m := range inner {
+					o := m.Offset
+					if m.Msg.Version >= 1 {
+						o += mb.Offset - inner[len(inner)-1].Offset
+					}
+					if o < offset {
+						continue
+					}
+					msgs = append(msgs, &sarama.ConsumerMessage{
+						Topic:          tp.topic,
+						Partition:      tp.partition,
+						Key:            m.Msg.Key,
+						Value:          m.Msg.Value,
+						Offset:         o,
+						Timestamp:      m.Msg.Timestamp,
+						BlockTimestamp: mb.Msg.Timestamp,
+					})
+					next = o + 1
+				}
+			}
+			continue
+		}
+
+		batch := records.RecordBatch
+		if batch == nil || batch.PartialTrailingRecord {
+			break
+		}
+
+		last := batch.FirstOffset + int64(batch.LastOffsetDelta)
+		for len(aborted) > 0 && aborted[0].FirstOffset <= last {
+			aborting[aborted[0].ProducerID] = true
+			aborted = aborted[1:]
+		}
+
+		switch {
+		case batch.Control:
+			// the marker ends the producer's transaction.
+			delete(aborting, batch.ProducerID)
+		case aborting[batch.ProducerID]:
+		default:
+			for _, r := range batch.Records {
+				o := batch.FirstOffset + r.OffsetDelta
+				if o < offset {
+					continue
+				}
+				msgs = append(msgs, &sarama.ConsumerMessage{
+					Topic:     tp.topic,
+					Partition: tp.partition,
+					Key:       r.Key,
+					Value:     r.Value,
+					Offset:    o,
+					Timestamp: batch.FirstTimestamp.Add(r.TimestampDelta),
+					Headers:   r.Headers,
+				})
+			}
+		}
+
+		if last+1 > next {
+			next = last + 1
+		}
+	}
+
+	return msgs, next
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+// committedBatch returns a record batch of the given producer with a record
+// per offset.
+func committedBatch(producer int64, control bool, offsets ...int64) *sarama.Records {
+	fetch := &sarama.FetchResponse{Version: 4}
+	for _, o := range offsets {
+		fetch.AddRecord("orders", 0, nil, sarama.StringEncoder(fmt.Sprint(o)), o-offsets[0])
+	}
+	records := fetch.GetBlock("orders", 0).RecordsSet[0]
+	batch := records.RecordBatch
+	batch.FirstOffset = offsets[0]
+	batch.LastOffsetDelta = int32(offsets[len(offsets)-1] - offsets[0])
+	batch.ProducerID = producer
+	batch.Control = control
+	return records
+}
+
+// committedBlock holds an aborted transaction of producer 1 at offsets 0 to 2,
+// a committed one of producer 2 at offsets 3 to 5 and a message without
+// transaction at offset 6.
+func committedBlock() *sarama.FetchResponseBlock {
+	return &sarama.FetchResponseBlock{
+		HighWaterMarkOffset: 9,
+		LastStableOffset:    7,
+		AbortedTransactions: []*sarama.AbortedTransaction{{ProducerID: 1, FirstOffset: 0}},
+		RecordsSet: []*sarama.Records{
+			committedBatch(1, false, 0, 1),
+			committedBatch(1, true, 2),
+			committedBatch(2, false, 3, 4),
+			committedBatch(2, true, 5),
+			committedBatch(-1, false, 6),
+		},
+	}
+}
+
+func TestCommittedMessages(t *testing.T) {
+	offsets := func(msgs []*sarama.ConsumerMessage) []int64 {
+		res := []int64{}
+		for _, m := range msgs {
+			res = append(res, m.Offset)
+		}
+		return res
+	}
+
+	msgs, next := committedMessages(topicPartition{"orders", 0}, committedBlock(), 0)
+	require.Equal(t, []int64{3, 4, 6}, offsets(msgs))
+	require.Equal(t, "3", string(msgs[0].Value))
+	require.Equal(t, int64(7), next)
+
+	msgs, next = committedMessages(topicPartition{"orders", 0}, committedBlock(), 4)
+	require.Equal(t, []int64{4, 6}, offsets(msgs))
+	require.Equal(t, int64(7), next)
+
+	// the commit marker at offset 5 is skipped like the aborted records.
+	block := committedBlock()
+	block.RecordsSet = block.RecordsSet[:4]
+	msgs, next = committedMessages(topicPartition{"orders", 0}, block, 5)
+	require.Empty(t, msgs)
+	require.Equal(t, int64(6), next)
+}
+
+func TestConsumePartitionReadCommittedUntilCaughtUp(t *testing.T) {
+	fetch := &sarama.FetchResponse{Version: 4}
+	fetch.AddRecord("orders", 0, nil, nil, 0)
+	*fetch.GetBlock("orders", 0) = *committedBlock()
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("orders", 0, sarama.OffsetOldest, 0).
+			SetOffset("orders", 0, sarama.OffsetNewest, 9),
+		"FetchRequest": sarama.NewMockWrapper(fetch),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	lso, err := lastStableOffset(client, topicPartition{"orders", 0})
+	require.NoError(t, err)
+	require.Equal(t, int64(7), lso)
+
+	out := make(chan printContext)
+	printed := make(chan int64, 10)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage).Offset
+			close(ctx.done)
+		}
+	}()
+
+	// the open transaction at offsets 7 and 8 isn't waited for.
+	target := &consumeCmd{
+		topics:    []string{"orders"},
+		client:    client,
+		version:   cfg.Version,
+		caughtUp:  true,
+		isolation: sarama.ReadCommitted,
+		quit:      make(chan struct{}),
+		offsets: map[int32]interval{
+			-1: interval{start: offset{relative: true, start: sarama.OffsetOldest}, end: offset{start: 1<<63 - 1}},
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		target.consumePartition(out, topicPartition{"orders", 0})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("consume did not stop at the last stable offset")
+	}
+	close(printed)
+	actual := []int64{}
+	for o := range printed {
+		actual = append(actual, o)
+	}
+	require.Equal(t, []int64{3, 4, 6}, actual)
+}
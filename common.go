@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,25 +28,42 @@ var (
 
 func listenForInterrupt(q chan struct{}) {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Kill, os.Interrupt)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	sig := <-signals
+	signal.Stop(signals) // a second signal terminates the process
 	fmt.Fprintf(os.Stderr, "received signal %s\n", sig)
 	close(q)
 }
 
 func kafkaVersion(s string) sarama.KafkaVersion {
-	if s == "" {
-		return sarama.V2_0_0_0
-	}
-
-	v, err := sarama.ParseKafkaVersion(strings.TrimPrefix(s, "v"))
+	v, err := parseKafkaVersion(s)
 	if err != nil {
-		failf(err.Error())
+		failErrorf(&categoryUsage, "%s", err)
 	}
 
 	return v
 }
 
+// parseKafkaVersion parses the value of -version, which defaults to 2.0.0.
+func parseKafkaVersion(s string) (sarama.KafkaVersion, error) {
+	if s == "" {
+		return sarama.V2_0_0_0, nil
+	}
+	return sarama.ParseKafkaVersion(strings.TrimPrefix(s, "v"))
+}
+
+// parseBrokers splits a comma separated list of broker addresses and adds the
+// default port 9092 where it's omitted.
+func parseBrokers(s string) []string {
+	brokers := strings.Split(s, ",")
+	for i, b := range brokers {
+		if !strings.Contains(b, ":") {
+			brokers[i] = b + ":9092"
+		}
+	}
+	return brokers
+}
+
 func parseTimeout(s string) *time.Duration {
 	if s == "" {
 		return nil
@@ -53,7 +71,7 @@ func parseTimeout(s string) *time.Duration {
 
 	v, err := time.ParseDuration(s)
 	if err != nil {
-		failf(err.Error())
+		failErrorf(&categoryUsage, "%s", err)
 	}
 
 	return &v
@@ -61,7 +79,7 @@ func parseTimeout(s string) *time.Duration {
 
 func logClose(name string, c io.Closer) {
 	if err := c.Close(); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to close %#v err=%v", name, err)
+		warnf("failed to close %#v err=%v", name, err)
 	}
 }
 
@@ -96,8 +114,10 @@ func quitf(msg string, args ...interface{}) {
 	exitf(0, msg, args...)
 }
 
+// failf reports a fatal error and exits with the exit code of the category of
+// the first error in args.
 func failf(msg string, args ...interface{}) {
-	exitf(1, msg, args...)
+	failErrorf(nil, msg, args...)
 }
 
 func exitf(code int, msg string, args ...interface{}) {
@@ -109,20 +129,6 @@ func exitf(code int, msg string, args ...interface{}) {
 	os.Exit(code)
 }
 
-func readStdinLines(max int, out chan string) {
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Buffer(make([]byte, max), max)
-
-	for scanner.Scan() {
-		out <- scanner.Text()
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "scanning input failed err=%v\n", err)
-	}
-	close(out)
-}
-
 // hashCode imitates the behavior of the JDK's String#hashCode method.
 // https://docs.oracle.com/javase/7/docs/api/java/lang/String.html#hashCode()
 //
@@ -159,6 +165,17 @@ func hashCodePartition(key string, partitions int32) int32 {
 	return kafkaAbs(hashCode(key)) % partitions
 }
 
+// decodeString decodes s according to encoding, one of string, hex or base64.
+func decodeString(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		return hex.DecodeString(s)
+	case "base64":
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
 func sanitizeUsername(u string) string {
 	// Windows user may have format "DOMAIN|MACHINE\username", remove domain/machine if present
 	s := strings.Split(u, "\\")
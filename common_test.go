@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenForInterruptSIGTERM(t *testing.T) {
+	// keeps the test process alive should SIGTERM arrive before
+	// listenForInterrupt registered for it.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGTERM)
+	defer signal.Stop(guard)
+
+	q := make(chan struct{})
+	go listenForInterrupt(q)
+
+	timeout := time.After(time.Second)
+	for {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatalf("failed to send SIGTERM err=%v", err)
+		}
+		select {
+		case <-q:
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("SIGTERM did not close the quit channel")
+		}
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,24 +23,57 @@ import (
 type consumeCmd struct {
 	sync.Mutex
 
-	topic       string
-	brokers     []string
-	tlsCA       string
-	tlsCert     string
-	tlsCertKey  string
-	offsets     map[int32]interval
-	timeout     time.Duration
-	verbose     bool
-	version     sarama.KafkaVersion
-	encodeValue string
-	encodeKey   string
-	pretty      bool
-	group       string
+	topics     []string
+	topicRegex *regexp.Regexp
+	brokers    []string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	offsets    map[int32]interval
+
+	// topicOffsets holds the intervals of topics that have their own in
+	// -offsets, other topics use offsets.
+	topicOffsets map[string]map[int32]interval
+	timeout      time.Duration
+	verbose      bool
+	version      sarama.KafkaVersion
+	encodeValue  string
+	encodeKey    string
+	pretty       bool
+	group        string
+	caughtUp     bool
+	outOfRange   string
+	isolation    sarama.IsolationLevel
+	refresh      time.Duration
+	mergeByTime  bool
+	mergeMaxLag  time.Duration
 
 	client        sarama.Client
 	consumer      sarama.Consumer
 	offsetManager sarama.OffsetManager
-	poms          map[int32]sarama.PartitionOffsetManager
+	poms          map[topicPartition]sarama.PartitionOffsetManager
+	quit          chan struct{}
+	stats         map[topicPartition]*consumePartitionSummary
+	failed        map[topicPartition]error
+	discovered    map[topicPartition]bool
+	running       int
+	consumed      chan struct{}
+	merge         *consumeMerge
+}
+
+// consumeSummary is printed to stderr when consume is interrupted.
+type consumeSummary struct {
+	Messages   int64                     `json:"messages"`
+	Bytes      int64                     `json:"bytes"`
+	Partitions []consumePartitionSummary `json:"partitions"`
+}
+
+type consumePartitionSummary struct {
+	Topic      string `json:"topic"`
+	Partition  int32  `json:"partition"`
+	Messages   int64  `json:"messages"`
+	Bytes      int64  `json:"bytes"`
+	LastOffset *int64 `json:"lastOffset"`
 }
 
 var offsetResume int64 = -3
@@ -48,7 +84,23 @@ type offset struct {
 	diff     int64
 }
 
-func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
+func (cmd *consumeCmd) resolveOffset(o offset, tp topicPartition) (int64, error) {
+	if o.relative && o.start == offsetResume {
+		if cmd.group == "" {
+			return 0, fmt.Errorf("cannot resume without -group argument")
+		}
+		pom := cmd.getPOM(tp)
+		next, _ := pom.NextOffset()
+		return next, nil
+	}
+
+	return resolveOffset(cmd.client, tp.topic, tp.partition, o)
+}
+
+// resolveOffset turns o into an absolute offset for the given partition,
+// asking the cluster for the oldest and newest offsets where necessary. It
+// does not support offsetResume as that requires a consumer group.
+func resolveOffset(client sarama.Client, topic string, partition int32, o offset) (int64, error) {
 	if !o.relative {
 		return o.start, nil
 	}
@@ -58,8 +110,9 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 		err error
 	)
 
-	if o.start == sarama.OffsetNewest || o.start == sarama.OffsetOldest {
-		if res, err = cmd.client.GetOffset(cmd.topic, partition, o.start); err != nil {
+	switch o.start {
+	case sarama.OffsetNewest, sarama.OffsetOldest:
+		if res, err = client.GetOffset(topic, partition, o.start); err != nil {
 			return 0, err
 		}
 
@@ -68,13 +121,8 @@ func (cmd *consumeCmd) resolveOffset(o offset, partition int32) (int64, error) {
 		}
 
 		return res + o.diff, nil
-	} else if o.start == offsetResume {
-		if cmd.group == "" {
-			return 0, fmt.Errorf("cannot resume without -group argument")
-		}
-		pom := cmd.getPOM(partition)
-		next, _ := pom.NextOffset()
-		return next, nil
+	case offsetResume:
+		return 0, fmt.Errorf("cannot resume without -group argument")
 	}
 
 	return o.start + o.diff, nil
@@ -87,6 +135,7 @@ type interval struct {
 
 type consumeArgs struct {
 	topic       string
+	topicRegex  string
 	brokers     string
 	tlsCA       string
 	tlsCert     string
@@ -99,6 +148,12 @@ type consumeArgs struct {
 	encodeKey   string
 	pretty      bool
 	group       string
+	caughtUp    bool
+	outOfRange  string
+	isolation   string
+	refresh     time.Duration
+	mergeByTime bool
+	mergeMaxLag time.Duration
 }
 
 func parseOffset(str string) (offset, error) {
@@ -203,9 +258,77 @@ func parseOffsets(str string) (map[int32]interval, error) {
 	return result, nil
 }
 
+// offsetSyntax matches a single offset of -offsets as parsed by parseOffset.
+var offsetSyntax = regexp.MustCompile(`^(oldest|newest|resume)?(-|\+)?(\d+)?$`)
+
+// splitTopic splits the optional "topic:" prefix off an interval of -offsets.
+// The text before the first colon is only a topic when it's not part of the
+// interval itself, i.e. neither names a partition nor is an offset.
+func splitTopic(info string) (string, string) {
+	i := strings.Index(info, ":")
+	if i < 0 {
+		return "", info
+	}
+
+	prefix := strings.TrimSpace(info[:i])
+	if prefix == "" || strings.Contains(prefix, "=") || offsetSyntax.MatchString(prefix) {
+		return "", info
+	}
+	return prefix, info[i+1:]
+}
+
+// parseTopicOffsets parses -offsets, grouping the intervals with a topic
+// prefix by topic. The intervals without prefix are parsed like parseOffsets
+// and apply to all topics that have no intervals of their own.
+func parseTopicOffsets(str string) (map[int32]interval, map[string]map[int32]interval, error) {
+	var (
+		general []string
+		byTopic = map[string][]string{}
+	)
+
+	if len(str) > 0 {
+		for _, info := range strings.Split(str, ",") {
+			topic, rest := splitTopic(info)
+			if topic == "" {
+				general = append(general, info)
+				continue
+			}
+			byTopic[topic] = append(byTopic[topic], rest)
+		}
+	}
+
+	offsets, err := parseOffsets(strings.Join(general, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topicOffsets := map[string]map[int32]interval{}
+	for topic, infos := range byTopic {
+		if topicOffsets[topic], err = parseOffsets(strings.Join(infos, ",")); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return offsets, topicOffsets, nil
+}
+
+// intervals returns the intervals to consume of the given topic by partition,
+// -1 being the default for all partitions.
+func (cmd *consumeCmd) intervals(topic string) map[int32]interval {
+	if offsets, ok := cmd.topicOffsets[topic]; ok {
+		return offsets
+	}
+	return cmd.offsets
+}
+
+// multiTopic reports whether messages of more than one topic may be consumed,
+// in which case the consumed messages include their topic.
+func (cmd *consumeCmd) multiTopic() bool {
+	return cmd.topicRegex != nil || len(cmd.topics) > 1
+}
+
 func (cmd *consumeCmd) failStartup(msg string) {
-	fmt.Fprintln(os.Stderr, msg)
-	failf("use \"kt consume -help\" for more information")
+	failUsage(msg, "use \"kt consume -help\" for more information")
 }
 
 func (cmd *consumeCmd) parseArgs(as []string) {
@@ -214,15 +337,30 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 		args = cmd.parseFlags(as)
 	)
 
-	envTopic := os.Getenv("KT_TOPIC")
-	if args.topic == "" {
-		if envTopic == "" {
-			cmd.failStartup("Topic name is required.")
+	if args.topic == "" && args.topicRegex == "" {
+		args.topic = os.Getenv("KT_TOPIC")
+	}
+
+	switch {
+	case args.topic != "" && args.topicRegex != "":
+		cmd.failStartup("Use either -topic or -topic-regex.")
+		return
+	case args.topicRegex != "":
+		if cmd.topicRegex, err = regexp.Compile(args.topicRegex); err != nil {
+			cmd.failStartup(fmt.Sprintf("Invalid -topic-regex %#v err=%v", args.topicRegex, err))
 			return
 		}
-		args.topic = envTopic
+	case args.topic == "":
+		cmd.failStartup("Topic name is required.")
+		return
+	}
+
+	cmd.topics = nil
+	for _, t := range strings.Split(args.topic, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cmd.topics = append(cmd.topics, t)
+		}
 	}
-	cmd.topic = args.topic
 	cmd.tlsCA = args.tlsCA
 	cmd.tlsCert = args.tlsCert
 	cmd.tlsCertKey = args.tlsCertKey
@@ -231,6 +369,28 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 	cmd.pretty = args.pretty
 	cmd.version = kafkaVersion(args.version)
 	cmd.group = args.group
+	cmd.caughtUp = args.caughtUp
+	cmd.refresh = args.refresh
+
+	if args.outOfRange != "oldest" && args.outOfRange != "newest" && args.outOfRange != "fail" {
+		cmd.failStartup(fmt.Sprintf(`unsupported offset-out-of-range argument %#v, only oldest, newest and fail are supported.`, args.outOfRange))
+		return
+	}
+	cmd.outOfRange = args.outOfRange
+
+	switch args.isolation {
+	case "read_uncommitted":
+		cmd.isolation = sarama.ReadUncommitted
+	case "read_committed":
+		if !cmd.version.IsAtLeast(sarama.V0_11_0_0) {
+			cmd.failStartup("-isolation read_committed requires -version 0.11.0.0 or later.")
+			return
+		}
+		cmd.isolation = sarama.ReadCommitted
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported isolation argument %#v, only read_uncommitted and read_committed are supported.`, args.isolation))
+		return
+	}
 
 	if args.encodeValue != "string" && args.encodeValue != "hex" && args.encodeValue != "base64" {
 		cmd.failStartup(fmt.Sprintf(`unsupported encodevalue argument %#v, only string, hex and base64 are supported.`, args.encodeValue))
@@ -259,7 +419,13 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 		}
 	}
 
-	cmd.offsets, err = parseOffsets(args.offsets)
+	if args.mergeMaxLag < 0 {
+		cmd.failStartup(fmt.Sprintf("Invalid -merge-max-lag %v", args.mergeMaxLag))
+	}
+	cmd.mergeByTime = args.mergeByTime
+	cmd.mergeMaxLag = args.mergeMaxLag
+
+	cmd.offsets, cmd.topicOffsets, err = parseTopicOffsets(args.offsets)
 	if err != nil {
 		cmd.failStartup(fmt.Sprintf("%s", err))
 	}
@@ -268,12 +434,13 @@ func (cmd *consumeCmd) parseArgs(as []string) {
 func (cmd *consumeCmd) parseFlags(as []string) consumeArgs {
 	var args consumeArgs
 	flags := flag.NewFlagSet("consume", flag.ContinueOnError)
-	flags.StringVar(&args.topic, "topic", "", "Topic to consume (required).")
+	flags.StringVar(&args.topic, "topic", "", "Comma separated list of topics to consume (required unless -topic-regex is given).")
+	flags.StringVar(&args.topicRegex, "topic-regex", "", "Consume all topics matching the regular expression, checking for new ones every -refresh interval.")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
 	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
 	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
-	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by partition and offset range (defaults to all).")
+	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by topic, partition and offset range (defaults to all).")
 	flags.DurationVar(&args.timeout, "timeout", time.Duration(0), "Timeout after not reading messages (default 0 to disable).")
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
@@ -281,6 +448,14 @@ func (cmd *consumeCmd) parseFlags(as []string) consumeArgs {
 	flags.StringVar(&args.encodeValue, "encodevalue", "string", "Present message value as (string|hex|base64), defaults to string.")
 	flags.StringVar(&args.encodeKey, "encodekey", "string", "Present message key as (string|hex|base64), defaults to string.")
 	flags.StringVar(&args.group, "group", "", "Consumer group to use for marking offsets. kt will mark offsets if this arg is supplied.")
+	flags.StringVar(&args.outOfRange, "offset-out-of-range", "fail", "Continue a partition whose offset went out of range at its (oldest|newest) offset, or (fail) to stop consuming it.")
+	flags.DurationVar(&args.refresh, "refresh", 30*time.Second, "Interval to check the topics for new partitions, and -topic-regex for new topics (0 to disable).")
+	flags.BoolVar(&args.caughtUp, "until-caught-up", false, "Stop consuming each partition once it reaches the high water mark captured at startup.")
+	flags.StringVar(&args.isolation, "isolation", "read_uncommitted", "Read the records of open and aborted transactions (read_uncommitted) or only committed ones (read_committed).")
+	flags.BoolVar(&args.mergeByTime, "merge-by-timestamp", false, "Print the messages of all partitions in timestamp order.")
+	flags.DurationVar(&args.mergeMaxLag, "merge-max-lag", 5*time.Second, "Longest time -merge-by-timestamp holds a message waiting for partitions without messages (0 to wait for all partitions).")
+
+	addErrorsFlag(flags)
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of consume:")
@@ -306,9 +481,10 @@ func (cmd *consumeCmd) setupClient() {
 	)
 	cfg.Version = cmd.version
 	if usr, err = user.Current(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+		warnf("Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-consume-" + sanitizeUsername(usr.Username)
+	cfg.Consumer.Return.Errors = true
 	if cmd.verbose {
 		fmt.Fprintf(os.Stderr, "sarama client configuration %#v\n", cfg)
 	}
@@ -344,12 +520,77 @@ func (cmd *consumeCmd) run(args []string) {
 	defer logClose("consumer", cmd.consumer)
 
 	partitions := cmd.findPartitions()
-	if len(partitions) == 0 {
+	if len(partitions) == 0 && !cmd.followTopics() {
 		failf("Found no partitions to consume")
 	}
-	defer cmd.closePOMs()
+
+	cmd.quit = make(chan struct{})
+	go listenForInterrupt(cmd.quit)
 
 	cmd.consume(partitions)
+	cmd.closePOMs()
+
+	// quit is only closed by an interrupt.
+	select {
+	case <-cmd.quit:
+		cmd.printSummary()
+	default:
+	}
+
+	cmd.exitFailed(len(cmd.stats))
+}
+
+// exitFailed exits with an error when partitions had to be given up on: as a
+// failure when all of them failed, as partial results otherwise.
+func (cmd *consumeCmd) exitFailed(total int) {
+	if len(cmd.failed) == 0 {
+		return
+	}
+
+	var (
+		partitions []topicPartition
+		ids        []string
+		err        error
+	)
+	for tp, e := range cmd.failed {
+		partitions = append(partitions, tp)
+		err = e
+	}
+	sortTopicPartitions(partitions)
+	for _, tp := range partitions {
+		ids = append(ids, fmt.Sprintf("%v:%v", tp.topic, tp.partition))
+	}
+
+	if len(cmd.failed) == total {
+		failf("failed to consume all partitions of topics=%v err=%v", strings.Join(cmd.consumedTopics(), ","), err)
+	}
+	failPartial("failed to consume partitions=%v", strings.Join(ids, ","))
+}
+
+// consumedTopics returns the sorted names of the topics consumed so far.
+func (cmd *consumeCmd) consumedTopics() []string {
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	seen := map[string]bool{}
+	topics := []string{}
+	for tp := range cmd.stats {
+		if !seen[tp.topic] {
+			seen[tp.topic] = true
+			topics = append(topics, tp.topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func sortTopicPartitions(tps []topicPartition) {
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
 }
 
 func (cmd *consumeCmd) setupOffsetManager() {
@@ -363,54 +604,438 @@ func (cmd *consumeCmd) setupOffsetManager() {
 	}
 }
 
-func (cmd *consumeCmd) consume(partitions []int32) {
-	var (
-		wg  sync.WaitGroup
-		out = make(chan printContext)
-	)
-
+func (cmd *consumeCmd) consume(partitions []topicPartition) {
+	out := make(chan printContext)
 	go print(out, cmd.pretty)
 
-	wg.Add(len(partitions))
+	cmd.stats = map[topicPartition]*consumePartitionSummary{}
+	cmd.consumed = make(chan struct{})
+
+	if cmd.mergeByTime {
+		cmd.merge = newConsumeMerge(out, cmd.mergeMaxLag)
+		go cmd.merge.run()
+	}
+
+	// hold a reference while starting partitions so that consumed isn't closed
+	// before all of them started. When following -topic-regex the refresh
+	// holds one until it stops, as matching topics may still be created.
+	cmd.Lock()
+	cmd.running++
+	if cmd.followTopics() {
+		cmd.running++
+	}
+	cmd.Unlock()
+
+	for _, tp := range partitions {
+		cmd.startPartition(out, tp)
+	}
+
+	if cmd.followTopics() || (cmd.refresh > 0 && cmd.hasDefaultInterval(partitions)) {
+		go cmd.refreshPartitions(out, partitions)
+	}
+
+	cmd.partitionDone()
+	<-cmd.consumed
+
+	if cmd.merge != nil {
+		cmd.merge.flush()
+	}
+}
+
+// followTopics reports whether topics matching -topic-regex that are created
+// while consuming should be consumed too. -until-caught-up reads a snapshot of
+// the topics matching at startup instead.
+func (cmd *consumeCmd) followTopics() bool {
+	return cmd.topicRegex != nil && cmd.refresh > 0 && !cmd.caughtUp
+}
+
+func (cmd *consumeCmd) hasDefaultInterval(partitions []topicPartition) bool {
+	for _, tp := range partitions {
+		if _, ok := cmd.intervals(tp.topic)[-1]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *consumeCmd) startPartition(out chan printContext, tp topicPartition) {
+	cmd.Lock()
+	cmd.stats[tp] = &consumePartitionSummary{Topic: tp.topic, Partition: tp.partition}
+	cmd.running++
+	cmd.Unlock()
+
+	if cmd.merge != nil {
+		cmd.merge.start(tp)
+	}
+
+	go func() {
+		defer cmd.partitionDone()
+		cmd.consumePartition(out, tp)
+		if cmd.merge != nil {
+			cmd.merge.stop(tp)
+		}
+	}()
+}
+
+func (cmd *consumeCmd) partitionDone() {
+	cmd.Lock()
+	cmd.running--
+	if cmd.running == 0 {
+		close(cmd.consumed)
+	}
+	cmd.Unlock()
+}
+
+// consumeRefresh is what refreshPartitions knows about a topic from the
+// previous refresh.
+type consumeRefresh struct {
+	partitions map[int32]bool
+	recreated  map[int32]bool
+	missing    bool
+}
+
+func newConsumeRefresh() *consumeRefresh {
+	return &consumeRefresh{partitions: map[int32]bool{}, recreated: map[int32]bool{}}
+}
+
+// refreshPartitions periodically checks the topics' metadata and starts
+// consuming partitions added since consume started, and with -topic-regex
+// topics created since. It stops when all partitions are consumed or consume
+// is interrupted.
+func (cmd *consumeCmd) refreshPartitions(out chan printContext, partitions []topicPartition) {
+	ticker := time.NewTicker(cmd.refresh)
+	defer ticker.Stop()
+	if cmd.followTopics() {
+		defer cmd.partitionDone()
+	}
+
+	states := map[string]*consumeRefresh{}
+	for _, tp := range partitions {
+		if states[tp.topic] == nil {
+			states[tp.topic] = newConsumeRefresh()
+		}
+		states[tp.topic].partitions[tp.partition] = true
+	}
+
+	for {
+		select {
+		case <-cmd.quit:
+			return
+		case <-cmd.consumed:
+			return
+		case <-ticker.C:
+			if cmd.followTopics() {
+				cmd.refreshTopics(out, states)
+			}
+			for topic, state := range states {
+				if _, ok := cmd.intervals(topic)[-1]; ok {
+					cmd.refreshTopic(out, topic, state)
+				}
+			}
+		}
+	}
+}
+
+// refreshTopics starts consuming the topics matching -topic-regex that were
+// created since the previous refresh, from their oldest offsets.
+func (cmd *consumeCmd) refreshTopics(out chan printContext, states map[string]*consumeRefresh) {
+	if err := cmd.client.RefreshMetadata(); err != nil {
+		warnf("Failed to refresh metadata err=%v", err)
+		return
+	}
+
+	topics, err := cmd.matchingTopics()
+	if err != nil {
+		warnf("Failed to read topics err=%v", err)
+		return
+	}
+
+	for _, topic := range topics {
+		if states[topic] != nil {
+			continue
+		}
+
+		partitions, err := cmd.topicPartitions(topic)
+		if err != nil {
+			warnf("Failed to read partitions for topic %v err=%v", topic, err)
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "found new topic %v\n", topic)
+		states[topic] = newConsumeRefresh()
+		for _, tp := range partitions {
+			cmd.Lock()
+			if cmd.discovered == nil {
+				cmd.discovered = map[topicPartition]bool{}
+			}
+			cmd.discovered[tp] = true
+			cmd.Unlock()
+
+			states[topic].partitions[tp.partition] = true
+			cmd.startPartition(out, tp)
+		}
+	}
+}
+
+func (cmd *consumeCmd) refreshTopic(out chan printContext, topic string, state *consumeRefresh) {
+	if err := cmd.client.RefreshMetadata(topic); err != nil {
+		if err == sarama.ErrUnknownTopicOrPartition {
+			if !state.missing {
+				warnf("topic %v was deleted while consuming it err=%v", topic, err)
+			}
+			state.missing = true
+			return
+		}
+		warnf("Failed to refresh metadata for topic %v err=%v", topic, err)
+		return
+	}
+
+	partitions, err := cmd.client.Partitions(topic)
+	if err != nil {
+		warnf("Failed to read partitions for topic %v err=%v", topic, err)
+		return
+	}
+
+	if state.missing || len(partitions) < len(state.partitions) {
+		warnf("topic %v was recreated while consuming it partitions=%v", topic, len(partitions))
+	}
+	state.missing = false
+	cmd.checkRecreated(topic, state)
+
 	for _, p := range partitions {
-		go func(p int32) { defer wg.Done(); cmd.consumePartition(out, p) }(p)
+		if state.partitions[p] {
+			continue
+		}
+
+		tp := topicPartition{topic, p}
+		cmd.Lock()
+		if cmd.running == 0 {
+			cmd.Unlock()
+			return
+		}
+		if cmd.discovered == nil {
+			cmd.discovered = map[topicPartition]bool{}
+		}
+		cmd.discovered[tp] = true
+		cmd.Unlock()
+
+		fmt.Fprintf(os.Stderr, "found new partition %v of topic %v\n", p, topic)
+		state.partitions[p] = true
+		cmd.startPartition(out, tp)
 	}
-	wg.Wait()
 }
 
-func (cmd *consumeCmd) consumePartition(out chan printContext, partition int32) {
+// checkRecreated warns about partitions whose newest offset is below the
+// offset consumed last, which happens when the topic is deleted and created
+// again between two refreshes.
+func (cmd *consumeCmd) checkRecreated(topic string, state *consumeRefresh) {
+	var partitions []int32
+	for p := range state.partitions {
+		partitions = append(partitions, p)
+	}
+
+	// fetchOffsets returns the offsets of the partitions it could read even
+	// if others failed, their errors were reported by the metadata refresh.
+	newest, _ := fetchOffsets(cmd.client, map[string][]int32{topic: partitions}, sarama.OffsetNewest)
+
+	cmd.Lock()
+	defer cmd.Unlock()
+	for p, offset := range newest[topic] {
+		s, ok := cmd.stats[topicPartition{topic, p}]
+		if !ok || s.LastOffset == nil || offset > *s.LastOffset {
+			delete(state.recreated, p)
+			continue
+		}
+		if !state.recreated[p] {
+			state.recreated[p] = true
+			warnf("topic %v was recreated while consuming it partition=%v newest=%v consumed=%v", topic, p, offset, *s.LastOffset)
+		}
+	}
+}
+
+func (cmd *consumeCmd) summary() consumeSummary {
+	result := consumeSummary{Partitions: []consumePartitionSummary{}}
+	for _, s := range cmd.stats {
+		result.Messages += s.Messages
+		result.Bytes += s.Bytes
+		result.Partitions = append(result.Partitions, *s)
+	}
+	sort.Slice(result.Partitions, func(i, j int) bool {
+		a, b := result.Partitions[i], result.Partitions[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	return result
+}
+
+func (cmd *consumeCmd) printSummary() {
+	buf, err := json.Marshal(cmd.summary())
+	if err != nil {
+		warnf("failed to marshal summary err=%v", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(buf))
+}
+
+// consumeRetryBackoff is the initial wait before a partition is consumed again
+// after a retriable error. It doubles per attempt up to consumeMaxRetryBackoff.
+var (
+	consumeRetryBackoff    = 250 * time.Millisecond
+	consumeMaxRetryBackoff = 10 * time.Second
+)
+
+var errPartitionConsumerClosed = errors.New("partition consumer closed unexpectedly")
+
+func (cmd *consumeCmd) consumePartition(out chan printContext, tp topicPartition) {
 	var (
-		offsets interval
 		err     error
 		pcon    sarama.PartitionConsumer
-		start   int64
+		next    int64
 		end     int64
-		ok      bool
+		skip    bool
+		attempt int
 	)
 
-	if offsets, ok = cmd.offsets[partition]; !ok {
-		offsets, ok = cmd.offsets[-1]
+	for {
+		if next, end, skip, err = cmd.resolveInterval(tp); err == nil {
+			break
+		}
+		warnf("Failed to read offsets for topic %v partition %v err=%v", tp.topic, tp.partition, err)
+		if !cmd.backoff(tp, attempt, err) {
+			return
+		}
+		attempt++
 	}
-
-	if start, err = cmd.resolveOffset(offsets.start, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read start offset for partition %v err=%v\n", partition, err)
+	if skip {
 		return
 	}
 
-	if end, err = cmd.resolveOffset(offsets.end, partition); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read end offset for partition %v err=%v\n", partition, err)
-		return
+	attempt = 0
+	for {
+		if pcon, err = cmd.consumePartitionAt(tp, next); err == nil {
+			if attempt > 0 {
+				fmt.Fprintf(os.Stderr, "topic %v partition %v recovered offset=%v\n", tp.topic, tp.partition, next)
+			}
+			attempt = 0
+			if next, err = cmd.partitionLoop(out, pcon, tp, next, end); err == nil {
+				return
+			}
+		}
+
+		if errors.Is(err, sarama.ErrOffsetOutOfRange) && cmd.outOfRange != "fail" {
+			var reset int64
+			if reset, err = cmd.resetOffset(tp); err == nil {
+				warnf("topic %v partition %v offset out of range offset=%v, continuing at %s offset=%v", tp.topic, tp.partition, next, cmd.outOfRange, reset)
+				next = reset
+				continue
+			}
+		}
+
+		warnf("Failed to consume topic %v partition %v offset=%v err=%v", tp.topic, tp.partition, next, err)
+		if !cmd.backoff(tp, attempt, err) {
+			return
+		}
+		attempt++
 	}
+}
 
-	if pcon, err = cmd.consumer.ConsumePartition(cmd.topic, partition, start); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to consume partition %v err=%v\n", partition, err)
-		return
+// resolveInterval returns the first and last offset to consume for the given
+// partition, and whether there is nothing to consume at all.
+func (cmd *consumeCmd) resolveInterval(tp topicPartition) (int64, int64, bool, error) {
+	intervals := cmd.intervals(tp.topic)
+	offsets, ok := intervals[tp.partition]
+	if !ok {
+		offsets = intervals[-1]
+	}
+
+	// partitions added while consuming start at their oldest offset so that
+	// messages produced before they were discovered aren't skipped.
+	cmd.Lock()
+	if cmd.discovered[tp] {
+		offsets.start = offset{relative: true, start: sarama.OffsetOldest}
+	}
+	cmd.Unlock()
+
+	start, err := cmd.resolveOffset(offsets.start, tp)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	end, err := cmd.resolveOffset(offsets.end, tp)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if cmd.caughtUp {
+		hwm, err := cmd.caughtUpOffset(tp)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if start >= hwm {
+			return start, end, true, nil
+		}
+		if end > hwm-1 {
+			end = hwm - 1
+		}
+	}
+
+	return start, end, false, nil
+}
+
+// caughtUpOffset returns the offset -until-caught-up stops at: the high water
+// mark, or the last stable offset with read_committed, as records after it can
+// still be aborted.
+func (cmd *consumeCmd) caughtUpOffset(tp topicPartition) (int64, error) {
+	if cmd.isolation == sarama.ReadCommitted {
+		return lastStableOffset(cmd.client, tp)
+	}
+	return cmd.client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
+}
+
+// resetOffset returns the offset to continue at after the consumer's offset
+// for the given partition went out of range, according to -offset-out-of-range.
+func (cmd *consumeCmd) resetOffset(tp topicPartition) (int64, error) {
+	if cmd.outOfRange == "newest" {
+		return cmd.client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
 	}
+	return cmd.client.GetOffset(tp.topic, tp.partition, sarama.OffsetOldest)
+}
 
-	cmd.partitionLoop(out, pcon, partition, end)
+// backoff waits before the given partition is consumed again after err. It
+// reports false when err is not retriable, recording the partition as failed,
+// or when consume is interrupted while waiting.
+func (cmd *consumeCmd) backoff(tp topicPartition, attempt int, err error) bool {
+	if !retriable(err) {
+		warnf("Giving up on topic %v partition %v err=%v", tp.topic, tp.partition, err)
+		cmd.Lock()
+		if cmd.failed == nil {
+			cmd.failed = map[topicPartition]error{}
+		}
+		cmd.failed[tp] = err
+		cmd.Unlock()
+		return false
+	}
+
+	wait := consumeRetryBackoff
+	for i := 0; i < attempt && wait < consumeMaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > consumeMaxRetryBackoff {
+		wait = consumeMaxRetryBackoff
+	}
+
+	select {
+	case <-cmd.quit:
+		return false
+	case <-time.After(wait):
+		return true
+	}
 }
 
 type consumedMessage struct {
+	Topic     string     `json:"topic,omitempty"`
 	Partition int32      `json:"partition"`
 	Offset    int64      `json:"offset"`
 	Key       *string    `json:"key"`
@@ -418,7 +1043,9 @@ type consumedMessage struct {
 	Timestamp *time.Time `json:"timestamp,omitempty"`
 }
 
-func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string) consumedMessage {
+// newConsumedMessage converts m for printing, including its topic only when
+// withTopic is set so that consuming a single topic prints what it used to.
+func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string, withTopic bool) consumedMessage {
 	result := consumedMessage{
 		Partition: m.Partition,
 		Offset:    m.Offset,
@@ -426,6 +1053,10 @@ func newConsumedMessage(m *sarama.ConsumerMessage, encodeKey, encodeValue string
 		Value:     encodeBytes(m.Value, encodeValue),
 	}
 
+	if withTopic {
+		result.Topic = m.Topic
+	}
+
 	if !m.Timestamp.IsZero() {
 		result.Timestamp = &m.Timestamp
 	}
@@ -451,48 +1082,78 @@ func encodeBytes(data []byte, encoding string) *string {
 	return &str
 }
 
+// closePOMs commits the marked offsets of all partitions. Closing the offset
+// manager first flushes them in one go rather than waiting for the next commit
+// interval per partition offset manager.
 func (cmd *consumeCmd) closePOMs() {
+	if cmd.offsetManager == nil {
+		return
+	}
+	logClose("offset manager", cmd.offsetManager)
+
 	cmd.Lock()
-	for p, pom := range cmd.poms {
+	for tp, pom := range cmd.poms {
 		if err := pom.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to close partition offset manager for partition %v err=%v", p, err)
+			warnf("failed to close partition offset manager for topic %v partition %v err=%v", tp.topic, tp.partition, err)
 		}
 	}
 	cmd.Unlock()
 }
 
-func (cmd *consumeCmd) getPOM(p int32) sarama.PartitionOffsetManager {
+func (cmd *consumeCmd) getPOM(tp topicPartition) sarama.PartitionOffsetManager {
 	cmd.Lock()
 	if cmd.poms == nil {
-		cmd.poms = map[int32]sarama.PartitionOffsetManager{}
+		cmd.poms = map[topicPartition]sarama.PartitionOffsetManager{}
 	}
-	pom, ok := cmd.poms[p]
+	pom, ok := cmd.poms[tp]
 	if ok {
 		cmd.Unlock()
 		return pom
 	}
 
-	pom, err := cmd.offsetManager.ManagePartition(cmd.topic, p)
+	pom, err := cmd.offsetManager.ManagePartition(tp.topic, tp.partition)
 	if err != nil {
 		cmd.Unlock()
 		failf("failed to create partition offset manager err=%v", err)
 	}
-	cmd.poms[p] = pom
+	cmd.poms[tp] = pom
 	cmd.Unlock()
 	return pom
 }
 
-func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionConsumer, p int32, end int64) {
-	defer logClose(fmt.Sprintf("partition consumer %v", p), pc)
+// consumePartitionAt starts consuming the given partition at offset with the
+// isolation given by -isolation, which sarama's consumer doesn't support.
+func (cmd *consumeCmd) consumePartitionAt(tp topicPartition, offset int64) (sarama.PartitionConsumer, error) {
+	if cmd.isolation == sarama.ReadCommitted {
+		return newCommittedPartitionConsumer(cmd.client, tp, offset), nil
+	}
+	return cmd.consumer.ConsumePartition(tp.topic, tp.partition, offset)
+}
+
+// caughtUpProbeInterval is how long -until-caught-up waits for the next
+// message before checking whether only transaction markers are left.
+var caughtUpProbeInterval = 500 * time.Millisecond
+
+// partitionLoop prints the messages of the given partition starting at next.
+// It returns the offset to continue at and an error if the partition consumer
+// failed before reaching end. Errors the consumer retries itself are reported
+// but don't stop the loop.
+func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionConsumer, tp topicPartition, next, end int64) (int64, error) {
+	defer logClose(fmt.Sprintf("partition consumer %v of topic %v", tp.partition, tp.topic), pc)
 	var (
-		timer   *time.Timer
-		pom     sarama.PartitionOffsetManager
-		timeout = make(<-chan time.Time)
+		timer      *time.Timer
+		probeTimer *time.Timer
+		pom        sarama.PartitionOffsetManager
+		timeout    = make(<-chan time.Time)
+		probe      = make(<-chan time.Time)
 	)
 
 	if cmd.group != "" {
-		pom = cmd.getPOM(p)
+		pom = cmd.getPOM(tp)
 	}
+	cmd.Lock()
+	stats := cmd.stats[tp]
+	cmd.Unlock()
 
 	for {
 		if cmd.timeout > 0 {
@@ -503,67 +1164,212 @@ func (cmd *consumeCmd) partitionLoop(out chan printContext, pc sarama.PartitionC
 			timeout = timer.C
 		}
 
+		if cmd.caughtUp {
+			if probeTimer != nil {
+				probeTimer.Stop()
+			}
+			probeTimer = time.NewTimer(caughtUpProbeInterval)
+			probe = probeTimer.C
+		}
+
 		select {
+		case <-cmd.quit:
+			return next, nil
+		case <-probe:
+			if cmd.onlySkippedRecords(tp, next, end+1) {
+				return next, nil
+			}
+		case err, ok := <-pc.Errors():
+			if !ok {
+				return next, errPartitionConsumerClosed
+			}
+			if err.Err == sarama.ErrOffsetOutOfRange {
+				return next, err.Err
+			}
+			warnf("topic %v partition %v consumer encountered err=%v", tp.topic, tp.partition, err.Err)
 		case <-timeout:
-			fmt.Fprintf(os.Stderr, "consuming from partition %v timed out after %s\n", p, cmd.timeout)
-			return
-		case err := <-pc.Errors():
-			fmt.Fprintf(os.Stderr, "partition %v consumer encountered err %s", p, err)
-			return
+			fmt.Fprintf(os.Stderr, "consuming from topic %v partition %v timed out after %s\n", tp.topic, tp.partition, cmd.timeout)
+			return next, nil
 		case msg, ok := <-pc.Messages():
 			if !ok {
-				fmt.Fprintf(os.Stderr, "unexpected closed messages chan")
-				return
+				return next, cmd.closedReason(pc)
 			}
 
-			m := newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue)
-			ctx := printContext{output: m, done: make(chan struct{})}
-			out <- ctx
-			<-ctx.done
+			m := newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue, cmd.multiTopic())
+			if cmd.merge != nil {
+				// the merge marks the message as consumed once it's printed.
+				cmd.merge.in <- mergeMessage{tp: tp, offset: msg.Offset, timestamp: msg.Timestamp, received: time.Now(), output: m, pom: pom}
+			} else {
+				ctx := printContext{output: m, done: make(chan struct{})}
+				out <- ctx
+				<-ctx.done
+
+				if cmd.group != "" {
+					pom.MarkOffset(msg.Offset+1, "")
+				}
+			}
 
-			if cmd.group != "" {
-				pom.MarkOffset(msg.Offset+1, "")
+			if stats != nil {
+				offset := msg.Offset
+				cmd.Lock()
+				stats.Messages++
+				stats.Bytes += int64(len(msg.Key) + len(msg.Value))
+				stats.LastOffset = &offset
+				cmd.Unlock()
 			}
 
-			if end > 0 && msg.Offset >= end {
-				return
+			next = msg.Offset + 1
+			if (end > 0 || cmd.caughtUp) && msg.Offset >= end {
+				return next, nil
 			}
 		}
 	}
 }
 
-func (cmd *consumeCmd) findPartitions() []int32 {
-	var (
-		all []int32
-		res []int32
-		err error
-	)
-	if all, err = cmd.consumer.Partitions(cmd.topic); err != nil {
-		failf("failed to read partitions for topic %v err=%v", cmd.topic, err)
+// closedReason returns why the consumer closed its messages channel. sarama
+// only shuts down a partition consumer by itself when its offset went out of
+// range, reporting that on the errors channel first.
+func (cmd *consumeCmd) closedReason(pc sarama.PartitionConsumer) error {
+	for err := range pc.Errors() {
+		if err.Err == sarama.ErrOffsetOutOfRange {
+			return err.Err
+		}
 	}
+	return errPartitionConsumerClosed
+}
 
-	if _, hasDefault := cmd.offsets[-1]; hasDefault {
-		return all
+// onlySkippedRecords reports whether the offsets between from and to of the
+// given partition hold nothing the consumer delivers: transaction markers, and
+// with read_committed the records of aborted transactions.
+func (cmd *consumeCmd) onlySkippedRecords(tp topicPartition, from, to int64) bool {
+	if cmd.isolation != sarama.ReadCommitted {
+		return onlyControlRecords(cmd.client, cmd.version, tp, from, to)
 	}
 
-	for _, p := range all {
-		if _, ok := cmd.offsets[p]; ok {
-			res = append(res, p)
+	block, err := fetchCommitted(cmd.client, tp, from, committedFetchSize, 0)
+	if err != nil {
+		return false
+	}
+	msgs, next := committedMessages(tp, block, from)
+	return len(msgs) == 0 && next >= to
+}
+
+// onlyControlRecords reports whether the offsets between from and to of the
+// given partition hold nothing but transaction markers. The consumer skips
+// these without delivering a message, so a partition ending in a commit or
+// abort marker would otherwise never look caught up.
+func onlyControlRecords(client sarama.Client, version sarama.KafkaVersion, tp topicPartition, from, to int64) bool {
+	if !version.IsAtLeast(sarama.V0_11_0_0) {
+		return false
+	}
+
+	broker, err := client.Leader(tp.topic, tp.partition)
+	if err != nil {
+		return false
+	}
+
+	req := &sarama.FetchRequest{Version: 4, MaxBytes: sarama.MaxResponseSize}
+	req.AddBlock(tp.topic, tp.partition, from, 1<<20)
+	resp, err := broker.Fetch(req)
+	if err != nil {
+		return false
+	}
+
+	block := resp.GetBlock(tp.topic, tp.partition)
+	if block == nil || block.Err != sarama.ErrNoError {
+		return false
+	}
+
+	next := from
+	for _, records := range block.RecordsSet {
+		batch := records.RecordBatch
+		if batch == nil || !batch.Control {
+			return false
+		}
+		next = batch.FirstOffset + int64(batch.LastOffsetDelta) + 1
+	}
+
+	return next >= to
+}
+
+// findPartitions returns the partitions to consume of all topics given by
+// -topic or matching -topic-regex.
+func (cmd *consumeCmd) findPartitions() []topicPartition {
+	topics := cmd.topics
+	if cmd.topicRegex != nil {
+		var err error
+		if topics, err = cmd.matchingTopics(); err != nil {
+			failf("failed to read topics err=%v", err)
 		}
 	}
 
+	var res []topicPartition
+	for _, topic := range topics {
+		partitions, err := cmd.topicPartitions(topic)
+		if err != nil {
+			failf("failed to read partitions for topic %v err=%v", topic, err)
+		}
+		res = append(res, partitions...)
+	}
+
 	return res
 }
 
+// matchingTopics returns the sorted names of the topics matching -topic-regex.
+func (cmd *consumeCmd) matchingTopics() ([]string, error) {
+	all, err := cmd.consumer.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, topic := range all {
+		if cmd.topicRegex.MatchString(topic) {
+			res = append(res, topic)
+		}
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// topicPartitions returns the partitions of the given topic that -offsets
+// selects for consuming.
+func (cmd *consumeCmd) topicPartitions(topic string) ([]topicPartition, error) {
+	all, err := cmd.consumer.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	intervals := cmd.intervals(topic)
+	_, hasDefault := intervals[-1]
+
+	var res []topicPartition
+	for _, p := range all {
+		if _, ok := intervals[p]; ok || hasDefault {
+			res = append(res, topicPartition{topic, p})
+		}
+	}
+
+	return res, nil
+}
+
 var consumeDocString = `
 The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
 
+-topic takes a comma-separated list of topics, -topic-regex consumes all topics
+matching a regular expression. When consuming more than one topic, each
+message includes its topic.
+
 Offsets can be specified as a comma-separated list of intervals:
 
-  [[partition=start:end],...]
+  [[topic:][partition=start:end],...]
 
-The default is to consume from the oldest offset on every partition for the given topic.
+The default is to consume from the oldest offset on every partition for the given topics.
+
+ - topic limits the interval to the given topic. Topics with intervals of their
+   own ignore the intervals without topic.
 
  - partition is the numeric identifier for a partition. You can use "all" to
    specify a default interval for all partitions.
@@ -644,4 +1450,49 @@ and
 
 Will achieve the same as the two examples above.
 
+To consume topic orders from partition 0 onwards from offset 5, and the last 10
+messages of every partition of the other topics:
+
+  orders:0=5:,-10:
+
+kt keeps consuming a partition through leader changes and broker restarts,
+retrying with backoff and reporting each failure on stderr. When a partition's
+offset goes out of range, e.g. because retention deleted the messages, it
+continues at the oldest or newest offset as per -offset-out-of-range, or gives
+up on that partition. kt exits with 3 when it gave up on some partitions and
+with an error when it gave up on all of them.
+
+When consuming all partitions, kt checks the topics every -refresh interval and
+starts consuming partitions added in the meantime from their oldest offset. It
+warns when a topic is deleted or recreated while consuming it. With
+-topic-regex, matching topics created in the meantime are consumed from their
+oldest offset too.
+
+With -until-caught-up, kt captures each partition's high water mark at startup
+and exits once every partition reached it, skipping partitions that are already
+caught up. Trailing transaction markers are recognized. By default kt reads
+with read_uncommitted isolation, so the snapshot can include records of open or
+aborted transactions. With -isolation read_committed, which requires -version
+0.11.0.0 or later, kt skips the records of aborted transactions and only reads
+up to the last stable offset, i.e. the first offset of a transaction that is
+still open. -until-caught-up then captures the last stable offset rather than
+the high water mark.
+
+With -merge-by-timestamp, kt buffers the messages of each partition and prints
+the messages of all partitions ordered by timestamp. Messages with equal
+timestamps are ordered by topic, partition and offset, and the messages of a
+partition always stay in offset order. A message is printed once every
+partition still being consumed has a message buffered, or after waiting for
+-merge-max-lag, which keeps tailing topics with idle partitions going. Messages
+arriving after a later one was printed are late: they're buffered like the
+others and, being the earliest, printed next, out of timestamp order rather than
+dropped. Their number is reported on stderr when kt exits. Messages without
+timestamp take the timestamp of the message before them in their partition.
+With -group, messages are marked as consumed once they're printed, so offsets
+of buffered messages aren't committed before they're written.
+
+On SIGINT or SIGTERM, kt stops fetching, finishes writing the message in flight,
+commits the consumed offsets when -group is set and prints a JSON summary of
+messages and bytes per partition to stderr. A second signal exits immediately.
+
 `
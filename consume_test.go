@@ -3,11 +3,13 @@ package main
 import (
 	"os"
 	"reflect"
+	"regexp"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseOffsets(t *testing.T) {
@@ -309,15 +311,35 @@ Input:    %v
 
 }
 
+func TestParseTopicOffsets(t *testing.T) {
+	offsets, topicOffsets, err := parseTopicOffsets("orders:0=5:10,orders:1,payments.eu:newest-2:,3=oldest:,resume:")
+	require.NoError(t, err)
+	require.Equal(t, map[int32]interval{
+		3:  {offset{true, sarama.OffsetOldest, 0}, offset{false, 1<<63 - 1, 0}},
+		-1: {offset{true, offsetResume, 0}, offset{false, 1<<63 - 1, 0}},
+	}, offsets)
+	require.Equal(t, map[string]map[int32]interval{
+		"orders": {
+			0: {offset{false, 5, 0}, offset{false, 10, 0}},
+			1: {offset{true, sarama.OffsetOldest, 0}, offset{false, 1<<63 - 1, 0}},
+		},
+		"payments.eu": {
+			-1: {offset{true, sarama.OffsetNewest, -2}, offset{false, 1<<63 - 1, 0}},
+		},
+	}, topicOffsets)
+}
+
 func TestFindPartitionsToConsume(t *testing.T) {
 	data := []struct {
-		topic    string
-		offsets  map[int32]interval
-		consumer tConsumer
-		expected []int32
+		topics       []string
+		topicRegex   string
+		offsets      map[int32]interval
+		topicOffsets map[string]map[int32]interval
+		consumer     tConsumer
+		expected     []topicPartition
 	}{
 		{
-			topic: "a",
+			topics: []string{"a"},
 			offsets: map[int32]interval{
 				10: {offset{false, 2, 0}, offset{false, 4, 0}},
 			},
@@ -330,10 +352,10 @@ func TestFindPartitionsToConsume(t *testing.T) {
 				consumePartitionErr: map[tConsumePartition]error{},
 				closeErr:            nil,
 			},
-			expected: []int32{10},
+			expected: []topicPartition{{"a", 10}},
 		},
 		{
-			topic: "a",
+			topics: []string{"a"},
 			offsets: map[int32]interval{
 				-1: {offset{false, 3, 0}, offset{false, 41, 0}},
 			},
@@ -346,15 +368,43 @@ func TestFindPartitionsToConsume(t *testing.T) {
 				consumePartitionErr: map[tConsumePartition]error{},
 				closeErr:            nil,
 			},
-			expected: []int32{0, 10},
+			expected: []topicPartition{{"a", 0}, {"a", 10}},
+		},
+		{
+			topics: []string{"a", "b"},
+			offsets: map[int32]interval{
+				-1: {offset{false, 3, 0}, offset{false, 41, 0}},
+			},
+			topicOffsets: map[string]map[int32]interval{
+				"b": {1: {offset{false, 0, 0}, offset{false, 9, 0}}},
+			},
+			consumer: tConsumer{
+				partitions: map[string][]int32{"a": {0, 1}, "b": {0, 1}},
+			},
+			expected: []topicPartition{{"a", 0}, {"a", 1}, {"b", 1}},
+		},
+		{
+			topicRegex: "^orders-",
+			offsets: map[int32]interval{
+				-1: {offset{false, 3, 0}, offset{false, 41, 0}},
+			},
+			consumer: tConsumer{
+				topics:     []string{"payments", "orders-eu", "orders-us"},
+				partitions: map[string][]int32{"orders-eu": {0}, "orders-us": {0, 1}, "payments": {0}},
+			},
+			expected: []topicPartition{{"orders-eu", 0}, {"orders-us", 0}, {"orders-us", 1}},
 		},
 	}
 
 	for _, d := range data {
 		target := &consumeCmd{
-			consumer: d.consumer,
-			topic:    d.topic,
-			offsets:  d.offsets,
+			consumer:     d.consumer,
+			topics:       d.topics,
+			offsets:      d.offsets,
+			topicOffsets: d.topicOffsets,
+		}
+		if d.topicRegex != "" {
+			target.topicRegex = regexp.MustCompile(d.topicRegex)
 		}
 		actual := target.findPartitions()
 
@@ -363,11 +413,11 @@ func TestFindPartitionsToConsume(t *testing.T) {
 				`
 Expected: %#v
 Actual:   %#v
-Input:    topic=%#v offsets=%#v
+Input:    topics=%#v offsets=%#v
 	`,
 				d.expected,
 				actual,
-				d.topic,
+				d.topics,
 				d.offsets,
 			)
 			return
@@ -386,9 +436,9 @@ func TestConsume(t *testing.T) {
 		},
 		calls: calls,
 	}
-	partitions := []int32{1, 2}
+	partitions := []topicPartition{{"hans", 1}, {"hans", 2}}
 	target := consumeCmd{consumer: consumer}
-	target.topic = "hans"
+	target.topics = []string{"hans"}
 	target.brokers = []string{"localhost:9092"}
 	target.offsets = map[int32]interval{
 		-1: interval{start: offset{false, 1, 0}, end: offset{false, 5, 0}},
@@ -521,7 +571,7 @@ func TestConsumeParseArgs(t *testing.T) {
 	target := &consumeCmd{}
 
 	target.parseArgs([]string{})
-	if target.topic != topic ||
+	if !reflect.DeepEqual(target.topics, []string{topic}) ||
 		!reflect.DeepEqual(target.brokers, brokers) {
 		t.Errorf("Expected topic %#v and brokers %#v from env vars, got %#v.", topic, brokers, target)
 		return
@@ -533,7 +583,7 @@ func TestConsumeParseArgs(t *testing.T) {
 	brokers = []string{"localhost:9092"}
 
 	target.parseArgs([]string{"-topic", topic})
-	if target.topic != topic ||
+	if !reflect.DeepEqual(target.topics, []string{topic}) ||
 		!reflect.DeepEqual(target.brokers, brokers) {
 		t.Errorf("Expected topic %#v and brokers %#v from env vars, got %#v.", topic, brokers, target)
 		return
@@ -545,9 +595,324 @@ func TestConsumeParseArgs(t *testing.T) {
 	brokers = []string{givenBroker}
 
 	target.parseArgs([]string{"-topic", topic, "-brokers", givenBroker})
-	if target.topic != topic ||
+	if !reflect.DeepEqual(target.topics, []string{topic}) ||
 		!reflect.DeepEqual(target.brokers, brokers) {
 		t.Errorf("Expected topic %#v and brokers %#v from env vars, got %#v.", topic, brokers, target)
 		return
 	}
+
+	target.parseArgs([]string{"-topic", "orders, payments", "-offsets", "payments:0=5:,newest"})
+	require.Equal(t, []string{"orders", "payments"}, target.topics)
+	require.True(t, target.multiTopic())
+	require.Equal(t, map[int32]interval{0: {offset{false, 5, 0}, offset{false, 1<<63 - 1, 0}}}, target.intervals("payments"))
+	require.Equal(t, target.offsets, target.intervals("orders"))
+
+	target.parseArgs([]string{"-topic-regex", "^orders-"})
+	require.Nil(t, target.topics)
+	require.Equal(t, "^orders-", target.topicRegex.String())
+}
+
+func TestConsumePartitionLoopSummary(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 3)
+	messages <- &sarama.ConsumerMessage{Partition: 1, Offset: 4, Key: []byte("k"), Value: []byte("val")}
+	messages <- &sarama.ConsumerMessage{Partition: 1, Offset: 5, Value: []byte("value")}
+	messages <- &sarama.ConsumerMessage{Partition: 1, Offset: 6, Value: []byte("ignored")}
+
+	target := &consumeCmd{
+		quit: make(chan struct{}),
+		stats: map[topicPartition]*consumePartitionSummary{
+			{"orders", 0}: &consumePartitionSummary{Topic: "orders", Partition: 0},
+			{"orders", 1}: &consumePartitionSummary{Topic: "orders", Partition: 1},
+		},
+	}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.partitionLoop(out, tPartitionConsumer{messages: messages}, topicPartition{"orders", 1}, 4, 5)
+
+	lastOffset := int64(5)
+	require.Equal(t, consumeSummary{
+		Messages: 2,
+		Bytes:    9,
+		Partitions: []consumePartitionSummary{
+			{Topic: "orders", Partition: 0},
+			{Topic: "orders", Partition: 1, Messages: 2, Bytes: 9, LastOffset: &lastOffset},
+		},
+	}, target.summary())
+
+	close(target.quit)
+	done := make(chan struct{})
+	go func() {
+		target.partitionLoop(out, tPartitionConsumer{messages: messages}, topicPartition{"orders", 0}, 0, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("partition loop did not return after quit was closed")
+	}
+}
+
+func TestConsumeOnlyControlRecords(t *testing.T) {
+	data := []struct {
+		testName string
+		control  bool
+		expected bool
+	}{
+		{"commit marker", true, true},
+		{"pending message", false, false},
+	}
+
+	for _, d := range data {
+		t.Run(d.testName, func(t *testing.T) {
+			fetch := &sarama.FetchResponse{Version: 4}
+			fetch.AddRecord("orders", 0, nil, sarama.StringEncoder("marker"), 0)
+			batch := fetch.GetBlock("orders", 0).RecordsSet[0].RecordBatch
+			batch.FirstOffset = 7
+			batch.Control = d.control
+
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("orders", 0, broker.BrokerID()),
+				"FetchRequest": sarama.NewMockWrapper(fetch),
+			})
+
+			cfg := sarama.NewConfig()
+			cfg.Version = sarama.V0_11_0_0
+			client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+			require.NoError(t, err)
+			defer client.Close()
+
+			require.Equal(t, d.expected, onlyControlRecords(client, cfg.Version, topicPartition{"orders", 0}, 7, 8))
+		})
+	}
+}
+
+func TestConsumePartitionCaughtUpEmpty(t *testing.T) {
+	broker := newOffsetsMockBroker(t, 0)
+	defer broker.Close()
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the consumer is left nil: a partition that is already caught up must
+	// not be consumed at all.
+	target := &consumeCmd{
+		topics:   []string{"orders"},
+		client:   client,
+		caughtUp: true,
+		offsets: map[int32]interval{
+			-1: interval{start: offset{start: 50}, end: offset{start: 1<<63 - 1}},
+		},
+	}
+	target.consumePartition(make(chan printContext), topicPartition{"orders", 1})
+}
+
+func TestConsumePartitionLoopErrors(t *testing.T) {
+	errs := make(chan *sarama.ConsumerError, 2)
+	errs <- &sarama.ConsumerError{Topic: "orders", Partition: 0, Err: sarama.ErrNotLeaderForPartition}
+	errs <- &sarama.ConsumerError{Topic: "orders", Partition: 0, Err: sarama.ErrOffsetOutOfRange}
+
+	target := &consumeCmd{quit: make(chan struct{})}
+	next, err := target.partitionLoop(nil, tPartitionConsumer{errors: errs}, topicPartition{"orders", 0}, 7, 10)
+	require.Equal(t, sarama.ErrOffsetOutOfRange, err)
+	require.Equal(t, int64(7), next)
+
+	close(errs)
+	_, err = target.partitionLoop(nil, tPartitionConsumer{errors: errs}, topicPartition{"orders", 0}, 7, 10)
+	require.Equal(t, errPartitionConsumerClosed, err)
+}
+
+func TestConsumePartitionOutOfRange(t *testing.T) {
+	broker := newOffsetsMockBroker(t, 0)
+	defer broker.Close()
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{Partition: 0, Offset: 100, Value: []byte("hello")}
+	calls := make(chan tConsumePartition, 2)
+
+	target := &consumeCmd{
+		topics:     []string{"orders"},
+		client:     client,
+		outOfRange: "newest",
+		offsets: map[int32]interval{
+			-1: interval{start: offset{start: 3}, end: offset{start: 100}},
+		},
+		consumer: tConsumer{
+			calls: calls,
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"orders", 0, 100}: {messages: messages},
+			},
+			consumePartitionErr: map[tConsumePartition]error{
+				{"orders", 0, 3}: sarama.ErrOffsetOutOfRange,
+			},
+		},
+	}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.consumePartition(out, topicPartition{"orders", 0})
+	close(calls)
+
+	actual := []tConsumePartition{}
+	for c := range calls {
+		actual = append(actual, c)
+	}
+	require.Equal(t, []tConsumePartition{{"orders", 0, 3}, {"orders", 0, 100}}, actual)
+	require.Empty(t, target.failed)
+}
+
+func TestConsumeBackoff(t *testing.T) {
+	defer func(b time.Duration) { consumeRetryBackoff = b }(consumeRetryBackoff)
+	consumeRetryBackoff = time.Millisecond
+
+	target := &consumeCmd{quit: make(chan struct{})}
+	require.True(t, target.backoff(topicPartition{"orders", 0}, 2, sarama.ErrLeaderNotAvailable))
+	require.Empty(t, target.failed)
+
+	require.False(t, target.backoff(topicPartition{"orders", 1}, 0, sarama.ErrTopicAuthorizationFailed))
+	require.Equal(t, map[topicPartition]error{{"orders", 1}: sarama.ErrTopicAuthorizationFailed}, target.failed)
+
+	close(target.quit)
+	consumeRetryBackoff = time.Minute
+	require.False(t, target.backoff(topicPartition{"orders", 0}, 0, sarama.ErrLeaderNotAvailable))
+}
+
+func TestConsumeRefreshTopic(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetOldest, 5),
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{Partition: 1, Offset: 5, Value: []byte("hello")}
+	calls := make(chan tConsumePartition, 1)
+
+	// new partitions start at their oldest offset, even when following the
+	// newest messages.
+	target := &consumeCmd{
+		topics: []string{"orders"},
+		client: client,
+		offsets: map[int32]interval{
+			-1: interval{start: offset{relative: true, start: sarama.OffsetNewest}, end: offset{start: 5}},
+		},
+		consumer: tConsumer{
+			calls: calls,
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"orders", 1, 5}: {messages: messages},
+			},
+		},
+		consumed: make(chan struct{}),
+		running:  1,
+	}
+	lastOffset := int64(120)
+	target.stats = map[topicPartition]*consumePartitionSummary{{"orders", 0}: {Topic: "orders", Partition: 0, LastOffset: &lastOffset}}
+
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	state := &consumeRefresh{partitions: map[int32]bool{0: true}, recreated: map[int32]bool{}}
+	target.refreshTopic(out, "orders", state)
+
+	require.Equal(t, tConsumePartition{"orders", 1, 5}, <-calls)
+	target.partitionDone()
+	<-target.consumed
+	require.Equal(t, map[int32]bool{0: true, 1: true}, state.partitions)
+	require.Equal(t, map[int32]bool{0: true}, state.recreated)
+}
+
+func TestConsumeRefreshTopics(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders-eu", 0, broker.BrokerID()).
+			SetLeader("orders-us", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders-us", 0, sarama.OffsetOldest, 5),
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	messages := make(chan *sarama.ConsumerMessage, 1)
+	messages <- &sarama.ConsumerMessage{Topic: "orders-us", Partition: 0, Offset: 5, Value: []byte("hello")}
+	calls := make(chan tConsumePartition, 1)
+
+	target := &consumeCmd{
+		topicRegex: regexp.MustCompile("^orders-"),
+		client:     client,
+		offsets: map[int32]interval{
+			-1: interval{start: offset{relative: true, start: sarama.OffsetNewest}, end: offset{start: 5}},
+		},
+		consumer: tConsumer{
+			topics:     []string{"orders-eu", "orders-us", "payments"},
+			partitions: map[string][]int32{"orders-eu": {0}, "orders-us": {0}},
+			calls:      calls,
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"orders-us", 0, 5}: {messages: messages},
+			},
+		},
+		stats:    map[topicPartition]*consumePartitionSummary{},
+		consumed: make(chan struct{}),
+		running:  1,
+	}
+
+	out := make(chan printContext)
+	printed := make(chan consumedMessage, 1)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(consumedMessage)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	// new topics start at their oldest offset and their messages include the
+	// topic.
+	states := map[string]*consumeRefresh{"orders-eu": newConsumeRefresh()}
+	target.refreshTopics(out, states)
+
+	require.Equal(t, tConsumePartition{"orders-us", 0, 5}, <-calls)
+	require.Equal(t, "orders-us", (<-printed).Topic)
+	target.partitionDone()
+	<-target.consumed
+	require.Equal(t, map[int32]bool{0: true}, states["orders-us"].partitions)
+	require.Nil(t, states["payments"])
 }
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type copyEndpoint struct {
+	topic      string
+	brokers    []string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	version    sarama.KafkaVersion
+}
+
+type copyCmd struct {
+	source      copyEndpoint
+	dest        copyEndpoint
+	offsets     map[int32]interval
+	timeout     time.Duration
+	partitioner string
+	rate        int
+	batch       int
+	progress    time.Duration
+	verbose     bool
+	pretty      bool
+
+	client   sarama.Client
+	consumer sarama.Consumer
+	producer sarama.SyncProducer
+
+	destPartitions int32
+	consumed       int64
+	produced       int64
+	bytes          int64
+	lastOffsets    sync.Map
+}
+
+type copyArgs struct {
+	topic          string
+	brokers        string
+	tlsCA          string
+	tlsCert        string
+	tlsCertKey     string
+	version        string
+	destTopic      string
+	destBrokers    string
+	destTLSCA      string
+	destTLSCert    string
+	destTLSCertKey string
+	destVersion    string
+	offsets        string
+	timeout        time.Duration
+	partitioner    string
+	rate           int
+	batch          int
+	progress       time.Duration
+	verbose        bool
+	pretty         bool
+}
+
+type copyProgress struct {
+	Elapsed    string                  `json:"elapsed"`
+	Consumed   int64                   `json:"consumed"`
+	Produced   int64                   `json:"produced"`
+	Bytes      int64                   `json:"bytes"`
+	Rate       float64                 `json:"rate"`
+	Done       bool                    `json:"done"`
+	Partitions []copyPartitionProgress `json:"partitions,omitempty"`
+}
+
+type copyPartitionProgress struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+func (cmd *copyCmd) parseFlags(as []string) copyArgs {
+	var args copyArgs
+	flags := flag.NewFlagSet("copy", flag.ContinueOnError)
+	flags.StringVar(&args.topic, "topic", "", "Topic to copy from (required).")
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of source brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file for the source cluster")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file for the source cluster")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file for the source cluster")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version of the source cluster")
+	flags.StringVar(&args.destTopic, "desttopic", "", "Topic to copy to (defaults to -topic).")
+	flags.StringVar(&args.destBrokers, "destbrokers", "", "Comma separated list of destination brokers (defaults to the source brokers).")
+	flags.StringVar(&args.destTLSCA, "desttlsca", "", "Path to the TLS certificate authority file for the destination cluster (defaults to -tlsca)")
+	flags.StringVar(&args.destTLSCert, "desttlscert", "", "Path to the TLS client certificate file for the destination cluster (defaults to -tlscert)")
+	flags.StringVar(&args.destTLSCertKey, "desttlscertkey", "", "Path to the TLS client certificate key file for the destination cluster (defaults to -tlscertkey)")
+	flags.StringVar(&args.destVersion, "destversion", "", "Kafka protocol version of the destination cluster (defaults to -version)")
+	flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to copy by partition and offset range (defaults to all).")
+	flags.DurationVar(&args.timeout, "timeout", time.Duration(0), "Timeout after not reading messages (default 0 to disable).")
+	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to remap messages by key. Available: hashCode (defaults to preserving partitions)")
+	flags.IntVar(&args.rate, "rate", 0, "Maximum number of messages to copy per second (default 0 for no limit).")
+	flags.IntVar(&args.batch, "batch", 100, "Max number of messages to send to the destination at once.")
+	flags.DurationVar(&args.progress, "progress", 5*time.Second, "Interval for printing progress reports.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of copy:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, copyDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *copyCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt copy -help\" for more information")
+}
+
+func (cmd *copyCmd) parseArgs(as []string) {
+	var (
+		err  error
+		args = cmd.parseFlags(as)
+	)
+
+	envTopic := os.Getenv("KT_TOPIC")
+	if args.topic == "" {
+		if envTopic == "" {
+			cmd.failStartup("Topic name is required.")
+			return
+		}
+		args.topic = envTopic
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	cmd.source = copyEndpoint{
+		topic:      args.topic,
+		brokers:    parseBrokers(args.brokers),
+		tlsCA:      args.tlsCA,
+		tlsCert:    args.tlsCert,
+		tlsCertKey: args.tlsCertKey,
+		version:    kafkaVersion(args.version),
+	}
+
+	cmd.dest = cmd.source
+	if args.destTopic != "" {
+		cmd.dest.topic = args.destTopic
+	}
+	if args.destBrokers != "" {
+		cmd.dest.brokers = parseBrokers(args.destBrokers)
+	}
+	if args.destTLSCA != "" {
+		cmd.dest.tlsCA = args.destTLSCA
+	}
+	if args.destTLSCert != "" {
+		cmd.dest.tlsCert = args.destTLSCert
+	}
+	if args.destTLSCertKey != "" {
+		cmd.dest.tlsCertKey = args.destTLSCertKey
+	}
+	if args.destVersion != "" {
+		cmd.dest.version = kafkaVersion(args.destVersion)
+	}
+
+	if cmd.dest.topic == cmd.source.topic && strings.Join(cmd.dest.brokers, ",") == strings.Join(cmd.source.brokers, ",") {
+		cmd.failStartup("Source and destination topic must differ when copying within a cluster.")
+		return
+	}
+
+	switch args.partitioner {
+	case "", "hashCode":
+		cmd.partitioner = args.partitioner
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported partitioner argument %#v, only hashCode is supported.`, args.partitioner))
+		return
+	}
+
+	if args.batch < 1 {
+		cmd.failStartup(fmt.Sprintf("batch size must be positive, got %v", args.batch))
+		return
+	}
+
+	if args.progress <= 0 {
+		cmd.failStartup(fmt.Sprintf("progress interval must be positive, got %v", args.progress))
+		return
+	}
+
+	cmd.timeout = args.timeout
+	cmd.rate = args.rate
+	cmd.batch = args.batch
+	cmd.progress = args.progress
+	cmd.verbose = args.verbose
+	cmd.pretty = args.pretty
+
+	if cmd.offsets, err = parseOffsets(args.offsets); err != nil {
+		cmd.failStartup(fmt.Sprintf("%s", err))
+	}
+	for _, iv := range cmd.offsets {
+		if iv.start.start == offsetResume || iv.end.start == offsetResume {
+			cmd.failStartup("resume offsets are not supported when copying.")
+		}
+	}
+}
+
+func (cmd *copyCmd) saramaConfig(e copyEndpoint, role string) *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = e.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-copy-" + role + "-" + sanitizeUsername(usr.Username)
+
+	tlsConfig, err := setupCerts(e.tlsCert, e.tlsCA, e.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	if cmd.verbose {
+		fmt.Fprintf(os.Stderr, "sarama %v client configuration %#v\n", role, cfg)
+	}
+
+	return cfg
+}
+
+func (cmd *copyCmd) run(as []string) {
+	var err error
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if cmd.client, err = sarama.NewClient(cmd.source.brokers, cmd.saramaConfig(cmd.source, "source")); err != nil {
+		failf("failed to create source client err=%v", err)
+	}
+	defer logClose("source client", cmd.client)
+
+	if cmd.consumer, err = sarama.NewConsumerFromClient(cmd.client); err != nil {
+		failf("failed to create consumer err=%v", err)
+	}
+	defer logClose("consumer", cmd.consumer)
+
+	destCfg := cmd.saramaConfig(cmd.dest, "dest")
+	destCfg.Producer.RequiredAcks = sarama.WaitForAll
+	destCfg.Producer.Return.Successes = true
+	destCfg.Producer.Partitioner = sarama.NewManualPartitioner
+	destCfg.Net.MaxOpenRequests = 1 // keeps retries from reordering messages
+	destClient, err := sarama.NewClient(cmd.dest.brokers, destCfg)
+	if err != nil {
+		failf("failed to create destination client err=%v", err)
+	}
+	defer logClose("destination client", destClient)
+
+	destPartitions, err := destClient.Partitions(cmd.dest.topic)
+	if err != nil {
+		failf("failed to read partitions for destination topic %v err=%v", cmd.dest.topic, err)
+	}
+	cmd.destPartitions = int32(len(destPartitions))
+
+	if cmd.producer, err = sarama.NewSyncProducerFromClient(destClient); err != nil {
+		failf("failed to create producer err=%v", err)
+	}
+	defer logClose("producer", cmd.producer)
+
+	partitions := cmd.findPartitions()
+	if len(partitions) == 0 {
+		failf("Found no partitions to copy")
+	}
+	if cmd.partitioner == "" {
+		for _, p := range partitions {
+			if p >= cmd.destPartitions {
+				failf("cannot preserve source partition %v, destination topic %v has only %v partitions", p, cmd.dest.topic, cmd.destPartitions)
+			}
+		}
+	}
+
+	cmd.copy(partitions)
+}
+
+func (cmd *copyCmd) findPartitions() []int32 {
+	var (
+		all []int32
+		res []int32
+		err error
+	)
+	if all, err = cmd.consumer.Partitions(cmd.source.topic); err != nil {
+		failf("failed to read partitions for topic %v err=%v", cmd.source.topic, err)
+	}
+
+	if _, hasDefault := cmd.offsets[-1]; hasDefault {
+		return all
+	}
+
+	for _, p := range all {
+		if _, ok := cmd.offsets[p]; ok {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+func (cmd *copyCmd) copy(partitions []int32) {
+	var (
+		wg       sync.WaitGroup
+		start    = time.Now()
+		messages = make(chan *sarama.ConsumerMessage, cmd.batch)
+		done     = make(chan struct{})
+		out      = make(chan printContext)
+	)
+
+	go print(out, cmd.pretty)
+
+	wg.Add(len(partitions))
+	for _, p := range partitions {
+		go func(p int32) { defer wg.Done(); cmd.copyPartition(messages, p) }(p)
+	}
+	go func() { wg.Wait(); close(messages) }()
+
+	go func() { cmd.produce(messages); close(done) }()
+
+	ticker := time.NewTicker(cmd.progress)
+	defer ticker.Stop()
+
+	var last copyProgress
+	for {
+		select {
+		case <-ticker.C:
+			last = cmd.reportProgress(out, start, last, false)
+		case <-done:
+			cmd.reportProgress(out, start, last, true)
+			return
+		}
+	}
+}
+
+func (cmd *copyCmd) reportProgress(out chan printContext, start time.Time, last copyProgress, done bool) copyProgress {
+	now := time.Now()
+	current := copyProgress{
+		Elapsed:  now.Sub(start).Round(time.Millisecond).String(),
+		Consumed: atomic.LoadInt64(&cmd.consumed),
+		Produced: atomic.LoadInt64(&cmd.produced),
+		Bytes:    atomic.LoadInt64(&cmd.bytes),
+		Done:     done,
+	}
+
+	if elapsed := now.Sub(start).Seconds(); elapsed > 0 {
+		current.Rate = float64(current.Produced) / elapsed
+	}
+
+	cmd.lastOffsets.Range(func(k, v interface{}) bool {
+		current.Partitions = append(current.Partitions, copyPartitionProgress{Partition: k.(int32), Offset: v.(int64)})
+		return true
+	})
+	sort.Slice(current.Partitions, func(i, j int) bool {
+		return current.Partitions[i].Partition < current.Partitions[j].Partition
+	})
+
+	ctx := printContext{output: current, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+
+	return current
+}
+
+func (cmd *copyCmd) copyPartition(out chan<- *sarama.ConsumerMessage, partition int32) {
+	var (
+		offsets interval
+		err     error
+		pcon    sarama.PartitionConsumer
+		start   int64
+		end     int64
+		ok      bool
+	)
+
+	if offsets, ok = cmd.offsets[partition]; !ok {
+		offsets, ok = cmd.offsets[-1]
+	}
+
+	if start, err = resolveOffset(cmd.client, cmd.source.topic, partition, offsets.start); err != nil {
+		warnf("Failed to read start offset for partition %v err=%v", partition, err)
+		return
+	}
+
+	if end, err = resolveOffset(cmd.client, cmd.source.topic, partition, offsets.end); err != nil {
+		warnf("Failed to read end offset for partition %v err=%v", partition, err)
+		return
+	}
+
+	if pcon, err = cmd.consumer.ConsumePartition(cmd.source.topic, partition, start); err != nil {
+		warnf("Failed to consume partition %v err=%v", partition, err)
+		return
+	}
+	defer logClose(fmt.Sprintf("partition consumer %v", partition), pcon)
+
+	var (
+		timer   *time.Timer
+		timeout = make(<-chan time.Time)
+	)
+
+	for {
+		if cmd.timeout > 0 {
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(cmd.timeout)
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+			fmt.Fprintf(os.Stderr, "consuming from partition %v timed out after %s\n", partition, cmd.timeout)
+			return
+		case msg, ok := <-pcon.Messages():
+			if !ok {
+				warnf("unexpected closed messages chan for partition %v", partition)
+				return
+			}
+
+			atomic.AddInt64(&cmd.consumed, 1)
+			out <- msg
+
+			if end > 0 && msg.Offset >= end {
+				return
+			}
+		}
+	}
+}
+
+func (cmd *copyCmd) produce(in <-chan *sarama.ConsumerMessage) {
+	var (
+		limiter = newRateLimiter(cmd.rate)
+		batch   = make([]*sarama.ProducerMessage, 0, cmd.batch)
+		offsets = make([]int64, 0, cmd.batch)
+		flush   = time.NewTicker(100 * time.Millisecond)
+	)
+	defer flush.Stop()
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := cmd.producer.SendMessages(batch); err != nil {
+			failf("failed to produce to destination topic %v err=%v", cmd.dest.topic, err)
+		}
+
+		for i, m := range batch {
+			atomic.AddInt64(&cmd.produced, 1)
+			atomic.AddInt64(&cmd.bytes, int64(len(m.Key.(sarama.ByteEncoder))+len(m.Value.(sarama.ByteEncoder))))
+			cmd.lastOffsets.Store(m.Metadata.(int32), offsets[i])
+		}
+
+		batch = batch[:0]
+		offsets = offsets[:0]
+	}
+
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				send()
+				return
+			}
+
+			limiter.wait()
+			batch = append(batch, cmd.producerMessage(msg))
+			offsets = append(offsets, msg.Offset)
+			if len(batch) >= cmd.batch {
+				send()
+			}
+		case <-flush.C:
+			send()
+		}
+	}
+}
+
+// producerMessage converts a message read from the source topic into one for
+// the destination topic, keeping its key, value, timestamp and headers. The
+// source partition is kept as metadata for progress reporting.
+func (cmd *copyCmd) producerMessage(msg *sarama.ConsumerMessage) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic:     cmd.dest.topic,
+		Key:       sarama.ByteEncoder(msg.Key),
+		Value:     sarama.ByteEncoder(msg.Value),
+		Timestamp: msg.Timestamp,
+		Partition: cmd.destPartition(msg),
+		Metadata:  msg.Partition,
+	}
+
+	for _, h := range msg.Headers {
+		pm.Headers = append(pm.Headers, *h)
+	}
+
+	return pm
+}
+
+func (cmd *copyCmd) destPartition(msg *sarama.ConsumerMessage) int32 {
+	if cmd.partitioner == "hashCode" && msg.Key != nil {
+		return hashCodePartition(string(msg.Key), cmd.destPartitions)
+	}
+
+	return msg.Partition % cmd.destPartitions
+}
+
+// rateLimiter spaces out calls to wait so that they don't exceed the given
+// number of calls per second. A rate of zero or less disables limiting.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (l *rateLimiter) wait() {
+	if l.interval == 0 {
+		return
+	}
+
+	now := time.Now()
+	if l.next.IsZero() || l.next.Before(now) {
+		l.next = now
+	}
+	time.Sleep(l.next.Sub(now))
+	l.next = l.next.Add(l.interval)
+}
+
+var copyDocString = `
+The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
+The values supplied on the command line win over environment variable values.
+
+Copy reads messages from the source topic and produces them to the destination
+topic, keeping their keys, values, timestamps and headers. The destination
+settings default to the source settings, so to copy between two topics in the
+same cluster only -desttopic is needed.
+
+The -offsets flag uses the same syntax as "kt consume", cf "kt consume -help",
+except for "resume" which is not supported.
+
+Messages keep their source partition by default, which requires the
+destination topic to have at least as many partitions as are copied. With
+-partitioner hashCode messages are remapped by key instead, and messages
+without a key keep their source partition modulo the destination's partition
+count.
+
+Progress is printed as a JSON object every -progress interval and once more
+when copying finished.
+
+Examples:
+
+Copy the last 1000 messages per partition from production to staging at no more
+than 500 messages per second:
+
+  kt copy -brokers prod:9092 -topic orders -destbrokers staging:9092 -offsets all=-1000:newest -rate 500
+
+Copy a topic into one with a different partition count:
+
+  kt copy -topic orders -desttopic orders-v2 -partitioner hashCode -timeout 5s
+`
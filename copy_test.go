@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyParseArgs(t *testing.T) {
+	os.Setenv("KT_TOPIC", "")
+	os.Setenv("KT_BROKERS", "")
+	target := &copyCmd{}
+
+	target.parseArgs([]string{"-topic", "orders", "-desttopic", "orders-copy"})
+	require.Equal(t, "orders", target.source.topic)
+	require.Equal(t, "orders-copy", target.dest.topic)
+	require.Equal(t, []string{"localhost:9092"}, target.source.brokers)
+	require.Equal(t, target.source.brokers, target.dest.brokers)
+
+	target = &copyCmd{}
+	target.parseArgs([]string{
+		"-topic", "orders",
+		"-brokers", "prod",
+		"-destbrokers", "staging:9093,staging2",
+		"-offsets", "0=10:20",
+	})
+	require.Equal(t, "orders", target.dest.topic)
+	require.Equal(t, []string{"prod:9092"}, target.source.brokers)
+	require.Equal(t, []string{"staging:9093", "staging2:9092"}, target.dest.brokers)
+	expectedOffsets := map[int32]interval{
+		0: {start: offset{start: 10}, end: offset{start: 20}},
+	}
+	if !reflect.DeepEqual(expectedOffsets, target.offsets) {
+		t.Errorf("expected offsets %#v, got %#v", expectedOffsets, target.offsets)
+	}
+}
+
+func TestCopyProducerMessage(t *testing.T) {
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	target := &copyCmd{destPartitions: 2}
+	target.dest.topic = "dest"
+
+	msg := &sarama.ConsumerMessage{
+		Key:       []byte("a"),
+		Value:     []byte("value"),
+		Partition: 3,
+		Offset:    42,
+		Timestamp: ts,
+		Headers:   []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}},
+	}
+
+	actual := target.producerMessage(msg)
+	require.Equal(t, "dest", actual.Topic)
+	require.Equal(t, sarama.ByteEncoder("a"), actual.Key)
+	require.Equal(t, sarama.ByteEncoder("value"), actual.Value)
+	require.Equal(t, ts, actual.Timestamp)
+	require.Equal(t, []sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}}, actual.Headers)
+	require.Equal(t, int32(1), actual.Partition) // preserved modulo destination partitions
+	require.Equal(t, int32(3), actual.Metadata)
+
+	target.partitioner = "hashCode"
+	actual = target.producerMessage(msg)
+	require.Equal(t, hashCodePartition("a", 2), actual.Partition)
+
+	msg.Key = nil
+	actual = target.producerMessage(msg)
+	require.Equal(t, int32(1), actual.Partition)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		limiter.wait()
+	}
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	limiter = newRateLimiter(0)
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		limiter.wait()
+	}
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
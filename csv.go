@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type csvArgs struct {
+	topic     string
+	key       string
+	value     string
+	partition string
+	timestamp string
+	headers   string
+	valueJSON bool
+}
+
+// csvColumns names the columns of CSV input that make up the parts of a
+// message. The column names are read from the first row of the input.
+type csvColumns struct {
+	topic     string
+	key       string
+	value     string
+	partition string
+	timestamp string
+	headers   []string
+	valueJSON bool
+}
+
+func parseCSVArgs(args csvArgs, enabled bool) (*csvColumns, error) {
+	given := args.topic != "" || args.key != "" || args.value != "" || args.partition != "" ||
+		args.timestamp != "" || args.headers != "" || args.valueJSON
+	if !enabled {
+		if given {
+			return nil, fmt.Errorf("column flags are only supported with -framing csv or tsv.")
+		}
+		return nil, nil
+	}
+
+	if (args.value == "") == !args.valueJSON {
+		return nil, fmt.Errorf("-framing csv and tsv require either -valuecolumn or -valuejson.")
+	}
+
+	columns := &csvColumns{
+		topic:     args.topic,
+		key:       args.key,
+		value:     args.value,
+		partition: args.partition,
+		timestamp: args.timestamp,
+		valueJSON: args.valueJSON,
+	}
+	if args.headers != "" {
+		columns.headers = strings.Split(args.headers, ",")
+	}
+	return columns, nil
+}
+
+// csvMapping holds the indexes of the columns of csvColumns in the input's
+// rows, -1 for columns that aren't used.
+type csvMapping struct {
+	names     []string
+	topic     int
+	key       int
+	value     int
+	partition int
+	timestamp int
+	headers   []int
+	rest      []int
+}
+
+func (c *csvColumns) resolve(names []string) (*csvMapping, error) {
+	indexes := map[string]int{}
+	for i := len(names) - 1; i >= 0; i-- {
+		indexes[names[i]] = i
+	}
+
+	used := map[int]bool{}
+	index := func(name string) (int, error) {
+		if name == "" {
+			return -1, nil
+		}
+		i, ok := indexes[name]
+		if !ok {
+			return -1, fmt.Errorf("column %#v not found in header row %v", name, names)
+		}
+		used[i] = true
+		return i, nil
+	}
+
+	var (
+		m   = &csvMapping{names: names}
+		err error
+	)
+	if m.topic, err = index(c.topic); err != nil {
+		return nil, err
+	}
+	if m.key, err = index(c.key); err != nil {
+		return nil, err
+	}
+	if m.value, err = index(c.value); err != nil {
+		return nil, err
+	}
+	if m.partition, err = index(c.partition); err != nil {
+		return nil, err
+	}
+	if m.timestamp, err = index(c.timestamp); err != nil {
+		return nil, err
+	}
+	for _, name := range c.headers {
+		i, err := index(name)
+		if err != nil {
+			return nil, err
+		}
+		m.headers = append(m.headers, i)
+	}
+
+	if c.valueJSON {
+		for i := range names {
+			if !used[i] {
+				m.rest = append(m.rest, i)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// message builds the message for a row. Empty cells leave the topic, key,
+// partition and timestamp unset.
+func (m *csvMapping) message(row []string) (message, error) {
+	var msg message
+
+	if m.topic >= 0 {
+		msg.Topic = row[m.topic]
+	}
+
+	if m.key >= 0 {
+		k := row[m.key]
+		msg.Key = &k
+	}
+
+	if m.value >= 0 {
+		v := row[m.value]
+		msg.Value = &v
+	} else {
+		v := m.jsonValue(row)
+		msg.Value = &v
+	}
+
+	if m.partition >= 0 && row[m.partition] != "" {
+		p, err := strconv.ParseInt(row[m.partition], 10, 32)
+		if err != nil || p < 0 {
+			return msg, fmt.Errorf("invalid partition %#v in column %#v", row[m.partition], m.names[m.partition])
+		}
+		partition := int32(p)
+		msg.Partition = &partition
+	}
+
+	if m.timestamp >= 0 && row[m.timestamp] != "" {
+		ts, err := parseTimestamp(row[m.timestamp])
+		if err != nil {
+			return msg, fmt.Errorf("invalid timestamp %#v in column %#v", row[m.timestamp], m.names[m.timestamp])
+		}
+		msg.Timestamp = &ts
+	}
+
+	for _, i := range m.headers {
+		if msg.Headers == nil {
+			msg.Headers = map[string]string{}
+		}
+		msg.Headers[m.names[i]] = row[i]
+	}
+
+	return msg, nil
+}
+
+// parseTimestamp accepts RFC3339 timestamps and unix milliseconds.
+func parseTimestamp(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// jsonValue builds a JSON object of the remaining columns, in the order of the
+// header row. Cells that are JSON numbers or booleans keep their type, empty
+// cells are null and everything else is a string, e.g. "007" stays a string.
+func (m *csvMapping) jsonValue(row []string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for n, i := range m.rest {
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(m.names[i])
+		buf.Write(name)
+		buf.WriteByte(':')
+
+		cell := row[i]
+		switch {
+		case cell == "":
+			buf.WriteString("null")
+		case cell == "true" || cell == "false" || jsonNumber.MatchString(cell):
+			buf.WriteString(cell)
+		default:
+			value, _ := json.Marshal(cell)
+			buf.Write(value)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// deserializeCSV reads CSV, or TSV, input with a header row and sends a
+// message per row. Malformed rows are reported with their line and skipped,
+// they count as failed messages.
+func (cmd *produceCmd) deserializeCSV(q chan struct{}, r io.Reader, out chan message, partitionCount func(topic string) int32) {
+	defer close(out)
+
+	cr := csv.NewReader(r)
+	if cmd.framing == "tsv" {
+		cr.Comma = '\t'
+	}
+
+	names, err := cr.Read()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		failErrorf(&categoryUsage, "failed to read header row err=%v", err)
+	}
+
+	mapping, err := cmd.columns.resolve(names)
+	if err != nil {
+		failErrorf(&categoryUsage, "%v", err)
+	}
+
+	partitioner := cmd.inputPartitioner()
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return
+		}
+
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			cmd.skipRow(int64(pe.StartLine), pe.Err)
+			continue
+		}
+		if err != nil {
+			failf("failed to read input err=%v", err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		msg, err := mapping.message(row)
+		if err != nil {
+			cmd.skipRow(int64(line), err)
+			continue
+		}
+		msg.line = int64(line)
+
+		cmd.assignPartition(partitioner, &msg, partitionCount)
+		select {
+		case out <- msg:
+		case <-q:
+			return
+		}
+	}
+}
+
+func (cmd *produceCmd) skipRow(line int64, err error) {
+	warnf("Skipping malformed row line=%v err=%v", line, err)
+	cmd.Lock()
+	cmd.failed++
+	cmd.Unlock()
+}
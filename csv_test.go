@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSVArgs(t *testing.T) {
+	columns, err := parseCSVArgs(csvArgs{}, false)
+	require.NoError(t, err)
+	require.Nil(t, columns)
+
+	_, err = parseCSVArgs(csvArgs{key: "id"}, false)
+	require.Error(t, err)
+
+	_, err = parseCSVArgs(csvArgs{key: "id"}, true)
+	require.Error(t, err)
+
+	_, err = parseCSVArgs(csvArgs{value: "v", valueJSON: true}, true)
+	require.Error(t, err)
+
+	columns, err = parseCSVArgs(csvArgs{key: "id", valueJSON: true, headers: "source,region"}, true)
+	require.NoError(t, err)
+	require.Equal(t, &csvColumns{key: "id", valueJSON: true, headers: []string{"source", "region"}}, columns)
+}
+
+func TestCSVMappingMessage(t *testing.T) {
+	columns := &csvColumns{key: "id", partition: "p", timestamp: "ts", headers: []string{"source"}, valueJSON: true}
+	mapping, err := columns.resolve([]string{"id", "name", "age", "score", "active", "zip", "note", "p", "ts", "source"})
+	require.NoError(t, err)
+
+	msg, err := mapping.message([]string{"23", "ola", "42", "-1.5e3", "true", "007", "", "2", "1538395200000", "crm"})
+	require.NoError(t, err)
+
+	partition := int32(2)
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	expected := newMessage("23", `{"name":"ola","age":42,"score":-1.5e3,"active":true,"zip":"007","note":null}`, 0)
+	expected.Partition = &partition
+	expected.Timestamp = &ts
+	expected.Headers = map[string]string{"source": "crm"}
+	require.Equal(t, expected, msg)
+
+	msg, err = mapping.message([]string{"24", "hej", "1", "1", "false", "1", "x", "", "2018-10-01T12:00:00Z", "web"})
+	require.NoError(t, err)
+	require.Nil(t, msg.Partition)
+	require.Equal(t, &ts, msg.Timestamp)
+
+	_, err = mapping.message([]string{"25", "", "", "", "", "", "", "two", "", ""})
+	require.EqualError(t, err, `invalid partition "two" in column "p"`)
+
+	_, err = mapping.message([]string{"25", "", "", "", "", "", "", "", "yesterday", ""})
+	require.EqualError(t, err, `invalid timestamp "yesterday" in column "ts"`)
+
+	_, err = columns.resolve([]string{"id", "name"})
+	require.Error(t, err)
+}
+
+func TestDeserializeCSV(t *testing.T) {
+	target := &produceCmd{
+		framing: "tsv",
+		columns: &csvColumns{key: "id", value: "name"},
+	}
+
+	input := "id\tname\n" +
+		"1\tola\n" +
+		"2\n" +
+		"3\t\"multi\nline\"\n" +
+		"4\t\"unterminated\"x\n" +
+		"5\thej\n"
+
+	out := make(chan message)
+	go target.deserializeCSV(make(chan struct{}), strings.NewReader(input), out, func(string) int32 { return 1 })
+
+	actual := []message{}
+	for msg := range out {
+		actual = append(actual, msg)
+	}
+
+	expected := []message{newMessage("1", "ola", 0), newMessage("3", "multi\nline", 0), newMessage("5", "hej", 0)}
+	expected[0].line, expected[1].line, expected[2].line = 2, 4, 7
+	require.Equal(t, expected, actual)
+	require.Equal(t, int64(2), target.failed)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+
+	"github.com/Shopify/sarama"
+)
+
+// Exit codes shared by all commands. kt health uses its own scheme, cf.
+// healthDocString.
+const (
+	exitCodeFailure     = 1 // unclassified failure
+	exitCodeUsage       = 2 // invalid flags or arguments
+	exitCodePartial     = 3 // results were printed but some items failed
+	exitCodeUnavailable = 4 // brokers, leaders or coordinators unavailable
+	exitCodeAuth        = 5 // authentication or authorization failed
+	exitCodeNotFound    = 6 // topic, partition, group or key doesn't exist
+	exitCodeOffset      = 7 // offset out of range
+	exitCodeRejected    = 8 // request rejected as invalid by the broker
+	exitCodeTimeout     = 9 // request timed out
+)
+
+// errorsFormat controls how errors are written to stderr. It defaults to the
+// environment variable KT_ERRORS and can be set per command via -errors.
+var errorsFormat = errorsFormatFlag(os.Getenv("KT_ERRORS"))
+
+type errorsFormatFlag string
+
+func (f *errorsFormatFlag) String() string { return string(*f) }
+
+func (f *errorsFormatFlag) Set(s string) error {
+	if s != "text" && s != "json" {
+		return fmt.Errorf("unsupported errors format %#v, use text or json", s)
+	}
+	*f = errorsFormatFlag(s)
+	return nil
+}
+
+func addErrorsFlag(flags *flag.FlagSet) {
+	flags.Var(&errorsFormat, "errors", "Format of errors on stderr: text or json (defaults to KT_ERRORS or text).")
+}
+
+// ktError is written to stderr for each error when errors are formatted as
+// JSON. Context holds the key=value pairs of the message, e.g. topic and
+// partition.
+type ktError struct {
+	Code       string            `json:"code"`
+	KafkaError string            `json:"kafkaError,omitempty"`
+	Message    string            `json:"message"`
+	Fatal      bool              `json:"fatal"`
+	Context    map[string]string `json:"context,omitempty"`
+}
+
+type errorCategory struct {
+	code     string
+	exitCode int
+}
+
+var (
+	categoryFailure     = errorCategory{"failed", exitCodeFailure}
+	categoryUsage       = errorCategory{"invalid_arguments", exitCodeUsage}
+	categoryPartial     = errorCategory{"partial_results", exitCodePartial}
+	categoryUnavailable = errorCategory{"broker_unavailable", exitCodeUnavailable}
+	categoryAuth        = errorCategory{"auth_failed", exitCodeAuth}
+	categoryDenied      = errorCategory{"not_authorized", exitCodeAuth}
+	categoryTopic       = errorCategory{"topic_not_found", exitCodeNotFound}
+	categoryKey         = errorCategory{"key_not_found", exitCodeNotFound}
+	categoryOffset      = errorCategory{"offset_out_of_range", exitCodeOffset}
+	categoryTopicExists = errorCategory{"topic_exists", exitCodeRejected}
+	categoryTooLarge    = errorCategory{"message_too_large", exitCodeRejected}
+	categoryUnsupported = errorCategory{"unsupported_version", exitCodeRejected}
+	categoryRejected    = errorCategory{"invalid_request", exitCodeRejected}
+	categoryTimeout     = errorCategory{"timeout", exitCodeTimeout}
+	categoryKafka       = errorCategory{"kafka_error", exitCodeFailure}
+)
+
+var kafkaErrorCategories = map[sarama.KError]errorCategory{
+	sarama.ErrOffsetOutOfRange:                   categoryOffset,
+	sarama.ErrUnknownTopicOrPartition:            categoryTopic,
+	sarama.ErrLeaderNotAvailable:                 categoryUnavailable,
+	sarama.ErrNotLeaderForPartition:              categoryUnavailable,
+	sarama.ErrRequestTimedOut:                    categoryTimeout,
+	sarama.ErrBrokerNotAvailable:                 categoryUnavailable,
+	sarama.ErrReplicaNotAvailable:                categoryUnavailable,
+	sarama.ErrMessageSizeTooLarge:                categoryTooLarge,
+	sarama.ErrMessageSetSizeTooLarge:             categoryTooLarge,
+	sarama.ErrNetworkException:                   categoryUnavailable,
+	sarama.ErrOffsetsLoadInProgress:              categoryUnavailable,
+	sarama.ErrConsumerCoordinatorNotAvailable:    categoryUnavailable,
+	sarama.ErrNotCoordinatorForConsumer:          categoryUnavailable,
+	sarama.ErrNotEnoughReplicas:                  categoryUnavailable,
+	sarama.ErrNotEnoughReplicasAfterAppend:       categoryUnavailable,
+	sarama.ErrNotController:                      categoryUnavailable,
+	sarama.ErrKafkaStorageError:                  categoryUnavailable,
+	sarama.ErrInvalidTopic:                       categoryRejected,
+	sarama.ErrInvalidRequiredAcks:                categoryRejected,
+	sarama.ErrInvalidTimestamp:                   categoryRejected,
+	sarama.ErrInvalidPartitions:                  categoryRejected,
+	sarama.ErrInvalidReplicationFactor:           categoryRejected,
+	sarama.ErrInvalidReplicaAssignment:           categoryRejected,
+	sarama.ErrInvalidConfig:                      categoryRejected,
+	sarama.ErrInvalidRequest:                     categoryRejected,
+	sarama.ErrPolicyViolation:                    categoryRejected,
+	sarama.ErrTopicAlreadyExists:                 categoryTopicExists,
+	sarama.ErrUnsupportedVersion:                 categoryUnsupported,
+	sarama.ErrUnsupportedForMessageFormat:        categoryUnsupported,
+	sarama.ErrTopicAuthorizationFailed:           categoryDenied,
+	sarama.ErrGroupAuthorizationFailed:           categoryDenied,
+	sarama.ErrClusterAuthorizationFailed:         categoryDenied,
+	sarama.ErrTransactionalIDAuthorizationFailed: categoryDenied,
+	sarama.ErrUnsupportedSASLMechanism:           categoryAuth,
+	sarama.ErrIllegalSASLState:                   categoryAuth,
+	sarama.ErrSASLAuthenticationFailed:           categoryAuth,
+}
+
+// kafkaErrorNames maps sarama's errors to the names of the Kafka protocol,
+// cf. https://kafka.apache.org/protocol#protocol_error_codes
+var kafkaErrorNames = map[sarama.KError]string{
+	sarama.ErrUnknown:                            "UNKNOWN_SERVER_ERROR",
+	sarama.ErrOffsetOutOfRange:                   "OFFSET_OUT_OF_RANGE",
+	sarama.ErrInvalidMessage:                     "CORRUPT_MESSAGE",
+	sarama.ErrUnknownTopicOrPartition:            "UNKNOWN_TOPIC_OR_PARTITION",
+	sarama.ErrInvalidMessageSize:                 "INVALID_FETCH_SIZE",
+	sarama.ErrLeaderNotAvailable:                 "LEADER_NOT_AVAILABLE",
+	sarama.ErrNotLeaderForPartition:              "NOT_LEADER_FOR_PARTITION",
+	sarama.ErrRequestTimedOut:                    "REQUEST_TIMED_OUT",
+	sarama.ErrBrokerNotAvailable:                 "BROKER_NOT_AVAILABLE",
+	sarama.ErrReplicaNotAvailable:                "REPLICA_NOT_AVAILABLE",
+	sarama.ErrMessageSizeTooLarge:                "MESSAGE_TOO_LARGE",
+	sarama.ErrStaleControllerEpochCode:           "STALE_CONTROLLER_EPOCH",
+	sarama.ErrOffsetMetadataTooLarge:             "OFFSET_METADATA_TOO_LARGE",
+	sarama.ErrNetworkException:                   "NETWORK_EXCEPTION",
+	sarama.ErrOffsetsLoadInProgress:              "COORDINATOR_LOAD_IN_PROGRESS",
+	sarama.ErrConsumerCoordinatorNotAvailable:    "COORDINATOR_NOT_AVAILABLE",
+	sarama.ErrNotCoordinatorForConsumer:          "NOT_COORDINATOR",
+	sarama.ErrInvalidTopic:                       "INVALID_TOPIC_EXCEPTION",
+	sarama.ErrMessageSetSizeTooLarge:             "RECORD_LIST_TOO_LARGE",
+	sarama.ErrNotEnoughReplicas:                  "NOT_ENOUGH_REPLICAS",
+	sarama.ErrNotEnoughReplicasAfterAppend:       "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	sarama.ErrInvalidRequiredAcks:                "INVALID_REQUIRED_ACKS",
+	sarama.ErrIllegalGeneration:                  "ILLEGAL_GENERATION",
+	sarama.ErrInconsistentGroupProtocol:          "INCONSISTENT_GROUP_PROTOCOL",
+	sarama.ErrInvalidGroupId:                     "INVALID_GROUP_ID",
+	sarama.ErrUnknownMemberId:                    "UNKNOWN_MEMBER_ID",
+	sarama.ErrInvalidSessionTimeout:              "INVALID_SESSION_TIMEOUT",
+	sarama.ErrRebalanceInProgress:                "REBALANCE_IN_PROGRESS",
+	sarama.ErrInvalidCommitOffsetSize:            "INVALID_COMMIT_OFFSET_SIZE",
+	sarama.ErrTopicAuthorizationFailed:           "TOPIC_AUTHORIZATION_FAILED",
+	sarama.ErrGroupAuthorizationFailed:           "GROUP_AUTHORIZATION_FAILED",
+	sarama.ErrClusterAuthorizationFailed:         "CLUSTER_AUTHORIZATION_FAILED",
+	sarama.ErrInvalidTimestamp:                   "INVALID_TIMESTAMP",
+	sarama.ErrUnsupportedSASLMechanism:           "UNSUPPORTED_SASL_MECHANISM",
+	sarama.ErrIllegalSASLState:                   "ILLEGAL_SASL_STATE",
+	sarama.ErrUnsupportedVersion:                 "UNSUPPORTED_VERSION",
+	sarama.ErrTopicAlreadyExists:                 "TOPIC_ALREADY_EXISTS",
+	sarama.ErrInvalidPartitions:                  "INVALID_PARTITIONS",
+	sarama.ErrInvalidReplicationFactor:           "INVALID_REPLICATION_FACTOR",
+	sarama.ErrInvalidReplicaAssignment:           "INVALID_REPLICA_ASSIGNMENT",
+	sarama.ErrInvalidConfig:                      "INVALID_CONFIG",
+	sarama.ErrNotController:                      "NOT_CONTROLLER",
+	sarama.ErrInvalidRequest:                     "INVALID_REQUEST",
+	sarama.ErrUnsupportedForMessageFormat:        "UNSUPPORTED_FOR_MESSAGE_FORMAT",
+	sarama.ErrPolicyViolation:                    "POLICY_VIOLATION",
+	sarama.ErrOutOfOrderSequenceNumber:           "OUT_OF_ORDER_SEQUENCE_NUMBER",
+	sarama.ErrDuplicateSequenceNumber:            "DUPLICATE_SEQUENCE_NUMBER",
+	sarama.ErrInvalidProducerEpoch:               "INVALID_PRODUCER_EPOCH",
+	sarama.ErrInvalidTxnState:                    "INVALID_TXN_STATE",
+	sarama.ErrInvalidProducerIDMapping:           "INVALID_PRODUCER_ID_MAPPING",
+	sarama.ErrInvalidTransactionTimeout:          "INVALID_TRANSACTION_TIMEOUT",
+	sarama.ErrConcurrentTransactions:             "CONCURRENT_TRANSACTIONS",
+	sarama.ErrTransactionCoordinatorFenced:       "TRANSACTION_COORDINATOR_FENCED",
+	sarama.ErrTransactionalIDAuthorizationFailed: "TRANSACTIONAL_ID_AUTHORIZATION_FAILED",
+	sarama.ErrSecurityDisabled:                   "SECURITY_DISABLED",
+	sarama.ErrOperationNotAttempted:              "OPERATION_NOT_ATTEMPTED",
+	sarama.ErrKafkaStorageError:                  "KAFKA_STORAGE_ERROR",
+	sarama.ErrLogDirNotFound:                     "LOG_DIR_NOT_FOUND",
+	sarama.ErrSASLAuthenticationFailed:           "SASL_AUTHENTICATION_FAILED",
+	sarama.ErrUnknownProducerID:                  "UNKNOWN_PRODUCER_ID",
+	sarama.ErrReassignmentInProgress:             "REASSIGNMENT_IN_PROGRESS",
+}
+
+// classifyError returns the category of err and the name of the underlying
+// Kafka error, if any.
+func classifyError(err error) (errorCategory, string) {
+	switch e := err.(type) {
+	case nil:
+		return categoryFailure, ""
+	case sarama.KError:
+		category, ok := kafkaErrorCategories[e]
+		if !ok {
+			category = categoryKafka
+		}
+		return category, kafkaErrorNames[e]
+	case *sarama.ProducerError:
+		return classifyError(e.Err)
+	case sarama.ProducerErrors:
+		if len(e) > 0 {
+			return classifyError(e[0].Err)
+		}
+	case *sarama.ConsumerError:
+		return classifyError(e.Err)
+	case sarama.ConsumerErrors:
+		if len(e) > 0 {
+			return classifyError(e[0].Err)
+		}
+	case partitionErrors:
+		for _, ps := range e {
+			for _, err := range ps {
+				return classifyError(err)
+			}
+		}
+	case brokerErrors:
+		return categoryUnavailable, ""
+	case sarama.ConfigurationError:
+		return categoryUsage, ""
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+		return categoryAuth, ""
+	case net.Error:
+		if e.Timeout() {
+			return categoryTimeout, ""
+		}
+		return categoryUnavailable, ""
+	}
+
+	switch err {
+	case sarama.ErrOutOfBrokers, sarama.ErrNotConnected, sarama.ErrControllerNotAvailable,
+		io.EOF, io.ErrUnexpectedEOF, errPartitionConsumerClosed:
+		return categoryUnavailable, ""
+	case errKeyNotFound:
+		return categoryKey, ""
+	}
+
+	if inner := errors.Unwrap(err); inner != nil {
+		return classifyError(inner)
+	}
+
+	return categoryFailure, ""
+}
+
+// retriable reports whether err is likely to go away by itself, e.g. while a
+// broker restarts or partition leadership moves.
+func retriable(err error) bool {
+	category, _ := classifyError(err)
+	return category == categoryUnavailable || category == categoryTimeout
+}
+
+var contextPattern = regexp.MustCompile(`(\w+)=("[^"]*"|[^\s,]+)`)
+
+// newKtError builds the error for msg, classified by the first error in args.
+func newKtError(fatal bool, msg string, args ...interface{}) (ktError, errorCategory) {
+	var err error
+	for _, a := range args {
+		if e, ok := a.(error); ok {
+			err = e
+			break
+		}
+	}
+
+	category, kafkaName := classifyError(err)
+	formatted := fmt.Sprintf(msg, args...)
+	result := ktError{
+		Code:       category.code,
+		KafkaError: kafkaName,
+		Message:    formatted,
+		Fatal:      fatal,
+	}
+
+	for _, m := range contextPattern.FindAllStringSubmatch(formatted, -1) {
+		if m[1] == "err" {
+			continue
+		}
+		if result.Context == nil {
+			result.Context = map[string]string{}
+		}
+		result.Context[m[1]] = m[2]
+	}
+
+	return result, category
+}
+
+func writeKtError(e ktError) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", e.Message)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", buf)
+}
+
+// warnf reports a non-fatal error on stderr.
+func warnf(msg string, args ...interface{}) {
+	if errorsFormat != "json" {
+		fmt.Fprintf(os.Stderr, msg+"\n", args...)
+		return
+	}
+	e, _ := newKtError(false, msg, args...)
+	writeKtError(e)
+}
+
+// failErrorf reports a fatal error on stderr and exits with the exit code of
+// its category.
+func failErrorf(category *errorCategory, msg string, args ...interface{}) {
+	e, c := newKtError(true, msg, args...)
+	if category != nil {
+		c = *category
+		e.Code = c.code
+	}
+
+	if errorsFormat != "json" {
+		fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	} else {
+		writeKtError(e)
+	}
+	os.Exit(c.exitCode)
+}
+
+// failUsage reports invalid arguments on stderr, followed by a hint how to
+// get help in text mode, and exits with exitCodeUsage.
+func failUsage(msg, help string) {
+	if errorsFormat != "json" {
+		fmt.Fprintln(os.Stderr, msg)
+		msg = help
+	}
+	failErrorf(&categoryUsage, "%s", msg)
+}
+
+// failPartial exits with exitCodePartial after results were printed with
+// errors attached to the affected items.
+func failPartial(msg string, args ...interface{}) {
+	failErrorf(&categoryPartial, msg, args...)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	pe := partitionErrors{}
+	pe.add("orders", 0, sarama.ErrNotLeaderForPartition)
+
+	data := []struct {
+		testName  string
+		err       error
+		code      string
+		exitCode  int
+		kafkaName string
+	}{
+		{"nil", nil, "failed", exitCodeFailure, ""},
+		{"plain", fmt.Errorf("boom"), "failed", exitCodeFailure, ""},
+		{"unknown topic", sarama.ErrUnknownTopicOrPartition, "topic_not_found", exitCodeNotFound, "UNKNOWN_TOPIC_OR_PARTITION"},
+		{"offset", sarama.ErrOffsetOutOfRange, "offset_out_of_range", exitCodeOffset, "OFFSET_OUT_OF_RANGE"},
+		{"sasl", sarama.ErrSASLAuthenticationFailed, "auth_failed", exitCodeAuth, "SASL_AUTHENTICATION_FAILED"},
+		{"authorization", sarama.ErrTopicAuthorizationFailed, "not_authorized", exitCodeAuth, "TOPIC_AUTHORIZATION_FAILED"},
+		{"unmapped kafka", sarama.ErrRebalanceInProgress, "kafka_error", exitCodeFailure, "REBALANCE_IN_PROGRESS"},
+		{"out of brokers", sarama.ErrOutOfBrokers, "broker_unavailable", exitCodeUnavailable, ""},
+		{"wrapped", fmt.Errorf("failed to fetch err=%w", sarama.ErrRequestTimedOut), "timeout", exitCodeTimeout, "REQUEST_TIMED_OUT"},
+		{"producer errors", sarama.ProducerErrors{{Err: sarama.ErrMessageSizeTooLarge}}, "message_too_large", exitCodeRejected, "MESSAGE_TOO_LARGE"},
+		{"partition errors", pe, "broker_unavailable", exitCodeUnavailable, "NOT_LEADER_FOR_PARTITION"},
+		{"configuration", sarama.ConfigurationError("bad"), "invalid_arguments", exitCodeUsage, ""},
+		{"connection closed", io.EOF, "broker_unavailable", exitCodeUnavailable, ""},
+	}
+
+	for _, d := range data {
+		t.Run(d.testName, func(t *testing.T) {
+			category, kafkaName := classifyError(d.err)
+			require.Equal(t, d.code, category.code)
+			require.Equal(t, d.exitCode, category.exitCode)
+			require.Equal(t, d.kafkaName, kafkaName)
+		})
+	}
+}
+
+func TestNewKtError(t *testing.T) {
+	actual, category := newKtError(
+		true,
+		"failed to consume topic=%s partition=%d err=%v",
+		"orders", int32(3), sarama.ErrOffsetOutOfRange,
+	)
+
+	require.Equal(t, categoryOffset, category)
+	require.Equal(t, ktError{
+		Code:       "offset_out_of_range",
+		KafkaError: "OFFSET_OUT_OF_RANGE",
+		Message:    "failed to consume topic=orders partition=3 err=" + sarama.ErrOffsetOutOfRange.Error(),
+		Fatal:      true,
+		Context:    map[string]string{"topic": "orders", "partition": "3"},
+	}, actual)
+}
+
+func TestErrorsFormatFlag(t *testing.T) {
+	var f errorsFormatFlag
+	require.NoError(t, f.Set("json"))
+	require.Equal(t, "json", f.String())
+	require.NoError(t, f.Set("text"))
+	require.Error(t, f.Set("xml"))
+	require.Equal(t, "text", f.String())
+}
+
+func TestRetriable(t *testing.T) {
+	require.True(t, retriable(sarama.ErrNotLeaderForPartition))
+	require.True(t, retriable(sarama.ErrRequestTimedOut))
+	require.True(t, retriable(errPartitionConsumerClosed))
+	require.False(t, retriable(sarama.ErrOffsetOutOfRange))
+	require.False(t, retriable(sarama.ErrTopicAuthorizationFailed))
+}
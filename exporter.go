@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type exporterCmd struct {
+	brokers      []string
+	tlsCA        string
+	tlsCert      string
+	tlsCertKey   string
+	addr         string
+	refresh      time.Duration
+	filterTopics *regexp.Regexp
+	filterGroups *regexp.Regexp
+	verbose      bool
+	version      sarama.KafkaVersion
+
+	client sarama.Client
+
+	mu            sync.RWMutex
+	snapshot      *exporterSnapshot
+	refreshErrors int64
+}
+
+type exporterArgs struct {
+	brokers      string
+	tlsCA        string
+	tlsCert      string
+	tlsCertKey   string
+	addr         string
+	refresh      time.Duration
+	filterTopics string
+	filterGroups string
+	verbose      bool
+	version      string
+}
+
+// exporterSnapshot holds the metrics gathered by one refresh. Scrapes are
+// served from the latest snapshot rather than querying the cluster.
+type exporterSnapshot struct {
+	time            time.Time
+	duration        time.Duration
+	partitions      []exporterPartition
+	underReplicated []exporterTopic
+	groups          []exporterGroupOffset
+	groupsFailed    []exporterFailed
+	brokersFailed   []exporterFailed
+}
+
+// exporterPartition holds the offsets of a partition. When failed is set, its
+// offsets couldn't be read and are left out.
+type exporterPartition struct {
+	topic     string
+	partition int32
+	oldest    int64
+	newest    int64
+	failed    bool
+}
+
+// exporterFailed tells whether the group or broker of the given name could be
+// read.
+type exporterFailed struct {
+	name   string
+	failed bool
+}
+
+type exporterTopic struct {
+	topic           string
+	underReplicated int
+}
+
+type exporterGroupOffset struct {
+	group     string
+	topic     string
+	partition int32
+	offset    int64
+	lag       *int64
+}
+
+func (cmd *exporterCmd) parseFlags(as []string) exporterArgs {
+	var args exporterArgs
+	flags := flag.NewFlagSet("exporter", flag.ContinueOnError)
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.addr, "addr", ":9358", "Address to serve the /metrics endpoint on.")
+	flags.DurationVar(&args.refresh, "refresh", 30*time.Second, "Interval for refreshing metrics from the cluster.")
+	flags.StringVar(&args.filterTopics, "filter-topics", "", "Regex to filter topics.")
+	flags.StringVar(&args.filterGroups, "filter-groups", "", "Regex to filter groups.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of exporter:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, exporterDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *exporterCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt exporter -help\" for more information")
+}
+
+func (cmd *exporterCmd) parseArgs(as []string) {
+	var err error
+	args := cmd.parseFlags(as)
+
+	if args.refresh <= 0 {
+		cmd.failStartup(fmt.Sprintf("refresh interval must be positive, got %v", args.refresh))
+		return
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	if cmd.filterTopics, err = regexp.Compile(args.filterTopics); err != nil {
+		failf("topics filter regexp invalid err=%v", err)
+	}
+
+	if cmd.filterGroups, err = regexp.Compile(args.filterGroups); err != nil {
+		failf("groups filter regexp invalid err=%v", err)
+	}
+
+	cmd.brokers = parseBrokers(args.brokers)
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.addr = args.addr
+	cmd.refresh = args.refresh
+	cmd.verbose = args.verbose
+	cmd.version = kafkaVersion(args.version)
+}
+
+func (cmd *exporterCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-exporter-" + sanitizeUsername(usr.Username)
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+func (cmd *exporterCmd) run(as []string) {
+	var err error
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if cmd.client, err = sarama.NewClient(cmd.brokers, cmd.saramaConfig()); err != nil {
+		failf("failed to create client err=%v", err)
+	}
+	defer logClose("client", cmd.client)
+
+	cmd.update()
+	go func() {
+		ticker := time.NewTicker(cmd.refresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			cmd.update()
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving metrics on %v/metrics\n", cmd.addr)
+	if err = http.ListenAndServe(cmd.addr, cmd.handler()); err != nil {
+		failf("failed to serve metrics err=%v", err)
+	}
+}
+
+// update refreshes the snapshot, keeping the previous one on failure.
+func (cmd *exporterCmd) update() {
+	snap, err := cmd.collect()
+
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	if err != nil {
+		cmd.refreshErrors++
+		warnf("failed to refresh metrics err=%v", err)
+		return
+	}
+	cmd.snapshot = snap
+}
+
+func (cmd *exporterCmd) collect() (*exporterSnapshot, error) {
+	snap := &exporterSnapshot{time: time.Now()}
+
+	if err := cmd.client.RefreshMetadata(); err != nil {
+		return nil, fmt.Errorf("failed to refresh metadata err=%v", err)
+	}
+
+	all, err := cmd.client.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topics err=%v", err)
+	}
+
+	topics := []string{}
+	topicPartitions := map[string][]int32{}
+	for _, t := range all {
+		if !cmd.filterTopics.MatchString(t) {
+			continue
+		}
+		ps, err := cmd.client.Partitions(t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partitions for topic=%s err=%v", t, err)
+		}
+		topics = append(topics, t)
+		topicPartitions[t] = ps
+	}
+	sort.Strings(topics)
+
+	for _, t := range topics {
+		under, err := cmd.underReplicated(t, topicPartitions[t])
+		if err != nil {
+			return nil, err
+		}
+		snap.underReplicated = append(snap.underReplicated, exporterTopic{topic: t, underReplicated: under})
+	}
+
+	// partitions whose offsets can't be read are exported as failed.
+	oldest, err := fetchOffsets(cmd.client, topicPartitions, sarama.OffsetOldest)
+	if err != nil {
+		warnf("failed to fetch oldest offsets err=%v", err)
+	}
+	newest, err := fetchOffsets(cmd.client, topicPartitions, sarama.OffsetNewest)
+	if err != nil {
+		warnf("failed to fetch newest offsets err=%v", err)
+	}
+
+	for _, t := range topics {
+		for _, p := range topicPartitions[t] {
+			o, oldestOK := oldest[t][p]
+			n, newestOK := newest[t][p]
+			snap.partitions = append(snap.partitions, exporterPartition{
+				topic:     t,
+				partition: p,
+				oldest:    o,
+				newest:    n,
+				failed:    !oldestOK || !newestOK,
+			})
+		}
+	}
+
+	// groups of brokers that can't be queried are missing, the brokers are
+	// exported as failed.
+	groups, err := listGroups(cmd.client)
+	if err != nil {
+		warnf("failed to list groups err=%v", err)
+	}
+	brokerErrs, _ := err.(brokerErrors)
+	for _, b := range cmd.client.Brokers() {
+		_, failed := brokerErrs[b.Addr()]
+		snap.brokersFailed = append(snap.brokersFailed, exporterFailed{name: b.Addr(), failed: failed})
+	}
+	sort.Slice(snap.brokersFailed, func(i, j int) bool { return snap.brokersFailed[i].name < snap.brokersFailed[j].name })
+
+	for _, g := range groups {
+		if !cmd.filterGroups.MatchString(g) {
+			continue
+		}
+
+		// offsets of partitions that can't be read are missing from committed.
+		committed, err := fetchGroupOffsets(cmd.client, g, topicPartitions)
+		if err != nil {
+			warnf("failed to fetch offsets for group=%s err=%v", g, err)
+		}
+		snap.groupsFailed = append(snap.groupsFailed, exporterFailed{name: g, failed: err != nil})
+
+		for _, t := range topics {
+			for _, p := range topicPartitions[t] {
+				off, ok := committed[t][p]
+				if !ok {
+					continue
+				}
+				o := exporterGroupOffset{group: g, topic: t, partition: p, offset: off}
+				if n, ok := newest[t][p]; ok {
+					lag := n - off
+					o.lag = &lag
+				}
+				snap.groups = append(snap.groups, o)
+			}
+		}
+	}
+
+	snap.duration = time.Since(snap.time)
+	return snap, nil
+}
+
+func (cmd *exporterCmd) underReplicated(topic string, partitions []int32) (int, error) {
+	var count int
+	for _, p := range partitions {
+		replicas, err := cmd.client.Replicas(topic, p)
+		if err != nil && err != sarama.ErrReplicaNotAvailable {
+			return 0, fmt.Errorf("failed to read replicas for topic=%s partition=%d err=%v", topic, p, err)
+		}
+		isrs, err := cmd.client.InSyncReplicas(topic, p)
+		if err != nil && err != sarama.ErrReplicaNotAvailable {
+			return 0, fmt.Errorf("failed to read in-sync replicas for topic=%s partition=%d err=%v", topic, p, err)
+		}
+		if len(isrs) < len(replicas) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (cmd *exporterCmd) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", cmd.serveMetrics)
+	return mux
+}
+
+func (cmd *exporterCmd) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	cmd.mu.RLock()
+	snap, refreshErrors := cmd.snapshot, cmd.refreshErrors
+	cmd.mu.RUnlock()
+
+	var buf bytes.Buffer
+	writeMetricHeader(&buf, "kt_exporter_refresh_errors_total", "counter", "Number of failed metric refreshes.")
+	fmt.Fprintf(&buf, "kt_exporter_refresh_errors_total %d\n", refreshErrors)
+
+	if snap != nil {
+		writeExporterSnapshot(&buf, snap)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeExporterSnapshot renders snap in the Prometheus text exposition format.
+func writeExporterSnapshot(buf *bytes.Buffer, snap *exporterSnapshot) {
+	writeMetricHeader(buf, "kt_exporter_last_refresh_timestamp_seconds", "gauge", "Unix time of the last successful refresh.")
+	fmt.Fprintf(buf, "kt_exporter_last_refresh_timestamp_seconds %d\n", snap.time.Unix())
+
+	writeMetricHeader(buf, "kt_exporter_refresh_duration_seconds", "gauge", "Duration of the last successful refresh.")
+	fmt.Fprintf(buf, "kt_exporter_refresh_duration_seconds %g\n", snap.duration.Seconds())
+
+	writeMetricHeader(buf, "kt_partition_oldest_offset", "gauge", "Oldest offset of a partition.")
+	for _, p := range snap.partitions {
+		if !p.failed {
+			fmt.Fprintf(buf, "kt_partition_oldest_offset{topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(p.topic), p.partition, p.oldest)
+		}
+	}
+
+	writeMetricHeader(buf, "kt_partition_newest_offset", "gauge", "Newest offset of a partition.")
+	for _, p := range snap.partitions {
+		if !p.failed {
+			fmt.Fprintf(buf, "kt_partition_newest_offset{topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(p.topic), p.partition, p.newest)
+		}
+	}
+
+	writeMetricHeader(buf, "kt_partition_refresh_failed", "gauge", "Whether the offsets of a partition couldn't be read in the last refresh.")
+	for _, p := range snap.partitions {
+		fmt.Fprintf(buf, "kt_partition_refresh_failed{topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(p.topic), p.partition, boolGauge(p.failed))
+	}
+
+	writeMetricHeader(buf, "kt_topic_under_replicated_partitions", "gauge", "Number of partitions with fewer in-sync replicas than replicas.")
+	for _, t := range snap.underReplicated {
+		fmt.Fprintf(buf, "kt_topic_under_replicated_partitions{topic=\"%s\"} %d\n", escapeLabel(t.topic), t.underReplicated)
+	}
+
+	writeMetricHeader(buf, "kt_group_offset", "gauge", "Offset committed by a consumer group for a partition.")
+	for _, o := range snap.groups {
+		fmt.Fprintf(buf, "kt_group_offset{group=\"%s\",topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(o.group), escapeLabel(o.topic), o.partition, o.offset)
+	}
+
+	writeMetricHeader(buf, "kt_group_lag", "gauge", "Lag of a consumer group for a partition.")
+	for _, o := range snap.groups {
+		if o.lag != nil {
+			fmt.Fprintf(buf, "kt_group_lag{group=\"%s\",topic=\"%s\",partition=\"%d\"} %d\n", escapeLabel(o.group), escapeLabel(o.topic), o.partition, *o.lag)
+		}
+	}
+
+	writeMetricHeader(buf, "kt_group_refresh_failed", "gauge", "Whether the committed offsets of a consumer group couldn't all be read in the last refresh.")
+	for _, g := range snap.groupsFailed {
+		fmt.Fprintf(buf, "kt_group_refresh_failed{group=\"%s\"} %d\n", escapeLabel(g.name), boolGauge(g.failed))
+	}
+
+	writeMetricHeader(buf, "kt_broker_refresh_failed", "gauge", "Whether the consumer groups of a broker couldn't be listed in the last refresh.")
+	for _, b := range snap.brokersFailed {
+		fmt.Fprintf(buf, "kt_broker_refresh_failed{broker=\"%s\"} %d\n", escapeLabel(b.name), boolGauge(b.failed))
+	}
+}
+
+func boolGauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var exporterDocString = `
+The value for -brokers can also be set via the environment variable KT_BROKERS.
+The value supplied on the command line wins over the environment variable value.
+
+Exporter serves Prometheus metrics on the /metrics endpoint of -addr. Every
+-refresh interval it gathers the oldest and newest offset of each partition,
+the number of under-replicated partitions per topic and the committed offset
+and lag of each consumer group per partition. Scrapes return the metrics of the
+latest successful refresh.
+
+Partitions, groups and brokers that can't be read are left out of a refresh
+rather than failing it, and reported with the kt_partition_refresh_failed,
+kt_group_refresh_failed and kt_broker_refresh_failed gauges.
+
+Example:
+
+  kt exporter -addr :9358 -refresh 15s -filter-topics '^orders' -filter-groups '^billing'
+`
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporterParseArgs(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &exporterCmd{}
+
+	target.parseArgs([]string{"-filter-topics", "^orders"})
+	require.Equal(t, []string{"localhost:9092"}, target.brokers)
+	require.Equal(t, ":9358", target.addr)
+	require.Equal(t, 30*time.Second, target.refresh)
+	require.True(t, target.filterTopics.MatchString("orders-eu"))
+	require.False(t, target.filterTopics.MatchString("payments"))
+	require.True(t, target.filterGroups.MatchString("any"))
+}
+
+func TestExporterScrape(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := &sarama.MetadataResponse{Version: 1}
+	metadata.AddBroker(broker.Addr(), broker.BrokerID())
+	metadata.AddTopicPartition("orders", 0, broker.BrokerID(), []int32{1, 2}, []int32{1}, sarama.ErrNoError)
+	metadata.AddTopicPartition("orders", 1, broker.BrokerID(), []int32{1}, []int32{1}, sarama.ErrNoError)
+	metadata.AddTopicPartition("payments", 0, broker.BrokerID(), []int32{1}, []int32{1}, sarama.ErrNoError)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockWrapper(metadata),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetOldest, 3).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetOldest, 0).
+			SetOffset("orders", 1, sarama.OffsetNewest, 50),
+		"ListGroupsRequest": sarama.NewMockWrapper(&sarama.ListGroupsResponse{
+			Groups: map[string]string{"billing": "consumer", "other": "consumer"},
+		}),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "billing", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("billing", "orders", 0, 90, "", sarama.ErrNoError).
+			SetOffset("billing", "orders", 1, -1, "", sarama.ErrNoError),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_0_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := &exporterCmd{
+		client:       client,
+		filterTopics: regexp.MustCompile("^orders$"),
+		filterGroups: regexp.MustCompile("^billing$"),
+	}
+	target.update()
+	require.Equal(t, int64(0), target.refreshErrors)
+
+	server := httptest.NewServer(target.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	for _, expected := range []string{
+		`kt_exporter_refresh_errors_total 0`,
+		`kt_partition_oldest_offset{topic="orders",partition="0"} 3`,
+		`kt_partition_newest_offset{topic="orders",partition="0"} 100`,
+		`kt_partition_newest_offset{topic="orders",partition="1"} 50`,
+		`kt_topic_under_replicated_partitions{topic="orders"} 1`,
+		`kt_group_offset{group="billing",topic="orders",partition="0"} 90`,
+		`kt_group_lag{group="billing",topic="orders",partition="0"} 10`,
+	} {
+		require.Contains(t, string(body), expected+"\n")
+	}
+	require.False(t, strings.Contains(string(body), "payments"))
+	require.False(t, strings.Contains(string(body), `kt_group_offset{group="billing",topic="orders",partition="1"}`))
+}
+
+func TestExporterScrapePartial(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := &sarama.MetadataResponse{Version: 1}
+	metadata.AddBroker(broker.Addr(), broker.BrokerID())
+	metadata.AddTopicPartition("orders", 0, broker.BrokerID(), []int32{1}, []int32{1}, sarama.ErrNoError)
+	metadata.AddTopicPartition("orders", 1, broker.BrokerID(), []int32{1}, []int32{1}, sarama.ErrNoError)
+
+	offsets := &sarama.OffsetResponse{}
+	offsets.AddTopicPartition("orders", 0, 100)
+	offsets.AddTopicPartition("orders", 1, 0)
+	offsets.GetBlock("orders", 1).Err = sarama.ErrNotLeaderForPartition
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockWrapper(metadata),
+		"OffsetRequest":   sarama.NewMockWrapper(offsets),
+		"ListGroupsRequest": sarama.NewMockWrapper(&sarama.ListGroupsResponse{
+			Groups: map[string]string{"billing": "consumer", "shipping": "consumer"},
+		}),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "billing", broker).
+			SetError(sarama.CoordinatorGroup, "shipping", sarama.ErrConsumerCoordinatorNotAvailable),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("billing", "orders", 0, 90, "", sarama.ErrNoError).
+			SetOffset("billing", "orders", 1, 0, "", sarama.ErrNotLeaderForPartition),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_0_0
+	cfg.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := &exporterCmd{
+		client:       client,
+		filterTopics: regexp.MustCompile(""),
+		filterGroups: regexp.MustCompile(""),
+	}
+	target.update()
+	require.Equal(t, int64(0), target.refreshErrors)
+
+	var buf bytes.Buffer
+	writeExporterSnapshot(&buf, target.snapshot)
+	body := buf.String()
+
+	for _, expected := range []string{
+		`kt_partition_newest_offset{topic="orders",partition="0"} 100`,
+		`kt_partition_refresh_failed{topic="orders",partition="0"} 0`,
+		`kt_partition_refresh_failed{topic="orders",partition="1"} 1`,
+		`kt_group_offset{group="billing",topic="orders",partition="0"} 90`,
+		`kt_group_lag{group="billing",topic="orders",partition="0"} 10`,
+		`kt_group_refresh_failed{group="billing"} 1`,
+		`kt_group_refresh_failed{group="shipping"} 1`,
+		`kt_broker_refresh_failed{broker="` + broker.Addr() + `"} 0`,
+	} {
+		require.Contains(t, body, expected+"\n")
+	}
+	require.NotContains(t, body, `kt_partition_newest_offset{topic="orders",partition="1"}`)
+	require.NotContains(t, body, `kt_group_offset{group="billing",topic="orders",partition="1"}`)
+}
+
+func TestEscapeLabel(t *testing.T) {
+	require.Equal(t, `a\\b\"c\nd`, escapeLabel("a\\b\"c\nd"))
+}
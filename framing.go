@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// framingNames are the supported ways of splitting produce input into
+// records. Each record is deserialized like an input line.
+var framingNames = []string{"lines", "json-stream", "null", "length", "files", "csv", "tsv"}
+
+func validFraming(name string) bool {
+	for _, n := range framingNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readRecords splits r into records according to framing, which must not be
+// files, csv or tsv, and sends them to out. Records must not exceed max bytes.
+// It returns the error that ended reading early, if any.
+func readRecords(framing string, r io.Reader, max int, out chan string) error {
+	switch framing {
+	case "lines":
+		return scanRecords(r, max, bufio.ScanLines, out)
+	case "null":
+		return scanRecords(r, max, scanNullDelimited, out)
+	case "length":
+		return readLengthPrefixed(r, max, out)
+	case "json-stream":
+		return readJSONStream(r, out)
+	}
+	return fmt.Errorf("unsupported framing %#v", framing)
+}
+
+func scanRecords(r io.Reader, max int, split bufio.SplitFunc, out chan string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, max), max)
+	scanner.Split(split)
+
+	for scanner.Scan() {
+		out <- scanner.Text()
+	}
+	return scanner.Err()
+}
+
+// scanNullDelimited is a bufio.SplitFunc for records terminated by a null
+// byte. The terminator of the last record is optional.
+func scanNullDelimited(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// readLengthPrefixed reads records that are prefixed by their length as a
+// 4 byte big endian unsigned integer.
+func readLengthPrefixed(r io.Reader, max int, out chan string) error {
+	br := bufio.NewReader(r)
+	var size uint32
+	for {
+		err := binary.Read(br, binary.BigEndian, &size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read record length err=%w", err)
+		}
+		if int64(size) > int64(max) {
+			return fmt.Errorf("record of %v bytes exceeds -buffersize %v", size, max)
+		}
+
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return fmt.Errorf("failed to read record of %v bytes err=%w", size, err)
+		}
+		out <- string(buf)
+	}
+}
+
+// readJSONStream reads concatenated JSON values, e.g. pretty printed objects.
+// The elements of top-level arrays are sent as individual records.
+func readJSONStream(r io.Reader, out chan string) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode JSON input err=%w", err)
+		}
+
+		values := []json.RawMessage{raw}
+		if bytes.HasPrefix(raw, []byte("[")) {
+			values = nil
+			if err = json.Unmarshal(raw, &values); err != nil {
+				return fmt.Errorf("failed to decode JSON array err=%w", err)
+			}
+		}
+
+		for _, v := range values {
+			var buf bytes.Buffer
+			if err = json.Compact(&buf, v); err != nil {
+				return fmt.Errorf("failed to compact JSON input err=%w", err)
+			}
+			out <- buf.String()
+		}
+	}
+}
+
+// readFiles sends the contents of each file matching pattern as a record, in
+// lexical order of the file names. A directory matches the regular files
+// in it.
+func readFiles(pattern string, max int, out chan string) {
+	defer close(out)
+
+	names, err := inputFiles(pattern)
+	if err != nil {
+		failf("failed to list input files err=%v", err)
+	}
+
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			failf("failed to read input file %#v err=%v", name, err)
+		}
+		if len(buf) > max {
+			failf("input file %#v of %v bytes exceeds -buffersize %v", name, len(buf), max)
+		}
+		out <- string(buf)
+	}
+}
+
+func inputFiles(pattern string) ([]string, error) {
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().IsRegular() {
+			names = append(names, m)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files match %#v", pattern)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
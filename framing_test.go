@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collectRecords(read func(out chan string)) []string {
+	out := make(chan string)
+	go read(out)
+
+	records := []string{}
+	for r := range out {
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestReadRecords(t *testing.T) {
+	data := []struct {
+		testName string
+		framing  string
+		input    string
+		max      int
+		expected []string
+		failed   bool
+	}{
+		{
+			testName: "lines",
+			framing:  "lines",
+			input:    "a\nb\n\nc",
+			max:      16,
+			expected: []string{"a", "b", "", "c"},
+		},
+		{
+			testName: "lines-exceeding-max",
+			framing:  "lines",
+			input:    "a\nbbbbbbbbbbbbbbbbbbbb\nc",
+			max:      8,
+			expected: []string{"a"},
+			failed:   true,
+		},
+		{
+			testName: "null",
+			framing:  "null",
+			input:    "a\nb\x00\x00c",
+			max:      16,
+			expected: []string{"a\nb", "", "c"},
+		},
+		{
+			testName: "null-terminated",
+			framing:  "null",
+			input:    "a\x00b\x00",
+			max:      16,
+			expected: []string{"a", "b"},
+		},
+		{
+			testName: "length",
+			framing:  "length",
+			input:    "\x00\x00\x00\x03a\nb\x00\x00\x00\x00\x00\x00\x00\x02\x00\xff",
+			max:      16,
+			expected: []string{"a\nb", "", "\x00\xff"},
+		},
+		{
+			testName: "length-exceeding-max",
+			framing:  "length",
+			input:    "\x00\x00\x00\x01a\x00\x00\x01\x00b",
+			max:      16,
+			expected: []string{"a"},
+			failed:   true,
+		},
+		{
+			testName: "length-truncated",
+			framing:  "length",
+			input:    "\x00\x00\x00\x01a\x00\x00\x00\x05bc",
+			max:      16,
+			expected: []string{"a"},
+			failed:   true,
+		},
+		{
+			testName: "json-stream",
+			framing:  "json-stream",
+			input:    "{\n  \"key\": \"a\",\n  \"value\": \"1\"\n}{\"value\":\"2\"}\n[{\"value\": \"3\"}, {\"value\": \"4\"}]",
+			max:      16,
+			expected: []string{`{"key":"a","value":"1"}`, `{"value":"2"}`, `{"value":"3"}`, `{"value":"4"}`},
+		},
+		{
+			testName: "json-stream-invalid",
+			framing:  "json-stream",
+			input:    `{"value":"1"} {"value":`,
+			max:      16,
+			expected: []string{`{"value":"1"}`},
+			failed:   true,
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.testName, func(t *testing.T) {
+			var err error
+			actual := collectRecords(func(out chan string) {
+				defer close(out)
+				err = readRecords(d.framing, strings.NewReader(d.input), d.max, out)
+			})
+			require.Equal(t, d.expected, actual)
+			require.Equal(t, d.failed, err != nil, "err=%v", err)
+		})
+	}
+}
+
+func TestProduceReadRecordsFailure(t *testing.T) {
+	target := &produceCmd{framing: "length", bufferSize: 16}
+	actual := collectRecords(func(out chan string) {
+		target.readRecords(strings.NewReader("\x00\x00\x00\x01a\x00\x00\x00\x05bc"), out)
+	})
+	require.Equal(t, []string{"a"}, actual)
+	require.Equal(t, int64(1), target.failed)
+}
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kt-framing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte("{\n}\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.bin"), []byte("\x00a\nb"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "c"), 0755))
+
+	actual := collectRecords(func(out chan string) { readFiles(dir, 16, out) })
+	require.Equal(t, []string{"\x00a\nb", "{\n}\n"}, actual)
+
+	actual = collectRecords(func(out chan string) { readFiles(filepath.Join(dir, "*.json"), 16, out) })
+	require.Equal(t, []string{"{\n}\n"}, actual)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type getCmd struct {
+	topic       string
+	key         []byte
+	brokers     []string
+	tlsCA       string
+	tlsCert     string
+	tlsCertKey  string
+	partitioner string
+	at          *time.Time
+	encodeValue string
+	encodeKey   string
+	pretty      bool
+	verbose     bool
+	version     sarama.KafkaVersion
+
+	client   sarama.Client
+	consumer sarama.Consumer
+}
+
+type getArgs struct {
+	topic       string
+	key         string
+	brokers     string
+	tlsCA       string
+	tlsCert     string
+	tlsCertKey  string
+	partitioner string
+	at          string
+	decodeKey   string
+	encodeValue string
+	encodeKey   string
+	pretty      bool
+	verbose     bool
+	version     string
+}
+
+// errKeyNotFound is returned when the partition holds no message with the key.
+var errKeyNotFound = errors.New("key not found")
+
+// getResult is the latest record for the key. Deleted is set when that
+// record is a tombstone.
+type getResult struct {
+	consumedMessage
+	Deleted bool `json:"deleted"`
+}
+
+func (cmd *getCmd) parseFlags(as []string) getArgs {
+	var args getArgs
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	flags.StringVar(&args.topic, "topic", "", "Topic to look up the key in (required).")
+	flags.StringVar(&args.key, "key", "", "Message key to look up (required).")
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.partitioner, "partitioner", "murmur2", "Partitioner the topic was produced with. Available: hashCode, murmur2, consistent, consistent_random, crc32")
+	flags.StringVar(&args.at, "at", "", "Show the value as of the given time (RFC3339 or unix milliseconds) rather than the current one.")
+	flags.StringVar(&args.decodeKey, "decodekey", "string", "Decode message key as (string|hex|base64), defaults to string.")
+	flags.StringVar(&args.encodeValue, "encodevalue", "string", "Present message value as (string|hex|base64), defaults to string.")
+	flags.StringVar(&args.encodeKey, "encodekey", "string", "Present message key as (string|hex|base64), defaults to string.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of get:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, getDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *getCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt get -help\" for more information")
+}
+
+func (cmd *getCmd) parseArgs(as []string) {
+	var (
+		err  error
+		args = cmd.parseFlags(as)
+	)
+
+	envTopic := os.Getenv("KT_TOPIC")
+	if args.topic == "" {
+		if envTopic == "" {
+			cmd.failStartup("Topic name is required.")
+			return
+		}
+		args.topic = envTopic
+	}
+	cmd.topic = args.topic
+
+	if args.key == "" {
+		cmd.failStartup("Key is required.")
+		return
+	}
+
+	if args.decodeKey != "string" && args.decodeKey != "hex" && args.decodeKey != "base64" {
+		cmd.failStartup(fmt.Sprintf(`unsupported decodekey argument %#v, only string, hex and base64 are supported.`, args.decodeKey))
+		return
+	}
+	if cmd.key, err = decodeString(args.key, args.decodeKey); err != nil {
+		cmd.failStartup(fmt.Sprintf("failed to decode key err=%v", err))
+		return
+	}
+
+	switch args.partitioner {
+	case "hashCode", "murmur2", "consistent", "consistent_random", "crc32":
+	default:
+		cmd.failStartup(fmt.Sprintf(`unsupported partitioner argument %#v, only hashCode, murmur2, consistent, consistent_random and crc32 are supported.`, args.partitioner))
+		return
+	}
+	cmd.partitioner = args.partitioner
+
+	for _, e := range []string{args.encodeValue, args.encodeKey} {
+		if e != "string" && e != "hex" && e != "base64" {
+			cmd.failStartup(fmt.Sprintf(`unsupported encoding argument %#v, only string, hex and base64 are supported.`, e))
+			return
+		}
+	}
+	cmd.encodeValue = args.encodeValue
+	cmd.encodeKey = args.encodeKey
+
+	cmd.version = kafkaVersion(args.version)
+
+	cmd.at = nil
+	if args.at != "" {
+		at, err := parseTimestamp(args.at)
+		if err != nil {
+			cmd.failStartup(fmt.Sprintf("Invalid -at %#v err=%v", args.at, err))
+			return
+		}
+		if !cmd.version.IsAtLeast(sarama.V0_10_1_0) {
+			cmd.failStartup("-at requires -version 0.10.1.0 or later.")
+			return
+		}
+		cmd.at = &at
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+	cmd.brokers = parseBrokers(args.brokers)
+
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.pretty = args.pretty
+	cmd.verbose = args.verbose
+}
+
+func (cmd *getCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-get-" + sanitizeUsername(usr.Username)
+	cfg.Consumer.Return.Errors = true
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+func (cmd *getCmd) run(as []string) {
+	var err error
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if cmd.client, err = sarama.NewClient(cmd.brokers, cmd.saramaConfig()); err != nil {
+		failf("failed to create client err=%v", err)
+	}
+	defer logClose("client", cmd.client)
+
+	if cmd.consumer, err = sarama.NewConsumerFromClient(cmd.client); err != nil {
+		failf("failed to create consumer err=%v", err)
+	}
+	defer logClose("consumer", cmd.consumer)
+
+	tp, err := cmd.partition()
+	if err != nil {
+		failf("failed to read partitions for topic %v err=%v", cmd.topic, err)
+	}
+
+	start, end, err := cmd.interval(tp)
+	if err != nil {
+		failf("failed to read offsets for partition %v err=%v", tp.partition, err)
+	}
+
+	msg, err := cmd.latest(tp, start, end)
+	if err != nil {
+		failf("failed to look up key in partition %v of topic %v err=%v", tp.partition, cmd.topic, err)
+	}
+
+	result := getResult{
+		consumedMessage: newConsumedMessage(msg, cmd.encodeKey, cmd.encodeValue, true),
+		Deleted:         msg.Value == nil,
+	}
+
+	out := make(chan printContext)
+	go print(out, cmd.pretty)
+	ctx := printContext{output: result, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+// partition returns the partition the key is assigned to by the partitioner
+// given with -partitioner.
+func (cmd *getCmd) partition() (topicPartition, error) {
+	partitions, err := cmd.client.Partitions(cmd.topic)
+	if err != nil {
+		return topicPartition{}, err
+	}
+	if len(partitions) == 0 {
+		return topicPartition{}, sarama.ErrUnknownTopicOrPartition
+	}
+
+	p, _ := newPartitioner(cmd.partitioner, 1)
+	return topicPartition{cmd.topic, p.partition(cmd.key, int32(len(partitions)))}, nil
+}
+
+// interval returns the offsets to scan for the key: from the oldest offset up
+// to the high water mark, or with -at up to the first message with a later
+// timestamp.
+func (cmd *getCmd) interval(tp topicPartition) (int64, int64, error) {
+	start, err := cmd.client.GetOffset(tp.topic, tp.partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := cmd.client.GetOffset(tp.topic, tp.partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if cmd.at != nil {
+		// offsets are looked up by the earliest timestamp at or after the given
+		// one, in milliseconds.
+		ms := cmd.at.UnixNano()/int64(time.Millisecond) + 1
+		offset, err := cmd.client.GetOffset(tp.topic, tp.partition, ms)
+		if err != nil {
+			return 0, 0, err
+		}
+		if offset >= 0 && offset < end {
+			end = offset
+		}
+	}
+
+	return start, end, nil
+}
+
+// latest returns the last message with the key between start and end, or
+// errKeyNotFound when there is none.
+func (cmd *getCmd) latest(tp topicPartition, start, end int64) (*sarama.ConsumerMessage, error) {
+	if start >= end {
+		return nil, errKeyNotFound
+	}
+
+	pc, err := cmd.consumer.ConsumePartition(tp.topic, tp.partition, start)
+	if err != nil {
+		return nil, err
+	}
+	defer logClose(fmt.Sprintf("partition consumer %v", tp.partition), pc)
+
+	var (
+		latest *sarama.ConsumerMessage
+		next   = start
+	)
+scan:
+	for {
+		probe := time.NewTimer(caughtUpProbeInterval)
+		select {
+		case <-probe.C:
+			// compaction and transaction markers can leave the offsets before
+			// end without messages to deliver.
+			if onlyControlRecords(cmd.client, cmd.version, tp, next, end) {
+				break scan
+			}
+		case err, ok := <-pc.Errors():
+			probe.Stop()
+			if !ok {
+				return nil, errPartitionConsumerClosed
+			}
+			if err.Err == sarama.ErrOffsetOutOfRange {
+				return nil, err.Err
+			}
+			warnf("partition %v consumer encountered err=%v", tp.partition, err.Err)
+		case msg, ok := <-pc.Messages():
+			probe.Stop()
+			if !ok {
+				return nil, errPartitionConsumerClosed
+			}
+			if msg.Offset >= end {
+				break scan
+			}
+			if bytes.Equal(msg.Key, cmd.key) {
+				latest = msg
+			}
+			next = msg.Offset + 1
+			if next >= end {
+				break scan
+			}
+		}
+	}
+
+	if latest == nil {
+		return nil, errKeyNotFound
+	}
+	return latest, nil
+}
+
+var getDocString = `
+The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
+The values supplied on the command line win over environment variable values.
+
+Get looks up the current value of a key in a compacted topic. It computes the
+key's partition with -partitioner, which has to match the partitioner the
+topic is produced with, scans that partition up to the high water mark and
+prints the latest message with the key. When that message is a tombstone, its
+value is null and deleted is true. When the partition holds no message with
+the key, kt exits with 6 like for a missing topic, with the error code
+key_not_found.
+
+With -at, kt only scans the messages before the first message with a
+timestamp after the given time, as looked up by the brokers, which requires
+-version 0.10.1.0 or later. This shows the value as of that time as long as
+compaction didn't remove it yet.
+
+Example:
+
+  $ kt get -topic users -key id-23
+  {
+    "topic": "users",
+    "partition": 2,
+    "offset": 4711,
+    "key": "id-23",
+    "value": "{\"name\":\"Jane\"}",
+    "timestamp": "2026-10-01T09:12:44.318Z",
+    "deleted": false
+  }
+`
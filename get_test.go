@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPartitionAndInterval(t *testing.T) {
+	at := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	ms := at.UnixNano()/int64(time.Millisecond) + 1
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	offsets := sarama.NewMockOffsetResponse(t).SetVersion(1)
+	for p := int32(0); p < 4; p++ {
+		metadata.SetLeader("users", p, broker.BrokerID())
+		offsets.SetOffset("users", p, sarama.OffsetOldest, 10).
+			SetOffset("users", p, sarama.OffsetNewest, 100).
+			SetOffset("users", p, ms, 60)
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest":   offsets,
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_10_1_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, name := range []string{"hashCode", "murmur2"} {
+		target := &getCmd{topic: "users", key: []byte("id-23"), partitioner: name, client: client}
+		tp, err := target.partition()
+		require.NoError(t, err)
+
+		p, _ := newPartitioner(name, 1)
+		require.Equal(t, topicPartition{"users", p.partition([]byte("id-23"), 4)}, tp)
+	}
+
+	target := &getCmd{topic: "users", client: client}
+	start, end, err := target.interval(topicPartition{"users", 1})
+	require.NoError(t, err)
+	require.Equal(t, []int64{10, 100}, []int64{start, end})
+
+	target.at = &at
+	start, end, err = target.interval(topicPartition{"users", 1})
+	require.NoError(t, err)
+	require.Equal(t, []int64{10, 60}, []int64{start, end})
+}
+
+func TestGetLatest(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 5)
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 10, Key: []byte("id-23"), Value: []byte("v1")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 12, Key: []byte("id-42"), Value: []byte("other")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 15, Key: []byte("id-23"), Value: []byte("v2")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 18, Key: []byte("id-23")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 19, Key: []byte("id-42")}
+
+	calls := make(chan tConsumePartition, 3)
+	target := &getCmd{
+		key: []byte("id-23"),
+		consumer: tConsumer{
+			calls: calls,
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"users", 1, 10}: {messages: messages},
+			},
+		},
+	}
+	tp := topicPartition{"users", 1}
+
+	// the tombstone at offset 18 deletes the key.
+	msg, err := target.latest(tp, 10, 20)
+	require.NoError(t, err)
+	require.Equal(t, int64(18), msg.Offset)
+	require.Nil(t, msg.Value)
+
+	// compaction removed offset 16, the scan stops at the next message.
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 10, Key: []byte("id-23"), Value: []byte("v1")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 15, Key: []byte("id-23"), Value: []byte("v2")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 18, Key: []byte("id-23")}
+	msg, err = target.latest(tp, 10, 17)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(msg.Value))
+
+	// an empty interval isn't scanned at all.
+	_, err = target.latest(tp, 20, 20)
+	require.Equal(t, errKeyNotFound, err)
+	require.Len(t, calls, 2)
+}
+
+func TestGetKeyNotFound(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 2)
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 10, Key: []byte("id-42"), Value: []byte("other")}
+	messages <- &sarama.ConsumerMessage{Topic: "users", Partition: 1, Offset: 11, Key: []byte("id-43"), Value: []byte("other")}
+
+	target := &getCmd{
+		key: []byte("id-23"),
+		consumer: tConsumer{
+			calls: make(chan tConsumePartition, 1),
+			consumePartition: map[tConsumePartition]tPartitionConsumer{
+				{"users", 1, 10}: {messages: messages},
+			},
+		},
+	}
+
+	_, err := target.latest(topicPartition{"users", 1}, 10, 12)
+	require.Equal(t, errKeyNotFound, err)
+
+	// kt get exits with 6 like for a missing topic, but with its own code.
+	category, _ := classifyError(err)
+	require.Equal(t, "key_not_found", category.code)
+	require.Equal(t, exitCodeNotFound, category.exitCode)
+}
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
@@ -30,20 +31,69 @@ type groupCmd struct {
 	pretty       bool
 	version      sarama.KafkaVersion
 	offsets      bool
+	watch        time.Duration
 
-	client sarama.Client
+	client  sarama.Client
+	partial bool
 }
 
 type group struct {
 	Name    string        `json:"name"`
 	Topic   string        `json:"topic,omitempty"`
 	Offsets []groupOffset `json:"offsets,omitempty"`
+	Error   string        `json:"error,omitempty"`
 }
 
 type groupOffset struct {
 	Partition int32  `json:"partition"`
 	Offset    *int64 `json:"offset"`
 	Lag       *int64 `json:"lag"`
+	Error     string `json:"error,omitempty"`
+}
+
+// groupError is printed for brokers and topics that could not be read.
+type groupError struct {
+	Broker string `json:"broker,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Error  string `json:"error"`
+}
+
+// groupLag is printed per group and topic in watch mode. LagDelta and Rate
+// are relative to the previous sample and omitted for the first one.
+type groupLag struct {
+	Time     time.Time     `json:"time"`
+	Name     string        `json:"name"`
+	Topic    string        `json:"topic"`
+	Lag      int64         `json:"lag"`
+	LagDelta *int64        `json:"lagDelta,omitempty"`
+	Rate     *float64      `json:"rate,omitempty"`
+	Offsets  []groupOffset `json:"offsets"`
+}
+
+type groupTopic struct {
+	group string
+	topic string
+}
+
+// groupLagSample is the previous watch sample of a group and topic, with the
+// committed offset per partition.
+type groupLagSample struct {
+	time      time.Time
+	lag       int64
+	committed map[int32]int64
+}
+
+// rate returns how many offsets per second were committed between s and the
+// committed offsets at now. Only partitions with an offset in both count, so
+// that partitions appearing or disappearing don't skew it.
+func (s groupLagSample) rate(committed map[int32]int64, now time.Time) float64 {
+	var delta int64
+	for p, o := range committed {
+		if prev, ok := s.committed[p]; ok {
+			delta += o - prev
+		}
+	}
+	return float64(delta) / now.Sub(s.time).Seconds()
 }
 
 const (
@@ -67,10 +117,13 @@ func (cmd *groupCmd) run(args []string) {
 	brokers := cmd.client.Brokers()
 	fmt.Fprintf(os.Stderr, "found %v brokers\n", len(brokers))
 
+	out := make(chan printContext)
+	go print(out, cmd.pretty && cmd.watch == 0)
+
 	groups := []string{cmd.group}
 	if cmd.group == "" {
 		groups = []string{}
-		for _, g := range cmd.findGroups(brokers) {
+		for _, g := range cmd.findGroups(out) {
 			if cmd.filterGroups.MatchString(g) {
 				groups = append(groups, g)
 			}
@@ -89,9 +142,6 @@ func (cmd *groupCmd) run(args []string) {
 	}
 	fmt.Fprintf(os.Stderr, "found %v topics\n", len(topics))
 
-	out := make(chan printContext)
-	go print(out, cmd.pretty)
-
 	if !cmd.offsets {
 		for i, grp := range groups {
 			ctx := printContext{output: group{Name: grp}, done: make(chan struct{})}
@@ -102,6 +152,7 @@ func (cmd *groupCmd) run(args []string) {
 				fmt.Fprintf(os.Stderr, "%v/%v\n", i+1, len(groups))
 			}
 		}
+		cmd.exitPartial()
 		return
 	}
 
@@ -109,14 +160,30 @@ func (cmd *groupCmd) run(args []string) {
 	for _, topic := range topics {
 		parts := cmd.partitions
 		if len(parts) == 0 {
-			parts = cmd.fetchPartitions(topic)
+			var err error
+			if parts, err = cmd.client.Partitions(topic); err != nil {
+				cmd.printError(out, groupError{Topic: topic, Error: err.Error()})
+				continue
+			}
 			fmt.Fprintf(os.Stderr, "found partitions=%v for topic=%v\n", parts, topic)
 		}
 		topicPartitions[topic] = parts
 	}
 
+	if cmd.watch > 0 {
+		cmd.watchLag(out, groups, topicPartitions)
+		return
+	}
+
+	if cmd.reset == resetNotSpecified {
+		cmd.printGroupOffsets(out, groups, topicPartitions)
+		cmd.exitPartial()
+		return
+	}
+
+	// topics whose partitions can't be read were printed with an error above.
 	wg := &sync.WaitGroup{}
-	wg.Add(len(groups) * len(topics))
+	wg.Add(len(groups) * len(topicPartitions))
 	for _, grp := range groups {
 		for top, parts := range topicPartitions {
 			go func(grp, topic string, partitions []int32) {
@@ -126,6 +193,148 @@ func (cmd *groupCmd) run(args []string) {
 		}
 	}
 	wg.Wait()
+	cmd.exitPartial()
+}
+
+// printGroupOffsets prints the committed offsets and lag of the given groups
+// for each topic they have commits for. It sends one offset request per leader
+// broker and one offset fetch request per group covering all partitions.
+// Partitions that can't be read are printed with an error.
+func (cmd *groupCmd) printGroupOffsets(out chan printContext, groups []string, topicPartitions map[string][]int32) {
+	newest, err := fetchOffsets(cmd.client, topicPartitions, sarama.OffsetNewest)
+	newestErrs, _ := err.(partitionErrors)
+	if err != nil && newestErrs == nil {
+		warnf("failed to fetch newest offsets err=%v", err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([][]group, len(groups))
+		sem     = make(chan struct{}, offsetRequestConcurrency)
+	)
+	for i, grp := range groups {
+		wg.Add(1)
+		go func(i int, grp string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if cmd.verbose {
+				fmt.Fprintf(os.Stderr, "fetching offset information for group=%v\n", grp)
+			}
+			committed, err := fetchGroupOffsets(cmd.client, grp, topicPartitions)
+			errs, _ := err.(partitionErrors)
+			if err != nil && errs == nil {
+				results[i] = []group{{Name: grp, Error: err.Error()}}
+				return
+			}
+			if errs == nil {
+				errs = partitionErrors{}
+			}
+			for t, ps := range newestErrs {
+				for p, err := range ps {
+					if _, ok := committed[t][p]; ok {
+						errs.add(t, p, err)
+					}
+				}
+			}
+			results[i] = groupOffsets(grp, committed, newest, errs)
+		}(i, grp)
+	}
+	wg.Wait()
+
+	for _, gs := range results {
+		for _, g := range gs {
+			if g.failed() {
+				cmd.partial = true
+			}
+			ctx := printContext{output: g, done: make(chan struct{})}
+			out <- ctx
+			<-ctx.done
+		}
+	}
+}
+
+// groupOffsets combines a group's committed offsets with the newest offsets
+// into one group per topic, sorted by topic and partition. Lag is omitted for
+// partitions without a newest offset, errs are attached to their partitions.
+func groupOffsets(grp string, committed, newest map[string]map[int32]int64, errs partitionErrors) []group {
+	partitions := map[string]map[int32]bool{}
+	for t, ps := range committed {
+		for p := range ps {
+			if partitions[t] == nil {
+				partitions[t] = map[int32]bool{}
+			}
+			partitions[t][p] = true
+		}
+	}
+	for t, ps := range errs {
+		for p := range ps {
+			if partitions[t] == nil {
+				partitions[t] = map[int32]bool{}
+			}
+			partitions[t][p] = true
+		}
+	}
+
+	topics := make([]string, 0, len(partitions))
+	for t := range partitions {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	result := make([]group, 0, len(topics))
+	for _, top := range topics {
+		target := group{Name: grp, Topic: top, Offsets: make([]groupOffset, 0, len(partitions[top]))}
+		for part := range partitions[top] {
+			o := groupOffset{Partition: part}
+			if off, ok := committed[top][part]; ok {
+				o.Offset = &off
+				if partOff, ok := newest[top][part]; ok {
+					lag := partOff - off
+					o.Lag = &lag
+				}
+			}
+			if err := errs[top][part]; err != nil {
+				o.Error = err.Error()
+			}
+			target.Offsets = append(target.Offsets, o)
+		}
+		sort.Slice(target.Offsets, func(i, j int) bool {
+			return target.Offsets[i].Partition < target.Offsets[j].Partition
+		})
+		result = append(result, target)
+	}
+
+	return result
+}
+
+// failed reports whether g or any of its offsets could not be read.
+func (g group) failed() bool {
+	if g.Error != "" {
+		return true
+	}
+	for _, o := range g.Offsets {
+		if o.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *groupCmd) printError(out chan printContext, e groupError) {
+	cmd.partial = true
+	ctx := printContext{output: e, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+// exitPartial exits with exitCodePartial when some results were printed with
+// errors.
+func (cmd *groupCmd) exitPartial() {
+	if cmd.partial {
+		failPartial("failed to read some brokers, groups or partitions, see errors in output")
+	}
 }
 
 func (cmd *groupCmd) printGroupTopicOffset(out chan printContext, grp, top string, parts []int32) {
@@ -160,6 +369,73 @@ awaitGroupOffsets:
 	}
 }
 
+// watchLag prints the lag of the given groups every watch interval until
+// interrupted. Each interval sends one offset request per leader broker and
+// one offset fetch request per group.
+func (cmd *groupCmd) watchLag(out chan printContext, groups []string, topicPartitions map[string][]int32) {
+	var (
+		samples = map[groupTopic]groupLagSample{}
+		ticker  = time.NewTicker(cmd.watch)
+	)
+	defer ticker.Stop()
+
+	for {
+		cmd.printLag(out, groups, topicPartitions, samples)
+		<-ticker.C
+	}
+}
+
+func (cmd *groupCmd) printLag(out chan printContext, groups []string, topicPartitions map[string][]int32, samples map[groupTopic]groupLagSample) {
+	now := time.Now()
+
+	newest, err := fetchOffsets(cmd.client, topicPartitions, sarama.OffsetNewest)
+	if err != nil {
+		warnf("failed to fetch newest offsets, refreshing metadata err=%v", err)
+		topics := make([]string, 0, len(topicPartitions))
+		for t := range topicPartitions {
+			topics = append(topics, t)
+		}
+		if err = cmd.client.RefreshMetadata(topics...); err != nil {
+			warnf("failed to refresh metadata err=%v", err)
+		}
+	}
+
+	for _, grp := range groups {
+		committed, err := fetchGroupOffsets(cmd.client, grp, topicPartitions)
+		if err != nil {
+			warnf("failed to fetch offsets for group %v err=%v", grp, err)
+			if err = cmd.client.RefreshCoordinator(grp); err != nil {
+				warnf("failed to refresh coordinator for group %v err=%v", grp, err)
+			}
+			continue
+		}
+
+		for _, g := range groupOffsets(grp, committed, newest, nil) {
+			target := groupLag{Time: now, Name: grp, Topic: g.Topic, Offsets: g.Offsets}
+			committedOffsets := map[int32]int64{}
+			for _, o := range g.Offsets {
+				committedOffsets[o.Partition] = *o.Offset
+				if o.Lag != nil {
+					target.Lag += *o.Lag
+				}
+			}
+
+			key := groupTopic{group: grp, topic: g.Topic}
+			if prev, ok := samples[key]; ok {
+				lagDelta := target.Lag - prev.lag
+				rate := prev.rate(committedOffsets, now)
+				target.LagDelta = &lagDelta
+				target.Rate = &rate
+			}
+			samples[key] = groupLagSample{time: now, lag: target.Lag, committed: committedOffsets}
+
+			ctx := printContext{output: target, done: make(chan struct{})}
+			out <- ctx
+			<-ctx.done
+		}
+	}
+}
+
 func (cmd *groupCmd) resolveOffset(top string, part int32, off int64) int64 {
 	resolvedOff, err := cmd.client.GetOffset(top, part, off)
 	if err != nil {
@@ -228,92 +504,29 @@ func (cmd *groupCmd) fetchTopics() []string {
 	return tps
 }
 
-func (cmd *groupCmd) fetchPartitions(top string) []int32 {
-	ps, err := cmd.client.Partitions(top)
-	if err != nil {
-		failf("failed to read partitions for topic=%s err=%v", top, err)
-	}
-	return ps
-}
-
-type findGroupResult struct {
-	done  bool
-	group string
-}
-
-func (cmd *groupCmd) findGroups(brokers []*sarama.Broker) []string {
-	var (
-		doneCount int
-		groups    = []string{}
-		results   = make(chan findGroupResult)
-		errs      = make(chan error)
-	)
-
-	for _, broker := range brokers {
-		go cmd.findGroupsOnBroker(broker, results, errs)
-	}
-
-awaitGroups:
-	for {
-		if doneCount == len(brokers) {
-			return groups
-		}
-
-		select {
-		case err := <-errs:
-			failf("failed to find groups err=%v", err)
-		case res := <-results:
-			if res.done {
-				doneCount++
-				continue awaitGroups
-			}
-			groups = append(groups, res.group)
-		}
-	}
-}
-
-func (cmd *groupCmd) findGroupsOnBroker(broker *sarama.Broker, results chan findGroupResult, errs chan error) {
-	var (
-		err  error
-		resp *sarama.ListGroupsResponse
-	)
-	if err = cmd.connect(broker); err != nil {
-		errs <- fmt.Errorf("failed to connect to broker %#v err=%s\n", broker.Addr(), err)
-	}
-
-	if resp, err = broker.ListGroups(&sarama.ListGroupsRequest{}); err != nil {
-		errs <- fmt.Errorf("failed to list brokers on %#v err=%v", broker.Addr(), err)
-	}
-
-	if resp.Err != sarama.ErrNoError {
-		errs <- fmt.Errorf("failed to list brokers on %#v err=%v", broker.Addr(), resp.Err)
-	}
-
-	for name := range resp.Groups {
-		results <- findGroupResult{group: name}
-	}
-	results <- findGroupResult{done: true}
-}
-
-func (cmd *groupCmd) connect(broker *sarama.Broker) error {
-	if ok, _ := broker.Connected(); ok {
-		return nil
+// findGroups returns the groups of all brokers, printing an error for each
+// broker that can't be queried.
+func (cmd *groupCmd) findGroups(out chan printContext) []string {
+	groups, err := listGroups(cmd.client)
+	if err == nil {
+		return groups
 	}
 
-	if err := broker.Open(cmd.saramaConfig()); err != nil {
-		return err
+	errs, ok := err.(brokerErrors)
+	if !ok {
+		failf("failed to find groups err=%v", err)
 	}
 
-	connected, err := broker.Connected()
-	if err != nil {
-		return err
+	addrs := make([]string, 0, len(errs))
+	for a := range errs {
+		addrs = append(addrs, a)
 	}
-
-	if !connected {
-		return fmt.Errorf("failed to connect broker %#v", broker.Addr())
+	sort.Strings(addrs)
+	for _, a := range addrs {
+		cmd.printError(out, groupError{Broker: a, Error: errs[a].Error()})
 	}
 
-	return nil
+	return groups
 }
 
 func (cmd *groupCmd) saramaConfig() *sarama.Config {
@@ -325,7 +538,7 @@ func (cmd *groupCmd) saramaConfig() *sarama.Config {
 
 	cfg.Version = cmd.version
 	if usr, err = user.Current(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+		warnf("Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-group-" + sanitizeUsername(usr.Username)
 
@@ -342,8 +555,7 @@ func (cmd *groupCmd) saramaConfig() *sarama.Config {
 }
 
 func (cmd *groupCmd) failStartup(msg string) {
-	fmt.Fprintln(os.Stderr, msg)
-	failf("use \"kt group -help\" for more information")
+	failUsage(msg, "use \"kt group -help\" for more information")
 }
 
 func (cmd *groupCmd) parseArgs(as []string) {
@@ -366,6 +578,7 @@ func (cmd *groupCmd) parseArgs(as []string) {
 	cmd.pretty = args.pretty
 	cmd.offsets = args.offsets
 	cmd.version = kafkaVersion(args.version)
+	cmd.watch = args.watch
 
 	switch args.partitions {
 	case "", "all":
@@ -397,6 +610,14 @@ func (cmd *groupCmd) parseArgs(as []string) {
 		failf("group and topic are required to reset offsets.")
 	}
 
+	if args.watch < 0 {
+		failf("watch interval must be positive, got %v", args.watch)
+	}
+
+	if args.watch > 0 && (args.reset != "" || !args.offsets) {
+		failf("watch can't be combined with -reset or -offsets=false.")
+	}
+
 	switch args.reset {
 	case "newest":
 		cmd.reset = sarama.OffsetNewest
@@ -409,7 +630,7 @@ func (cmd *groupCmd) parseArgs(as []string) {
 		cmd.reset, err = strconv.ParseInt(args.reset, 10, 64)
 		if err != nil {
 			if cmd.verbose {
-				fmt.Fprintf(os.Stderr, "failed to parse set %#v err=%v", args.reset, err)
+				warnf("failed to parse set %#v err=%v", args.reset, err)
 			}
 			cmd.failStartup(fmt.Sprintf(`set value %#v not valid. either newest, oldest or specific offset expected.`, args.reset))
 		}
@@ -446,6 +667,7 @@ type groupArgs struct {
 	pretty       bool
 	version      string
 	offsets      bool
+	watch        time.Duration
 }
 
 func (cmd *groupCmd) parseFlags(as []string) groupArgs {
@@ -465,6 +687,9 @@ func (cmd *groupCmd) parseFlags(as []string) groupArgs {
 	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
 	flags.StringVar(&args.partitions, "partitions", allPartitionsHuman, "comma separated list of partitions to limit offsets to, or all")
 	flags.BoolVar(&args.offsets, "offsets", true, "Controls if offsets should be fetched (defauls to true)")
+	flags.DurationVar(&args.watch, "watch", 0, "Interval for repeatedly printing lag per group and topic as JSON lines (default 0 to print once).")
+
+	addErrorsFlag(flags)
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of group:")
@@ -488,7 +713,10 @@ The values supplied on the command line win over environment variable values.
 
 The group command can be used to list groups, their offsets and lag and to reset a group's offset.
 
-When an explicit offset hasn't been set yet, kt prints out the respective sarama constants, cf. https://godoc.org/github.com/Shopify/sarama#pkg-constants
+Offsets and lag are only printed for topics and partitions the group has committed offsets for.
+
+When some brokers, groups or partitions can't be read, kt prints the remaining
+results with an "error" field on the affected items and exits with code 3.
 
 To simply list all groups:
 
@@ -513,4 +741,12 @@ kt group -reset 23 -topic fav-topic -group specials -partitions 2
 To reset a consumer group's offset for all partitions:
 
 kt group -reset newest -topic fav-topic -group specials -partitions all
+
+To print the lag of a consumer group every 10 seconds until interrupted:
+
+kt group -group specials -topic fav-topic -watch 10s
+
+In watch mode, kt prints one JSON line per group and topic with committed
+offsets, containing the total lag, the change in lag since the previous line
+(lagDelta) and the consumption rate in committed offsets per second (rate).
 `
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupOffsets(t *testing.T) {
+	committed := map[string]map[int32]int64{
+		"b": {1: 5, 0: 7},
+		"a": {0: 3},
+	}
+	newest := map[string]map[int32]int64{
+		"b": {0: 10, 1: 5},
+	}
+
+	actual := groupOffsets("specials", committed, newest, nil)
+	require.Len(t, actual, 2)
+
+	require.Equal(t, "a", actual[0].Topic)
+	require.Len(t, actual[0].Offsets, 1)
+	require.Equal(t, int64(3), *actual[0].Offsets[0].Offset)
+	require.Nil(t, actual[0].Offsets[0].Lag)
+
+	require.Equal(t, "b", actual[1].Topic)
+	require.Equal(t, "specials", actual[1].Name)
+	require.Len(t, actual[1].Offsets, 2)
+	require.Equal(t, int32(0), actual[1].Offsets[0].Partition)
+	require.Equal(t, int64(3), *actual[1].Offsets[0].Lag)
+	require.Equal(t, int32(1), actual[1].Offsets[1].Partition)
+	require.Equal(t, int64(0), *actual[1].Offsets[1].Lag)
+	require.False(t, actual[1].failed())
+
+	errs := partitionErrors{}
+	errs.add("b", 1, sarama.ErrNotLeaderForPartition)
+	errs.add("c", 0, sarama.ErrUnknownTopicOrPartition)
+	actual = groupOffsets("specials", committed, newest, errs)
+	require.Len(t, actual, 3)
+	require.False(t, actual[0].failed())
+	require.True(t, actual[1].failed())
+	require.Equal(t, sarama.ErrNotLeaderForPartition.Error(), actual[1].Offsets[1].Error)
+	require.Equal(t, int64(5), *actual[1].Offsets[1].Offset)
+	require.Equal(t, "c", actual[2].Topic)
+	require.Nil(t, actual[2].Offsets[0].Offset)
+	require.Equal(t, sarama.ErrUnknownTopicOrPartition.Error(), actual[2].Offsets[0].Error)
+}
+
+func TestGroupPrintGroupOffsets(t *testing.T) {
+	broker := newOffsetsMockBroker(t, 90)
+	defer broker.Close()
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	var (
+		target     = &groupCmd{client: client}
+		partitions = map[string][]int32{"orders": {0, 1}, "payments": {0}}
+		out        = make(chan printContext)
+		printed    = make(chan group, 10)
+	)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output.(group)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.printGroupOffsets(out, []string{"specials"}, partitions)
+	close(printed)
+
+	var actual []group
+	for g := range printed {
+		actual = append(actual, g)
+	}
+	require.Len(t, actual, 1)
+	require.False(t, target.partial)
+	require.Equal(t, "orders", actual[0].Topic)
+	require.Len(t, actual[0].Offsets, 1)
+	require.Equal(t, int64(10), *actual[0].Offsets[0].Lag)
+
+	var fetches int
+	for _, r := range broker.History() {
+		if _, ok := r.Request.(*sarama.OffsetFetchRequest); ok {
+			fetches++
+		}
+	}
+	require.Equal(t, 1, fetches)
+}
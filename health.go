@@ -0,0 +1,389 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Exit codes of kt health, following the convention of Nagios plugins.
+const (
+	healthOK       = 0
+	healthWarning  = 1
+	healthCritical = 2
+	healthUnknown  = 3
+)
+
+var healthStatusNames = map[int]string{
+	healthOK:       "ok",
+	healthWarning:  "warning",
+	healthCritical: "critical",
+	healthUnknown:  "unknown",
+}
+
+type healthCmd struct {
+	brokers    []string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	filter     *regexp.Regexp
+	verbose    bool
+	pretty     bool
+	version    sarama.KafkaVersion
+
+	client sarama.Client
+}
+
+type healthArgs struct {
+	brokers    string
+	tlsCA      string
+	tlsCert    string
+	tlsCertKey string
+	filter     string
+	verbose    bool
+	pretty     bool
+	version    string
+}
+
+type healthReport struct {
+	Status     string         `json:"status"`
+	Brokers    []healthBroker `json:"brokers"`
+	Controller *healthBroker  `json:"controller"`
+	Topics     int            `json:"topics"`
+	Partitions int            `json:"partitions"`
+	Issues     []healthIssue  `json:"issues"`
+	Skipped    []string       `json:"skipped,omitempty"`
+
+	code int
+}
+
+type healthBroker struct {
+	ID        int32  `json:"id"`
+	Addr      string `json:"addr"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthIssue struct {
+	Severity  string `json:"severity"`
+	Check     string `json:"check"`
+	Topic     string `json:"topic,omitempty"`
+	Partition *int32 `json:"partition,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (r *healthReport) add(code int, check, topic string, partition *int32, msg string, args ...interface{}) {
+	if code > r.code {
+		r.code = code
+	}
+	r.Issues = append(r.Issues, healthIssue{
+		Severity:  healthStatusNames[code],
+		Check:     check,
+		Topic:     topic,
+		Partition: partition,
+		Message:   fmt.Sprintf(msg, args...),
+	})
+}
+
+func (cmd *healthCmd) parseFlags(as []string) healthArgs {
+	var args healthArgs
+	flags := flag.NewFlagSet("health", flag.ContinueOnError)
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.filter, "filter", "", "Regex to filter the checked topics by name.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of health:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, healthDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(healthUnknown)
+	}
+
+	return args
+}
+
+func (cmd *healthCmd) parseArgs(as []string) {
+	var err error
+	args := cmd.parseFlags(as)
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	if cmd.filter, err = regexp.Compile(args.filter); err != nil {
+		exitf(healthUnknown, "invalid regex for filter err=%s", err)
+	}
+	if cmd.version, err = parseKafkaVersion(args.version); err != nil {
+		exitf(healthUnknown, "invalid version err=%s", err)
+	}
+
+	cmd.brokers = parseBrokers(args.brokers)
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.verbose = args.verbose
+	cmd.pretty = args.pretty
+}
+
+func (cmd *healthCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-health-" + sanitizeUsername(usr.Username)
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		exitf(healthUnknown, "failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+func (cmd *healthCmd) run(as []string) {
+	var (
+		err    error
+		report *healthReport
+	)
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if cmd.client, err = sarama.NewClient(cmd.brokers, cmd.saramaConfig()); err != nil {
+		report = &healthReport{Brokers: []healthBroker{}, Issues: []healthIssue{}}
+		report.add(healthCritical, "brokers", "", nil, "failed to connect to any of %v err=%v", cmd.brokers, err)
+	} else {
+		report = cmd.check()
+		logClose("client", cmd.client)
+	}
+	report.Status = healthStatusNames[report.code]
+
+	out := make(chan printContext)
+	go print(out, cmd.pretty)
+	ctx := printContext{output: report, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+
+	os.Exit(report.code)
+}
+
+// check runs all health checks against the cluster. Unreachable brokers,
+// a missing controller, offline partitions and partitions with fewer in-sync
+// replicas than min.insync.replicas are critical, under-replicated partitions
+// are a warning.
+func (cmd *healthCmd) check() *healthReport {
+	report := &healthReport{Brokers: []healthBroker{}, Issues: []healthIssue{}}
+
+	cmd.checkBrokers(report)
+	cmd.checkController(report)
+
+	all, err := cmd.client.Topics()
+	if err != nil {
+		report.add(healthCritical, "topics", "", nil, "failed to read topics err=%v", err)
+		return report
+	}
+
+	topics := []string{}
+	for _, t := range all {
+		if cmd.filter.MatchString(t) {
+			topics = append(topics, t)
+		}
+	}
+	sort.Strings(topics)
+	report.Topics = len(topics)
+
+	minISRs := cmd.minInsyncReplicas(report, topics)
+	for _, t := range topics {
+		cmd.checkTopic(report, t, minISRs[t])
+	}
+
+	return report
+}
+
+func (cmd *healthCmd) checkBrokers(report *healthReport) {
+	brokers := cmd.client.Brokers()
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].ID() < brokers[j].ID() })
+
+	for _, b := range brokers {
+		hb := healthBroker{ID: b.ID(), Addr: b.Addr()}
+		err := b.Open(cmd.client.Config())
+		if err == nil || err == sarama.ErrAlreadyConnected {
+			hb.Reachable, err = b.Connected()
+		}
+		if err != nil {
+			hb.Error = err.Error()
+		}
+		if !hb.Reachable {
+			report.add(healthCritical, "brokers", "", nil, "broker %v at %v is unreachable", hb.ID, hb.Addr)
+		}
+		report.Brokers = append(report.Brokers, hb)
+	}
+}
+
+func (cmd *healthCmd) checkController(report *healthReport) {
+	if !cmd.client.Config().Version.IsAtLeast(sarama.V0_10_0_0) {
+		report.Skipped = append(report.Skipped, "controller check requires -version 0.10.0.0 or later")
+		return
+	}
+
+	controller, err := cmd.client.Controller()
+	if err != nil {
+		report.add(healthCritical, "controller", "", nil, "failed to find controller err=%v", err)
+		return
+	}
+	report.Controller = &healthBroker{ID: controller.ID(), Addr: controller.Addr()}
+	report.Controller.Reachable, _ = controller.Connected()
+}
+
+// minInsyncReplicas reads the min.insync.replicas config of the given topics
+// with a single request to the controller.
+func (cmd *healthCmd) minInsyncReplicas(report *healthReport, topics []string) map[string]int {
+	result := map[string]int{}
+	if !cmd.client.Config().Version.IsAtLeast(sarama.V0_11_0_0) {
+		report.Skipped = append(report.Skipped, "min.insync.replicas check requires -version 0.11.0.0 or later")
+		return result
+	}
+	if len(topics) == 0 {
+		return result
+	}
+
+	controller, err := cmd.client.Controller()
+	if err != nil {
+		report.Skipped = append(report.Skipped, "min.insync.replicas check requires a controller")
+		return result
+	}
+
+	req := &sarama.DescribeConfigsRequest{}
+	for _, t := range topics {
+		req.Resources = append(req.Resources, &sarama.ConfigResource{
+			Type:        sarama.TopicResource,
+			Name:        t,
+			ConfigNames: []string{"min.insync.replicas"},
+		})
+	}
+
+	resp, err := controller.DescribeConfigs(req)
+	if err != nil {
+		report.add(healthCritical, "min-insync-replicas", "", nil, "failed to describe topic configs err=%v", err)
+		return result
+	}
+
+	for _, r := range resp.Resources {
+		if r.ErrorMsg != "" {
+			report.add(healthCritical, "min-insync-replicas", r.Name, nil, "failed to describe topic config err=%v", r.ErrorMsg)
+			continue
+		}
+		for _, c := range r.Configs {
+			if c.Name != "min.insync.replicas" {
+				continue
+			}
+			if v, err := strconv.Atoi(c.Value); err == nil {
+				result[r.Name] = v
+			}
+		}
+	}
+
+	return result
+}
+
+func (cmd *healthCmd) checkTopic(report *healthReport, topic string, minISR int) {
+	partitions, err := cmd.client.Partitions(topic)
+	if err != nil {
+		report.add(healthCritical, "topics", topic, nil, "failed to read partitions err=%v", err)
+		return
+	}
+	report.Partitions += len(partitions)
+
+	writable, err := cmd.client.WritablePartitions(topic)
+	if err != nil {
+		report.add(healthCritical, "topics", topic, nil, "failed to read writable partitions err=%v", err)
+		return
+	}
+	online := map[int32]bool{}
+	for _, p := range writable {
+		online[p] = true
+	}
+
+	for _, p := range partitions {
+		p := p
+		if !online[p] {
+			report.add(healthCritical, "offline-partitions", topic, &p, "partition has no leader")
+			continue
+		}
+
+		replicas, err := cmd.client.Replicas(topic, p)
+		if err != nil && err != sarama.ErrReplicaNotAvailable {
+			report.add(healthCritical, "topics", topic, &p, "failed to read replicas err=%v", err)
+			continue
+		}
+		isrs, err := cmd.client.InSyncReplicas(topic, p)
+		if err != nil && err != sarama.ErrReplicaNotAvailable {
+			report.add(healthCritical, "topics", topic, &p, "failed to read in-sync replicas err=%v", err)
+			continue
+		}
+
+		if minISR > 0 && len(isrs) < minISR {
+			report.add(healthCritical, "min-insync-replicas", topic, &p, "%v in-sync replicas, min.insync.replicas is %v", len(isrs), minISR)
+		} else if len(isrs) < len(replicas) {
+			report.add(healthWarning, "under-replicated-partitions", topic, &p, "%v of %v replicas in sync", len(isrs), len(replicas))
+		}
+	}
+}
+
+var healthDocString = `
+The value for -brokers can also be set via the environment variable KT_BROKERS.
+The value supplied on the command line wins over the environment variable value.
+
+Health checks the cluster and prints a JSON report with the overall status and
+a list of issues. The exit code reflects the status:
+
+  0  ok
+  1  warning: under-replicated partitions
+  2  critical: unreachable brokers, no controller, offline partitions or
+     partitions with fewer in-sync replicas than min.insync.replicas
+  3  unknown: invalid arguments or setup
+
+The controller check requires -version 0.10.0.0 or later, the
+min.insync.replicas check -version 0.11.0.0 or later; they are listed as
+skipped otherwise.
+
+Example:
+
+  kt health -version 1.0.0 -filter '^orders' || alert "kafka is $?"
+`
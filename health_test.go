@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func newHealthCmd(t *testing.T, broker *sarama.MockBroker, metadata *sarama.MetadataResponse, minISR string) *healthCmd {
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockWrapper(metadata),
+		"DescribeConfigsRequest": sarama.NewMockWrapper(&sarama.DescribeConfigsResponse{
+			Resources: []*sarama.ResourceResponse{{
+				Type:    sarama.TopicResource,
+				Name:    "orders",
+				Configs: []*sarama.ConfigEntry{{Name: "min.insync.replicas", Value: minISR}},
+			}},
+		}),
+	})
+
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	cfg.Metadata.Retry.Backoff = time.Millisecond
+	client, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+	require.NoError(t, err)
+
+	return &healthCmd{client: client, filter: regexp.MustCompile("")}
+}
+
+func newHealthMetadata(broker *sarama.MockBroker) *sarama.MetadataResponse {
+	metadata := &sarama.MetadataResponse{Version: 1, ControllerID: broker.BrokerID()}
+	metadata.AddBroker(broker.Addr(), broker.BrokerID())
+	return metadata
+}
+
+func TestHealthCheckOK(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := newHealthMetadata(broker)
+	metadata.AddTopicPartition("orders", 0, broker.BrokerID(), []int32{1}, []int32{1}, sarama.ErrNoError)
+
+	target := newHealthCmd(t, broker, metadata, "1")
+	defer target.client.Close()
+
+	report := target.check()
+	require.Equal(t, healthOK, report.code)
+	require.Empty(t, report.Issues)
+	require.Equal(t, 1, report.Topics)
+	require.Equal(t, 1, report.Partitions)
+	require.Len(t, report.Brokers, 1)
+	require.True(t, report.Brokers[0].Reachable)
+	require.NotNil(t, report.Controller)
+	require.Equal(t, broker.BrokerID(), report.Controller.ID)
+}
+
+func TestHealthCheckIssues(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := newHealthMetadata(broker)
+	metadata.AddTopicPartition("orders", 0, broker.BrokerID(), []int32{1, 2, 3}, []int32{1, 2}, sarama.ErrNoError)
+	metadata.AddTopicPartition("orders", 1, broker.BrokerID(), []int32{1, 2, 3}, []int32{1}, sarama.ErrNoError)
+	metadata.AddTopicPartition("orders", 2, -1, []int32{1, 2, 3}, []int32{}, sarama.ErrLeaderNotAvailable)
+
+	target := newHealthCmd(t, broker, metadata, "2")
+	defer target.client.Close()
+
+	report := target.check()
+	require.Equal(t, healthCritical, report.code)
+	require.Len(t, report.Issues, 3)
+
+	checks := map[int32]string{}
+	severities := map[int32]string{}
+	for _, i := range report.Issues {
+		require.Equal(t, "orders", i.Topic)
+		require.NotNil(t, i.Partition)
+		checks[*i.Partition] = i.Check
+		severities[*i.Partition] = i.Severity
+	}
+	require.Equal(t, map[int32]string{
+		0: "under-replicated-partitions",
+		1: "min-insync-replicas",
+		2: "offline-partitions",
+	}, checks)
+	require.Equal(t, "warning", severities[0])
+	require.Equal(t, "critical", severities[1])
+	require.Equal(t, "critical", severities[2])
+}
+
+func TestHealthCheckSkipsWithOldVersion(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := &healthCmd{client: client, filter: regexp.MustCompile("")}
+	report := target.check()
+	require.Equal(t, healthOK, report.code)
+	require.Nil(t, report.Controller)
+	require.Len(t, report.Skipped, 2)
+}
+
+func TestHealthParseArgsVersion(t *testing.T) {
+	target := &healthCmd{}
+	target.parseArgs([]string{"-version", "v1.0.0"})
+	require.Equal(t, sarama.V1_0_0_0, target.version)
+
+	target.parseArgs(nil)
+	require.Equal(t, sarama.V2_0_0_0, target.version)
+
+	// an invalid version exits with healthUnknown rather than the usage
+	// error's code, which reads as critical.
+	_, err := parseKafkaVersion("1.0.x")
+	require.Error(t, err)
+}
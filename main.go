@@ -32,14 +32,37 @@ The commands are:
 	topic      topic information.
 	group      consumer group information and modification.
 	admin      basic cluster administration.
+	copy       copy messages between topics and clusters.
+	backup     back up a topic to an archive file.
+	restore    restore a topic from an archive file.
+	perf       benchmark producing and consuming.
+	exporter   serve Prometheus metrics for offsets and lag.
+	health     check cluster health for alerting.
+	partition  show which partition a key is assigned to.
+	get        look up the current value of a key in a compacted topic.
 
 Use "kt [command] -help" for for information about the command.
 
+Errors are written to stderr as text, or as JSON objects with a stable code
+when passing -errors json or setting KT_ERRORS=json. The exit code reflects
+the kind of failure:
+
+	1  unclassified failure
+	2  invalid flags or arguments (invalid_arguments)
+	3  results are incomplete, cf. errors in output (partial_results)
+	4  brokers, leaders or coordinators unavailable (broker_unavailable)
+	5  authentication or authorization failed (auth_failed, not_authorized)
+	6  topic, partition or key doesn't exist (topic_not_found, key_not_found)
+	7  offset out of range (offset_out_of_range)
+	8  request rejected by the broker (topic_exists, message_too_large,
+	   unsupported_version, invalid_request)
+	9  request timed out (timeout)
+
 More at https://github.com/fgeller/kt`
 
 func parseArgs() command {
 	if len(os.Args) < 2 {
-		failf(usageMessage)
+		failErrorf(&categoryUsage, "%s", usageMessage)
 	}
 
 	switch os.Args[1] {
@@ -53,10 +76,26 @@ func parseArgs() command {
 		return &groupCmd{}
 	case "admin":
 		return &adminCmd{}
+	case "copy":
+		return &copyCmd{}
+	case "backup":
+		return &backupCmd{}
+	case "restore":
+		return &restoreCmd{}
+	case "perf":
+		return &perfCmd{}
+	case "exporter":
+		return &exporterCmd{}
+	case "health":
+		return &healthCmd{}
+	case "partition":
+		return &partitionCmd{}
+	case "get":
+		return &getCmd{}
 	case "-h", "-help", "--help":
 		quitf(usageMessage)
 	default:
-		failf(usageMessage)
+		failErrorf(&categoryUsage, "%s", usageMessage)
 	}
 	return nil
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// mergeMaxBuffered is how many messages -merge-by-timestamp holds at most.
+// Once reached, the earliest message is printed without waiting for the
+// partitions that have nothing buffered.
+var mergeMaxBuffered = 10000
+
+// mergeMessage is a consumed message waiting to be printed in timestamp order.
+// With -group, pom marks it as consumed once it's printed.
+type mergeMessage struct {
+	tp        topicPartition
+	offset    int64
+	timestamp time.Time
+	received  time.Time
+	output    interface{}
+	pom       sarama.PartitionOffsetManager
+}
+
+// before reports whether m is printed before o: by timestamp, and by topic,
+// partition and offset for equal timestamps.
+func (m mergeMessage) before(o mergeMessage) bool {
+	switch {
+	case !m.timestamp.Equal(o.timestamp):
+		return m.timestamp.Before(o.timestamp)
+	case m.tp.topic != o.tp.topic:
+		return m.tp.topic < o.tp.topic
+	case m.tp.partition != o.tp.partition:
+		return m.tp.partition < o.tp.partition
+	}
+	return m.offset < o.offset
+}
+
+// mergeControl tells the merge that a partition started or stopped being
+// consumed, or asks it to print all buffered messages.
+type mergeControl struct {
+	tp      topicPartition
+	started bool
+	stopped bool
+	flushed chan struct{}
+}
+
+// consumeMerge prints the messages of all partitions in timestamp order. It
+// buffers the messages of each partition in offset order and prints the
+// earliest of the partitions' first messages once every partition still being
+// consumed has a message buffered, so that no partition can deliver an
+// earlier one anymore. With maxLag, a message is held at most that long
+// waiting for partitions that have nothing buffered.
+type consumeMerge struct {
+	maxLag      time.Duration
+	maxBuffered int
+	in          chan mergeMessage
+	control     chan mergeControl
+	out         chan printContext
+
+	buffers  map[topicPartition][]mergeMessage
+	buffered int
+	active   map[topicPartition]bool
+	last     map[topicPartition]time.Time
+	printed  time.Time
+	late     int64
+}
+
+func newConsumeMerge(out chan printContext, maxLag time.Duration) *consumeMerge {
+	return &consumeMerge{
+		maxLag:      maxLag,
+		maxBuffered: mergeMaxBuffered,
+		in:          make(chan mergeMessage),
+		control:     make(chan mergeControl),
+		out:         out,
+		buffers:     map[topicPartition][]mergeMessage{},
+		active:      map[topicPartition]bool{},
+		last:        map[topicPartition]time.Time{},
+	}
+}
+
+func (m *consumeMerge) start(tp topicPartition) {
+	m.control <- mergeControl{tp: tp, started: true}
+}
+
+func (m *consumeMerge) stop(tp topicPartition) {
+	m.control <- mergeControl{tp: tp, stopped: true}
+}
+
+// flush prints all buffered messages and returns once they're written.
+func (m *consumeMerge) flush() {
+	flushed := make(chan struct{})
+	m.control <- mergeControl{flushed: flushed}
+	<-flushed
+}
+
+func (m *consumeMerge) run() {
+	for {
+		var (
+			timer *time.Timer
+			wait  <-chan time.Time
+		)
+		if d, ok := m.printReady(time.Now()); ok {
+			timer = time.NewTimer(d)
+			wait = timer.C
+		}
+
+		select {
+		case msg := <-m.in:
+			m.push(msg)
+		case c := <-m.control:
+			switch {
+			case c.started:
+				m.active[c.tp] = true
+			case c.stopped:
+				delete(m.active, c.tp)
+			case c.flushed != nil:
+				for m.buffered > 0 {
+					m.printNext()
+				}
+				if m.late > 0 {
+					fmt.Fprintf(os.Stderr, "printed %v late messages out of timestamp order\n", m.late)
+				}
+				close(c.flushed)
+			}
+		case <-wait:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// push buffers msg. Messages without timestamp take the timestamp of the
+// message before them in their partition, so they stay next to it, or sort
+// first when there's none.
+func (m *consumeMerge) push(msg mergeMessage) {
+	if msg.timestamp.IsZero() {
+		msg.timestamp = m.last[msg.tp]
+	}
+	m.last[msg.tp] = msg.timestamp
+
+	m.buffers[msg.tp] = append(m.buffers[msg.tp], msg)
+	m.buffered++
+}
+
+// printReady prints the messages that are due at now. It returns how long to
+// wait until the next buffered message is due, if it's held for -merge-max-lag.
+func (m *consumeMerge) printReady(now time.Time) (time.Duration, bool) {
+	for m.buffered > 0 {
+		next, _ := m.next()
+		if m.complete() || m.buffered >= m.maxBuffered {
+			m.printNext()
+			continue
+		}
+
+		if m.maxLag <= 0 {
+			return 0, false
+		}
+		if wait := next.received.Add(m.maxLag).Sub(now); wait > 0 {
+			return wait, true
+		}
+		m.printNext()
+	}
+	return 0, false
+}
+
+// complete reports whether every partition still being consumed has a
+// message buffered.
+func (m *consumeMerge) complete() bool {
+	for tp := range m.active {
+		if len(m.buffers[tp]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the earliest of the partitions' first buffered messages.
+func (m *consumeMerge) next() (mergeMessage, bool) {
+	var (
+		next  mergeMessage
+		found bool
+	)
+	for _, buf := range m.buffers {
+		if len(buf) > 0 && (!found || buf[0].before(next)) {
+			next, found = buf[0], true
+		}
+	}
+	return next, found
+}
+
+// printNext prints the earliest buffered message and marks it as consumed. A
+// message older than one printed before is late, it is counted and printed out
+// of order rather than dropped.
+func (m *consumeMerge) printNext() {
+	next, ok := m.next()
+	if !ok {
+		return
+	}
+
+	buf := m.buffers[next.tp][1:]
+	if len(buf) == 0 {
+		delete(m.buffers, next.tp)
+	} else {
+		m.buffers[next.tp] = buf
+	}
+	m.buffered--
+
+	if next.timestamp.Before(m.printed) {
+		m.late++
+	} else {
+		m.printed = next.timestamp
+	}
+
+	ctx := printContext{output: next.output, done: make(chan struct{})}
+	m.out <- ctx
+	<-ctx.done
+
+	if next.pom != nil {
+		next.pom.MarkOffset(next.offset+1, "")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+// collectMerged starts a merge printing to a channel and returns the outputs
+// printed, in order.
+func collectMerged(maxLag time.Duration) (*consumeMerge, chan interface{}) {
+	out := make(chan printContext)
+	printed := make(chan interface{}, 100)
+	go func() {
+		for ctx := range out {
+			printed <- ctx.output
+			close(ctx.done)
+		}
+	}()
+
+	m := newConsumeMerge(out, maxLag)
+	go m.run()
+	return m, printed
+}
+
+func drain(printed chan interface{}) []interface{} {
+	var res []interface{}
+	for {
+		select {
+		case o := <-printed:
+			res = append(res, o)
+		default:
+			return res
+		}
+	}
+}
+
+func TestConsumeMergeOrder(t *testing.T) {
+	m, printed := collectMerged(0)
+	a, b := topicPartition{"orders", 0}, topicPartition{"orders", 1}
+	at := func(s int) time.Time { return time.Unix(int64(s), 0) }
+
+	m.start(a)
+	m.start(b)
+	m.in <- mergeMessage{tp: a, offset: 0, timestamp: at(10), output: "a0"}
+	m.in <- mergeMessage{tp: a, offset: 1, timestamp: at(30), output: "a1"}
+	m.in <- mergeMessage{tp: a, offset: 2, output: "a2"}
+
+	// nothing is printed while partition b might still deliver earlier
+	// messages.
+	syncMerge(m)
+	require.Empty(t, drain(printed))
+
+	// ties are ordered by partition and a2 without timestamp follows a1.
+	m.in <- mergeMessage{tp: b, offset: 0, timestamp: at(20), output: "b0"}
+	m.in <- mergeMessage{tp: b, offset: 1, timestamp: at(30), output: "b1"}
+	syncMerge(m)
+	require.Equal(t, []interface{}{"a0", "b0", "a1", "a2"}, drain(printed))
+
+	// b isn't waited for once stopped, b2 arrives late.
+	m.stop(b)
+	m.in <- mergeMessage{tp: a, offset: 3, timestamp: at(40), output: "a3"}
+	syncMerge(m)
+	require.Equal(t, []interface{}{"b1", "a3"}, drain(printed))
+
+	m.in <- mergeMessage{tp: b, offset: 2, timestamp: at(5), output: "b2"}
+	m.flush()
+	require.Equal(t, []interface{}{"b2"}, drain(printed))
+	require.Equal(t, int64(1), m.late)
+}
+
+func TestConsumeMergeMaxLag(t *testing.T) {
+	m, printed := collectMerged(20 * time.Millisecond)
+	a, b := topicPartition{"orders", 0}, topicPartition{"orders", 1}
+
+	m.start(a)
+	m.start(b)
+	m.in <- mergeMessage{tp: a, offset: 0, timestamp: time.Unix(10, 0), received: time.Now(), output: "a0"}
+
+	select {
+	case o := <-printed:
+		require.Equal(t, "a0", o)
+	case <-time.After(time.Second):
+		t.Errorf("message was not printed after the max lag")
+	}
+}
+
+func TestConsumeMergeMaxBuffered(t *testing.T) {
+	defer func(n int) { mergeMaxBuffered = n }(mergeMaxBuffered)
+	mergeMaxBuffered = 2
+
+	m, printed := collectMerged(0)
+	a, b := topicPartition{"orders", 0}, topicPartition{"orders", 1}
+
+	m.start(a)
+	m.start(b)
+	m.in <- mergeMessage{tp: a, offset: 0, timestamp: time.Unix(10, 0), output: "a0"}
+	m.in <- mergeMessage{tp: a, offset: 1, timestamp: time.Unix(11, 0), output: "a1"}
+	syncMerge(m)
+	require.Equal(t, []interface{}{"a0"}, drain(printed))
+}
+
+// syncMerge returns once m printed what's due for the messages sent before.
+func syncMerge(m *consumeMerge) {
+	m.control <- mergeControl{}
+}
+
+// markingPOM records the offsets marked as consumed.
+type markingPOM struct {
+	sarama.PartitionOffsetManager
+	marked []int64
+}
+
+func (pom *markingPOM) MarkOffset(offset int64, metadata string) {
+	pom.marked = append(pom.marked, offset)
+}
+
+func TestConsumeMergeMarksPrinted(t *testing.T) {
+	m, printed := collectMerged(0)
+	a, b := topicPartition{"orders", 0}, topicPartition{"orders", 1}
+	pom := &markingPOM{}
+
+	m.start(a)
+	m.start(b)
+	m.in <- mergeMessage{tp: a, offset: 0, timestamp: time.Unix(10, 0), output: "a0", pom: pom}
+	m.in <- mergeMessage{tp: a, offset: 1, timestamp: time.Unix(11, 0), output: "a1", pom: pom}
+
+	// buffered messages aren't marked before they're printed.
+	syncMerge(m)
+	require.Empty(t, drain(printed))
+	require.Empty(t, pom.marked)
+
+	m.flush()
+	require.Equal(t, []interface{}{"a0", "a1"}, drain(printed))
+	require.Equal(t, []int64{1, 2}, pom.marked)
+}
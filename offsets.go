@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetRequestConcurrency limits the number of brokers fetchOffsets sends
+// requests to at the same time.
+const offsetRequestConcurrency = 8
+
+// partitionErrors is returned along with partial results and holds the error
+// per topic and partition that could not be read.
+type partitionErrors map[string]map[int32]error
+
+func (pe partitionErrors) add(topic string, partition int32, err error) {
+	if pe[topic] == nil {
+		pe[topic] = map[int32]error{}
+	}
+	pe[topic][partition] = err
+}
+
+func (pe partitionErrors) Error() string {
+	var (
+		count  int
+		topics = make([]string, 0, len(pe))
+	)
+	for t, ps := range pe {
+		topics = append(topics, t)
+		count += len(ps)
+	}
+	sort.Strings(topics)
+
+	first := topics[0]
+	partitions := make([]int32, 0, len(pe[first]))
+	for p := range pe[first] {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+
+	return fmt.Sprintf("failed for %d partitions, first topic=%s partition=%d err=%v", count, first, partitions[0], pe[first][partitions[0]])
+}
+
+// brokerErrors is returned along with partial results and holds the error
+// per broker address that could not be queried.
+type brokerErrors map[string]error
+
+func (be brokerErrors) Error() string {
+	addrs := make([]string, 0, len(be))
+	for a := range be {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+
+	return fmt.Sprintf("failed for %d brokers, first broker=%s err=%v", len(addrs), addrs[0], be[addrs[0]])
+}
+
+// fetchOffsets looks up the offsets at the given time (sarama.OffsetOldest or
+// sarama.OffsetNewest) for all given partitions. Partitions are grouped by
+// their leader so that only one request is sent per broker. When some
+// partitions fail, the offsets that could be fetched are returned along with a
+// partitionErrors.
+func fetchOffsets(client sarama.Client, partitions map[string][]int32, time int64) (map[string]map[int32]int64, error) {
+	version := int16(0)
+	if client.Config().Version.IsAtLeast(sarama.V0_10_1_0) {
+		version = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     = partitionErrors{}
+		result   = map[string]map[int32]int64{}
+		requests = map[*sarama.Broker]*sarama.OffsetRequest{}
+		members  = map[*sarama.Broker]map[string][]int32{}
+		sem      = make(chan struct{}, offsetRequestConcurrency)
+	)
+
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			leader, err := client.Leader(topic, p)
+			if err != nil {
+				errs.add(topic, p, fmt.Errorf("failed to find leader err=%w", err))
+				continue
+			}
+
+			req, ok := requests[leader]
+			if !ok {
+				req = &sarama.OffsetRequest{Version: version}
+				requests[leader] = req
+				members[leader] = map[string][]int32{}
+			}
+			req.AddBlock(topic, p, time, 1)
+			members[leader][topic] = append(members[leader][topic], p)
+		}
+	}
+
+	for broker, req := range requests {
+		wg.Add(1)
+		go func(broker *sarama.Broker, req *sarama.OffsetRequest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			resp, err := broker.GetAvailableOffsets(req)
+			<-sem
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				for topic, ps := range members[broker] {
+					for _, p := range ps {
+						errs.add(topic, p, fmt.Errorf("failed to fetch offsets from broker %v err=%w", broker.Addr(), err))
+					}
+				}
+				return
+			}
+
+			for topic, ps := range members[broker] {
+				for _, p := range ps {
+					block := resp.GetBlock(topic, p)
+					if block == nil {
+						errs.add(topic, p, fmt.Errorf("missing offset in response from broker %v", broker.Addr()))
+						continue
+					}
+					if block.Err != sarama.ErrNoError {
+						errs.add(topic, p, block.Err)
+						continue
+					}
+					if result[topic] == nil {
+						result[topic] = map[int32]int64{}
+					}
+					result[topic][p] = responseOffset(block)
+				}
+			}
+		}(broker, req)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return result, errs
+	}
+	return result, nil
+}
+
+func responseOffset(block *sarama.OffsetResponseBlock) int64 {
+	if len(block.Offsets) > 0 {
+		return block.Offsets[0]
+	}
+	return block.Offset
+}
+
+// fetchGroupOffsets fetches the offsets committed by group for the given
+// partitions with a single request to the group's coordinator. Partitions
+// without a committed offset are omitted from the result. When the request
+// fails, no offsets are returned; when only some partitions fail, the
+// remaining offsets are returned along with a partitionErrors.
+func fetchGroupOffsets(client sarama.Client, group string, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find coordinator for group=%s err=%w", group, err)
+	}
+
+	req := &sarama.OffsetFetchRequest{ConsumerGroup: group, Version: 1}
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			req.AddPartition(topic, p)
+		}
+	}
+
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offsets for group=%s err=%w", group, err)
+	}
+
+	var (
+		errs   = partitionErrors{}
+		result = map[string]map[int32]int64{}
+	)
+	for topic, blocks := range resp.Blocks {
+		for p, block := range blocks {
+			if block.Err != sarama.ErrNoError {
+				errs.add(topic, p, block.Err)
+				continue
+			}
+			if block.Offset < 0 {
+				continue
+			}
+			if result[topic] == nil {
+				result[topic] = map[int32]int64{}
+			}
+			result[topic][p] = block.Offset
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, errs
+	}
+	return result, nil
+}
+
+// listGroups returns the sorted names of all consumer groups known to the
+// client's brokers. When some brokers fail, the groups of the remaining brokers
+// are returned along with a brokerErrors.
+func listGroups(client sarama.Client) ([]string, error) {
+	var (
+		errs   = brokerErrors{}
+		groups = []string{}
+	)
+
+	for _, broker := range client.Brokers() {
+		if ok, _ := broker.Connected(); !ok {
+			if err := broker.Open(client.Config()); err != nil && err != sarama.ErrAlreadyConnected {
+				errs[broker.Addr()] = fmt.Errorf("failed to connect err=%w", err)
+				continue
+			}
+		}
+
+		resp, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err != nil {
+			errs[broker.Addr()] = fmt.Errorf("failed to list groups err=%w", err)
+			continue
+		}
+		if resp.Err != sarama.ErrNoError {
+			errs[broker.Addr()] = fmt.Errorf("failed to list groups err=%w", resp.Err)
+			continue
+		}
+
+		for name := range resp.Groups {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	if len(errs) > 0 {
+		return groups, errs
+	}
+	return groups, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func newOffsetsMockBroker(t *testing.T, committed int64) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetNewest, 50),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "specials", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("specials", "orders", 0, committed, "", sarama.ErrNoError).
+			SetOffset("specials", "orders", 1, -1, "", sarama.ErrNoError),
+	})
+	return broker
+}
+
+func TestFetchOffsets(t *testing.T) {
+	broker := newOffsetsMockBroker(t, 90)
+	defer broker.Close()
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	partitions := map[string][]int32{"orders": {0, 1}}
+
+	newest, err := fetchOffsets(client, partitions, sarama.OffsetNewest)
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[int32]int64{"orders": {0: 100, 1: 50}}, newest)
+
+	committed, err := fetchGroupOffsets(client, "specials", partitions)
+	require.NoError(t, err)
+	require.Equal(t, map[string]map[int32]int64{"orders": {0: 90}}, committed)
+}
+
+func TestGroupPrintLag(t *testing.T) {
+	broker := newOffsetsMockBroker(t, 90)
+	defer broker.Close()
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	var (
+		target     = &groupCmd{client: client}
+		partitions = map[string][]int32{"orders": {0, 1}}
+		samples    = map[groupTopic]groupLagSample{}
+		out        = make(chan printContext)
+		lags       = make(chan groupLag, 2)
+	)
+	go func() {
+		for ctx := range out {
+			lags <- ctx.output.(groupLag)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.printLag(out, []string{"specials"}, partitions, samples)
+	first := <-lags
+	require.Equal(t, "specials", first.Name)
+	require.Equal(t, "orders", first.Topic)
+	require.Equal(t, int64(10), first.Lag)
+	require.Len(t, first.Offsets, 1)
+	require.Nil(t, first.LagDelta)
+	require.Nil(t, first.Rate)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetNewest, 50),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("specials", "orders", 0, 96, "", sarama.ErrNoError),
+	})
+
+	target.printLag(out, []string{"specials"}, partitions, samples)
+	second := <-lags
+	require.Equal(t, int64(4), second.Lag)
+	require.NotNil(t, second.LagDelta)
+	require.Equal(t, int64(-6), *second.LagDelta)
+	require.NotNil(t, second.Rate)
+	require.True(t, *second.Rate > 0)
+}
+
+func TestGroupLagSampleRate(t *testing.T) {
+	prev := groupLagSample{time: time.Unix(100, 0), committed: map[int32]int64{0: 90, 1: 40}}
+
+	// partition 2 appears with its full offset and partition 1 disappears.
+	require.Equal(t, 2.5, prev.rate(map[int32]int64{0: 100, 2: 5000}, time.Unix(104, 0)))
+	require.Equal(t, 0.0, prev.rate(map[int32]int64{2: 5000}, time.Unix(104, 0)))
+}
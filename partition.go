@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type partitionCmd struct {
+	key        string
+	partitions int32
+	decodeKey  string
+	pretty     bool
+}
+
+type partitionArgs struct {
+	key        string
+	partitions int
+	decodeKey  string
+	pretty     bool
+}
+
+// partitionResult maps the names of the key based partitioners to the
+// partition they choose for the key.
+type partitionResult struct {
+	Key        string           `json:"key"`
+	Partitions int32            `json:"partitions"`
+	Schemes    map[string]int32 `json:"schemes"`
+}
+
+func (cmd *partitionCmd) parseFlags(as []string) partitionArgs {
+	var args partitionArgs
+	flags := flag.NewFlagSet("partition", flag.ContinueOnError)
+	flags.StringVar(&args.key, "key", "", "Message key to partition (required).")
+	flags.IntVar(&args.partitions, "partitions", 0, "Number of partitions of the topic (required).")
+	flags.StringVar(&args.decodeKey, "decodekey", "string", "Decode message key as (string|hex|base64), defaults to string.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of partition:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, partitionDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *partitionCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt partition -help\" for more information")
+}
+
+func (cmd *partitionCmd) parseArgs(as []string) {
+	args := cmd.parseFlags(as)
+
+	if args.key == "" {
+		cmd.failStartup("Key is required.")
+		return
+	}
+	cmd.key = args.key
+
+	if args.partitions < 1 {
+		cmd.failStartup("Number of partitions must be at least 1.")
+		return
+	}
+	cmd.partitions = int32(args.partitions)
+
+	if args.decodeKey != "string" && args.decodeKey != "hex" && args.decodeKey != "base64" {
+		cmd.failStartup(fmt.Sprintf(`unsupported decodekey argument %#v, only string, hex and base64 are supported.`, args.decodeKey))
+		return
+	}
+	cmd.decodeKey = args.decodeKey
+	cmd.pretty = args.pretty
+}
+
+func (cmd *partitionCmd) run(as []string) {
+	cmd.parseArgs(as)
+
+	result, err := cmd.partition()
+	if err != nil {
+		failErrorf(&categoryUsage, "failed to decode key err=%v", err)
+	}
+
+	out := make(chan printContext)
+	go print(out, cmd.pretty)
+	ctx := printContext{output: result, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+func (cmd *partitionCmd) partition() (partitionResult, error) {
+	key, err := decodeString(cmd.key, cmd.decodeKey)
+	if err != nil {
+		return partitionResult{}, err
+	}
+
+	result := partitionResult{Key: cmd.key, Partitions: cmd.partitions, Schemes: map[string]int32{}}
+	for _, name := range []string{"hashCode", "murmur2", "consistent"} {
+		p, _ := newPartitioner(name, 1)
+		result.Schemes[name] = p.partition(key, cmd.partitions)
+	}
+	return result, nil
+}
+
+var partitionDocString = `
+Prints the partition a message key is assigned to by each of the key based
+partitioners supported by kt produce -partitioner:
+
+  hashCode    Kafka's legacy Scala producer.
+  murmur2     Kafka's DefaultPartitioner of the Java client.
+  consistent  librdkafka's consistent partitioner, consistent_random and its
+              alias crc32 pick the same partition for non-empty keys.
+
+The random and sticky partitioners don't take the key into account.
+
+Example:
+
+  $ kt partition -key id-23 -partitions 12
+  {
+    "key": "id-23",
+    "partitions": 12,
+    "schemes": {
+      "consistent": 9,
+      "hashCode": 3,
+      "murmur2": 2
+    }
+  }
+`
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"time"
+)
+
+// partitioner picks the partition for a message given its key, which is nil
+// for keyless messages.
+type partitioner interface {
+	partition(key []byte, partitions int32) int32
+}
+
+var partitionerNames = []string{"hashCode", "murmur2", "consistent", "consistent_random", "crc32", "random", "sticky"}
+
+// newPartitioner returns the partitioner of the given name. Sticky
+// partitioning moves on to the next partition after stickiness messages.
+func newPartitioner(name string, stickiness int) (partitioner, error) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	switch name {
+	case "hashCode":
+		return hashCodePartitioner{}, nil
+	case "murmur2":
+		return murmur2Partitioner{keyless: newStickyPartitioner(rnd, stickiness)}, nil
+	case "consistent":
+		return consistentPartitioner{}, nil
+	case "consistent_random", "crc32":
+		return consistentPartitioner{keyless: &randomPartitioner{rnd}}, nil
+	case "random":
+		return &randomPartitioner{rnd}, nil
+	case "sticky":
+		return newStickyPartitioner(rnd, stickiness), nil
+	}
+	return nil, fmt.Errorf("unsupported partitioner %#v, use one of %v", name, partitionerNames)
+}
+
+// hashCodePartitioner mirrors the partitioner of Kafka's legacy Scala
+// producer. Keyless messages go to partition 0.
+type hashCodePartitioner struct{}
+
+func (hashCodePartitioner) partition(key []byte, partitions int32) int32 {
+	if key == nil {
+		return 0
+	}
+	return hashCodePartition(string(key), partitions)
+}
+
+// murmur2Partitioner mirrors Kafka's DefaultPartitioner of the Java client:
+// keys are hashed with murmur2, keyless messages are partitioned stickily.
+type murmur2Partitioner struct {
+	keyless partitioner
+}
+
+func (p murmur2Partitioner) partition(key []byte, partitions int32) int32 {
+	if key == nil {
+		return p.keyless.partition(key, partitions)
+	}
+	return int32(murmur2(key)&0x7fffffff) % partitions
+}
+
+// murmur2 is the 32 bit murmur2 hash as implemented by Kafka's
+// org.apache.kafka.common.utils.Utils#murmur2.
+func murmur2(data []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// consistentPartitioner mirrors librdkafka's consistent partitioner, which
+// hashes keys with CRC32 so that keyless messages go to the partition of the
+// empty key. With keyless set it mirrors consistent_random instead, which
+// partitions messages with a missing or empty key with keyless.
+type consistentPartitioner struct {
+	keyless partitioner
+}
+
+func (p consistentPartitioner) partition(key []byte, partitions int32) int32 {
+	if len(key) == 0 && p.keyless != nil {
+		return p.keyless.partition(key, partitions)
+	}
+	return int32(crc32.ChecksumIEEE(key) % uint32(partitions))
+}
+
+type randomPartitioner struct {
+	rnd *rand.Rand
+}
+
+func (p *randomPartitioner) partition(key []byte, partitions int32) int32 {
+	return p.rnd.Int31n(partitions)
+}
+
+// stickyPartitioner ignores keys and sends stickiness messages in a row to the
+// same partition before moving on to the next one, so that batches fill up
+// while the load is spread evenly across partitions.
+type stickyPartitioner struct {
+	stickiness int
+	current    int32
+	count      int
+}
+
+func newStickyPartitioner(rnd *rand.Rand, stickiness int) *stickyPartitioner {
+	if stickiness < 1 {
+		stickiness = 1
+	}
+	return &stickyPartitioner{stickiness: stickiness, current: rnd.Int31()}
+}
+
+func (p *stickyPartitioner) partition(key []byte, partitions int32) int32 {
+	if p.count == p.stickiness {
+		p.count = 0
+		p.current++
+	}
+	p.count++
+	if p.current < 0 {
+		p.current = 0
+	}
+	return p.current % partitions
+}
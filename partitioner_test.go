@@ -0,0 +1,98 @@
+package main
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMurmur2(t *testing.T) {
+	// cf. Kafka's UtilsTest#testMurmur2
+	data := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+
+	for in, expected := range data {
+		require.Equal(t, expected, int32(murmur2([]byte(in))), in)
+	}
+}
+
+func TestPartitioners(t *testing.T) {
+	murmur, err := newPartitioner("murmur2", 1)
+	require.NoError(t, err)
+	require.Equal(t, (int32(-790332482)&0x7fffffff)%12, murmur.partition([]byte("foobar"), 12))
+
+	for _, name := range []string{"consistent", "consistent_random", "crc32"} {
+		crc, err := newPartitioner(name, 1)
+		require.NoError(t, err)
+		require.Equal(t, int32(crc32.ChecksumIEEE([]byte("foobar"))%12), crc.partition([]byte("foobar"), 12), name)
+	}
+
+	// consistent hashes missing and empty keys like the empty key, whose CRC32
+	// is 0, while consistent_random picks a random partition for them.
+	consistent, _ := newPartitioner("consistent", 1)
+	require.Equal(t, int32(0), consistent.partition(nil, 12))
+	require.Equal(t, int32(0), consistent.partition([]byte{}, 12))
+	consistentRandom := consistentPartitioner{keyless: tPartitioner(5)}
+	require.Equal(t, int32(5), consistentRandom.partition(nil, 12))
+	require.Equal(t, int32(5), consistentRandom.partition([]byte{}, 12))
+
+	// crc32 is kept as an alias of consistent_random.
+	alias, _ := newPartitioner("crc32", 1)
+	require.IsType(t, &randomPartitioner{}, alias.(consistentPartitioner).keyless)
+
+	hc, err := newPartitioner("hashCode", 1)
+	require.NoError(t, err)
+	require.Equal(t, hashCodePartition("foobar", 12), hc.partition([]byte("foobar"), 12))
+	require.Equal(t, int32(0), hc.partition(nil, 12))
+
+	random, err := newPartitioner("random", 1)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		p := random.partition([]byte("foobar"), 3)
+		require.True(t, p >= 0 && p < 3)
+	}
+
+	_, err = newPartitioner("roundRobin", 1)
+	require.Error(t, err)
+}
+
+func TestStickyPartitioner(t *testing.T) {
+	sticky := newStickyPartitioner(rand.New(rand.NewSource(1)), 2)
+	sticky.current = 2
+
+	actual := []int32{}
+	for i := 0; i < 7; i++ {
+		actual = append(actual, sticky.partition([]byte("ignored"), 3))
+	}
+	require.Equal(t, []int32{2, 2, 0, 0, 1, 1, 2}, actual)
+}
+
+func TestPartitionCmd(t *testing.T) {
+	target := &partitionCmd{key: "666f6f626172", partitions: 12, decodeKey: "hex"}
+	actual, err := target.partition()
+	require.NoError(t, err)
+	require.Equal(t, partitionResult{
+		Key:        "666f6f626172",
+		Partitions: 12,
+		Schemes: map[string]int32{
+			"hashCode":   hashCodePartition("foobar", 12),
+			"murmur2":    (int32(-790332482) & 0x7fffffff) % 12,
+			"consistent": int32(crc32.ChecksumIEEE([]byte("foobar")) % 12),
+		},
+	}, actual)
+}
+
+// tPartitioner always picks the same partition.
+type tPartitioner int32
+
+func (p tPartitioner) partition(key []byte, partitions int32) int32 {
+	return int32(p)
+}
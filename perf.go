@@ -0,0 +1,646 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type perfCmd struct {
+	mode        string
+	topic       string
+	brokers     []string
+	tlsCA       string
+	tlsCert     string
+	tlsCertKey  string
+	version     sarama.KafkaVersion
+	size        int
+	keys        int
+	compression sarama.CompressionCodec
+	rate        int
+	batch       int
+	count       int64
+	duration    time.Duration
+	interval    time.Duration
+	offsets     map[int32]interval
+	verbose     bool
+	pretty      bool
+
+	mu       sync.Mutex
+	total    perfStats
+	current  perfStats
+	started  time.Time
+	reported time.Time
+}
+
+type perfArgs struct {
+	topic       string
+	brokers     string
+	tlsCA       string
+	tlsCert     string
+	tlsCertKey  string
+	version     string
+	size        int
+	keys        int
+	compression string
+	rate        int
+	batch       int
+	count       int64
+	duration    time.Duration
+	interval    time.Duration
+	offsets     string
+	verbose     bool
+	pretty      bool
+}
+
+// perfStats accumulates the counters and latencies for one reporting period.
+type perfStats struct {
+	messages  int64
+	bytes     int64
+	errors    int64
+	latencies latencyHistogram
+}
+
+type perfReport struct {
+	Mode           string             `json:"mode"`
+	Elapsed        string             `json:"elapsed"`
+	Messages       int64              `json:"messages"`
+	Bytes          int64              `json:"bytes"`
+	Errors         int64              `json:"errors"`
+	MessagesPerSec float64            `json:"messagesPerSec"`
+	MBPerSec       float64            `json:"mbPerSec"`
+	LatencyMs      map[string]float64 `json:"latencyMs,omitempty"`
+	Done           bool               `json:"done"`
+}
+
+// latencyHistogram records durations in logarithmic buckets that are 1% wide,
+// which keeps percentiles accurate to about 1% with constant memory.
+type latencyHistogram struct {
+	buckets map[int]int64
+	count   int64
+}
+
+const latencyBucketBase = 1.01
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if h.buckets == nil {
+		h.buckets = map[int]int64{}
+	}
+
+	us := float64(d / time.Microsecond)
+	if us < 1 {
+		us = 1
+	}
+	h.buckets[int(math.Log(us)/math.Log(latencyBucketBase))]++
+	h.count++
+}
+
+// percentile returns the approximate duration below which the given fraction
+// of recorded durations fall.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	idxs := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		idxs = append(idxs, i)
+	}
+	sort.Ints(idxs)
+
+	var (
+		seen   int64
+		target = int64(math.Ceil(q * float64(h.count)))
+	)
+	for _, i := range idxs {
+		seen += h.buckets[i]
+		if seen >= target {
+			return time.Duration(math.Pow(latencyBucketBase, float64(i+1))) * time.Microsecond
+		}
+	}
+	return 0
+}
+
+func (cmd *perfCmd) parseFlags(mode string, as []string) perfArgs {
+	var args perfArgs
+	flags := flag.NewFlagSet("perf "+mode, flag.ContinueOnError)
+	flags.StringVar(&args.topic, "topic", "", "Topic to use (required).")
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+	flags.Int64Var(&args.count, "count", 0, "Number of messages after which to stop (default 0 for no limit).")
+	flags.DurationVar(&args.duration, "duration", 0, "Duration after which to stop (default 0 for no limit).")
+	flags.DurationVar(&args.interval, "interval", 5*time.Second, "Interval for printing reports.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
+
+	switch mode {
+	case "produce":
+		flags.IntVar(&args.size, "size", 100, "Size of generated message values in bytes.")
+		flags.IntVar(&args.keys, "keys", 0, "Number of distinct keys to generate (default 0 for messages without keys).")
+		flags.StringVar(&args.compression, "compression", "", "Kafka message compression codec [gzip|snappy|lz4] (defaults to none)")
+		flags.IntVar(&args.rate, "rate", 0, "Target number of messages per second (default 0 for as fast as possible).")
+		flags.IntVar(&args.batch, "batch", 100, "Max size of a batch before sending it off")
+	case "consume":
+		flags.StringVar(&args.offsets, "offsets", "", "Specifies what messages to read by partition and offset range (defaults to all).")
+	}
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of perf %v:\n", mode)
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, perfDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *perfCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt perf -help\" for more information")
+}
+
+func (cmd *perfCmd) parseArgs(as []string) {
+	if len(as) == 0 {
+		cmd.failStartup("perf requires a mode: produce or consume.")
+		return
+	}
+
+	switch as[0] {
+	case "produce", "consume":
+		cmd.mode = as[0]
+	case "-h", "-help", "--help":
+		quitf("Usage of perf:\n\n  kt perf (produce|consume) [arguments]\n%v", perfDocString)
+	default:
+		cmd.failStartup(fmt.Sprintf("unsupported perf mode %#v, only produce and consume are supported.", as[0]))
+		return
+	}
+
+	args := cmd.parseFlags(cmd.mode, as[1:])
+
+	envTopic := os.Getenv("KT_TOPIC")
+	if args.topic == "" {
+		if envTopic == "" {
+			cmd.failStartup("Topic name is required.")
+			return
+		}
+		args.topic = envTopic
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	if args.interval <= 0 {
+		cmd.failStartup(fmt.Sprintf("report interval must be positive, got %v", args.interval))
+		return
+	}
+
+	if cmd.mode == "produce" {
+		if args.size < 0 {
+			cmd.failStartup(fmt.Sprintf("message size must not be negative, got %v", args.size))
+			return
+		}
+		if args.batch < 1 {
+			cmd.failStartup(fmt.Sprintf("batch size must be positive, got %v", args.batch))
+			return
+		}
+	}
+
+	var err error
+	if cmd.offsets, err = parseOffsets(args.offsets); err != nil {
+		cmd.failStartup(fmt.Sprintf("%s", err))
+		return
+	}
+
+	cmd.topic = args.topic
+	cmd.brokers = parseBrokers(args.brokers)
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.version = kafkaVersion(args.version)
+	cmd.size = args.size
+	cmd.keys = args.keys
+	cmd.compression = kafkaCompression(args.compression)
+	cmd.rate = args.rate
+	cmd.batch = args.batch
+	cmd.count = args.count
+	cmd.duration = args.duration
+	cmd.interval = args.interval
+	cmd.verbose = args.verbose
+	cmd.pretty = args.pretty
+}
+
+func (cmd *perfCmd) run(as []string) {
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	var (
+		q    = make(chan struct{})
+		stop = make(chan struct{})
+		done = make(chan struct{})
+		out  = make(chan printContext)
+	)
+
+	go print(out, cmd.pretty)
+	go listenForInterrupt(q)
+	go func() {
+		var timeout <-chan time.Time
+		if cmd.duration > 0 {
+			timeout = time.After(cmd.duration)
+		}
+		select {
+		case <-q:
+		case <-timeout:
+		case <-done:
+		}
+		close(stop)
+	}()
+
+	cmd.started = time.Now()
+	cmd.reported = cmd.started
+	go func() {
+		switch cmd.mode {
+		case "produce":
+			cmd.produce(stop)
+		case "consume":
+			cmd.consume(stop)
+		}
+		close(done)
+	}()
+
+	ticker := time.NewTicker(cmd.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cmd.report(out, false)
+		case <-done:
+			cmd.report(out, true)
+			return
+		}
+	}
+}
+
+func (cmd *perfCmd) record(messages, bytes, errors int64, latencies ...time.Duration) {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+
+	for _, s := range []*perfStats{&cmd.current, &cmd.total} {
+		s.messages += messages
+		s.bytes += bytes
+		s.errors += errors
+		for _, l := range latencies {
+			s.latencies.record(l)
+		}
+	}
+}
+
+// report prints the stats since the last report, or the stats for the whole
+// run once done.
+func (cmd *perfCmd) report(out chan printContext, done bool) {
+	cmd.mu.Lock()
+	var (
+		now   = time.Now()
+		stats = cmd.current
+		since = cmd.reported
+	)
+	if done {
+		stats, since = cmd.total, cmd.started
+	}
+	cmd.current = perfStats{}
+	cmd.reported = now
+	cmd.mu.Unlock()
+
+	r := perfReport{
+		Mode:     cmd.mode,
+		Elapsed:  now.Sub(cmd.started).Round(time.Millisecond).String(),
+		Messages: stats.messages,
+		Bytes:    stats.bytes,
+		Errors:   stats.errors,
+		Done:     done,
+	}
+
+	if secs := now.Sub(since).Seconds(); secs > 0 {
+		r.MessagesPerSec = float64(stats.messages) / secs
+		r.MBPerSec = float64(stats.bytes) / secs / (1024 * 1024)
+	}
+
+	if stats.latencies.count > 0 {
+		ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		r.LatencyMs = map[string]float64{
+			"p50":  ms(stats.latencies.percentile(0.5)),
+			"p99":  ms(stats.latencies.percentile(0.99)),
+			"p999": ms(stats.latencies.percentile(0.999)),
+		}
+	}
+
+	ctx := printContext{output: r, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
+}
+
+func (cmd *perfCmd) produceCmd() *produceCmd {
+	return &produceCmd{
+		topic:         cmd.topic,
+		brokers:       cmd.brokers,
+		tlsCA:         cmd.tlsCA,
+		tlsCert:       cmd.tlsCert,
+		tlsCertKey:    cmd.tlsCertKey,
+		batch:         cmd.batch,
+		timeout:       50 * time.Millisecond,
+		verbose:       cmd.verbose,
+		version:       cmd.version,
+		compression:   cmd.compression,
+		partitioner:   "hashCode",
+		decodeKey:     "string",
+		decodeValue:   "string",
+		recordBatches: true,
+	}
+}
+
+// produce sends generated messages through the produce command's batching
+// and request building until stop is closed or the message count is reached.
+func (cmd *perfCmd) produce(stop chan struct{}) {
+	pc := cmd.produceCmd()
+	pc.findLeaders()
+	defer pc.close()
+
+	var (
+		messages = make(chan message)
+		batches  = make(chan []message)
+		results  = make(chan printContext)
+	)
+
+	go func() {
+		for ctx := range results {
+			close(ctx.done)
+		}
+	}()
+	defer close(results)
+
+	go cmd.generate(stop, pc.partitionCount(cmd.topic), messages)
+	go pc.batchRecords(messages, batches)
+
+	for b := range batches {
+		if len(b) == 0 {
+			continue
+		}
+
+		failed := pc.produceBatch(pc.currentLeaders(), b, results)
+		if len(failed) > 0 && cmd.verbose {
+			warnf("failed to produce batch messages=%v err=%v", len(failed), failed[0].err)
+		}
+		cmd.recordBatch(b, failed, time.Now())
+	}
+}
+
+// recordBatch records the messages of batch acknowledged at acked, and the
+// failed ones as errors. Messages are told apart by their line.
+func (cmd *perfCmd) recordBatch(batch []message, failed []produceFailure, acked time.Time) {
+	lost := map[int64]bool{}
+	for _, f := range failed {
+		lost[f.pm.msg.line] = true
+	}
+
+	var (
+		size      int64
+		latencies []time.Duration
+	)
+	for _, m := range batch {
+		if lost[m.line] {
+			continue
+		}
+		if m.Value != nil {
+			size += int64(len(*m.Value))
+		}
+		if m.Key != nil {
+			size += int64(len(*m.Key))
+		}
+		latencies = append(latencies, acked.Sub(*m.Timestamp))
+	}
+	cmd.record(int64(len(latencies)), size, int64(len(lost)), latencies...)
+}
+
+// generate creates messages with values of the configured size and keys of
+// the configured cardinality. Messages are timestamped with their creation
+// time, which is what latencies are measured against.
+func (cmd *perfCmd) generate(stop chan struct{}, partitions int32, out chan message) {
+	defer close(out)
+
+	var (
+		rnd     = rand.New(rand.NewSource(time.Now().UnixNano()))
+		limiter = newRateLimiter(cmd.rate)
+		payload = make([]byte, cmd.size+1024*1024)
+		charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	)
+
+	for i := range payload {
+		payload[i] = charset[rnd.Intn(len(charset))]
+	}
+
+	for i := int64(0); cmd.count == 0 || i < cmd.count; i++ {
+		limiter.wait()
+
+		var (
+			now   = time.Now()
+			start = rnd.Intn(len(payload) - cmd.size)
+			value = string(payload[start : start+cmd.size])
+			part  = int32(i % int64(partitions))
+			key   *string
+		)
+
+		if cmd.keys > 0 {
+			k := fmt.Sprintf("key-%d", rnd.Intn(cmd.keys))
+			part = hashCodePartition(k, partitions)
+			key = &k
+		}
+
+		msg := message{Key: key, Value: &value, Partition: &part, Timestamp: &now, line: i + 1}
+
+		select {
+		case out <- msg:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (cmd *perfCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-perf-" + sanitizeUsername(usr.Username)
+	cfg.Consumer.Return.Errors = true
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+// consume reads from all selected partitions until stop is closed or the
+// message count is reached. End-to-end latency is measured against the
+// messages' timestamps, so it's meaningful for messages written by "kt perf
+// produce" or other producers that set the creation time.
+func (cmd *perfCmd) consume(stop chan struct{}) {
+	client, err := sarama.NewClient(cmd.brokers, cmd.saramaConfig())
+	if err != nil {
+		failf("failed to create client err=%v", err)
+	}
+	defer logClose("client", client)
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		failf("failed to create consumer err=%v", err)
+	}
+	defer logClose("consumer", consumer)
+
+	all, err := consumer.Partitions(cmd.topic)
+	if err != nil {
+		failf("failed to read partitions for topic %v err=%v", cmd.topic, err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		consumed int64
+		limit    = make(chan struct{})
+		once     sync.Once
+	)
+
+	for _, p := range all {
+		iv, ok := cmd.offsets[p]
+		if !ok {
+			if iv, ok = cmd.offsets[-1]; !ok {
+				continue
+			}
+		}
+
+		start, err := resolveOffset(client, cmd.topic, p, iv.start)
+		if err != nil {
+			failf("failed to resolve start offset for partition %v err=%v", p, err)
+		}
+
+		pc, err := consumer.ConsumePartition(cmd.topic, p, start)
+		if err != nil {
+			failf("failed to consume partition %v err=%v", p, err)
+		}
+
+		wg.Add(1)
+		go func(p int32, pc sarama.PartitionConsumer) {
+			defer wg.Done()
+			defer logClose("partition consumer", pc)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-limit:
+					return
+				case err, ok := <-pc.Errors():
+					if !ok {
+						warnf("stopped consuming partition %v err=%v", p, errPartitionConsumerClosed)
+						return
+					}
+					if cmd.verbose {
+						fmt.Fprintf(os.Stderr, "partition consumer err=%v\n", err)
+					}
+					cmd.record(0, 0, 1)
+				case msg, ok := <-pc.Messages():
+					if !ok {
+						// sarama stops a partition consumer after its offset
+						// went out of range, reported as error before.
+						warnf("stopped consuming partition %v err=%v", p, errPartitionConsumerClosed)
+						return
+					}
+					var latencies []time.Duration
+					if !msg.Timestamp.IsZero() {
+						latencies = append(latencies, time.Since(msg.Timestamp))
+					}
+					cmd.record(1, int64(len(msg.Key)+len(msg.Value)), 0, latencies...)
+
+					if cmd.count > 0 {
+						mu.Lock()
+						consumed++
+						if consumed >= cmd.count {
+							once.Do(func() { close(limit) })
+						}
+						mu.Unlock()
+					}
+				}
+			}
+		}(p, pc)
+	}
+
+	wg.Wait()
+}
+
+var perfDocString = `
+The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
+The values supplied on the command line win over environment variable values.
+
+"kt perf produce" sends generated messages through the same batching and
+request building as "kt produce", either at the target -rate or as fast as
+possible. Acknowledgement latency is measured from the creation of a message
+until the broker acknowledged the batch containing it. With -version 0.11.0.0
+or later the messages are written as record batches.
+
+"kt perf consume" reads messages and measures fetch throughput and end-to-end
+latency, i.e. the time between a message's timestamp and when it was read.
+The -offsets flag uses the same syntax as "kt consume".
+
+Both modes print a JSON report every -interval with the throughput, errors and
+p50, p99 and p999 latencies for that interval, and a final report for the
+whole run once -count messages were processed, -duration passed or kt was
+interrupted.
+
+Examples:
+
+Send one million 1KB messages with 1000 distinct keys, compressed with lz4:
+
+  kt perf produce -topic perf -count 1000000 -size 1024 -keys 1000 -compression lz4
+
+Measure end-to-end latency while producing 5000 messages per second:
+
+  kt perf consume -topic perf -offsets newest: &
+  kt perf produce -topic perf -rate 5000 -duration 1m
+`
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	require.Equal(t, time.Duration(0), h.percentile(0.5))
+
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	within := func(expected, actual time.Duration) {
+		diff := float64(actual-expected) / float64(expected)
+		require.True(t, diff > -0.02 && diff < 0.02, "expected %v, got %v", expected, actual)
+	}
+	within(500*time.Millisecond, h.percentile(0.5))
+	within(990*time.Millisecond, h.percentile(0.99))
+	within(999*time.Millisecond, h.percentile(0.999))
+}
+
+func TestPerfParseArgs(t *testing.T) {
+	os.Setenv("KT_TOPIC", "")
+	os.Setenv("KT_BROKERS", "")
+
+	target := &perfCmd{}
+	target.parseArgs([]string{"produce", "-topic", "perf", "-size", "512", "-keys", "10", "-compression", "gzip"})
+	require.Equal(t, "produce", target.mode)
+	require.Equal(t, "perf", target.topic)
+	require.Equal(t, []string{"localhost:9092"}, target.brokers)
+	require.Equal(t, 512, target.size)
+	require.Equal(t, 10, target.keys)
+	require.Equal(t, kafkaCompression("gzip"), target.compression)
+
+	target = &perfCmd{}
+	target.parseArgs([]string{"consume", "-topic", "perf", "-offsets", "newest"})
+	require.Equal(t, "consume", target.mode)
+	require.Contains(t, target.offsets, int32(-1))
+}
+
+func TestPerfGenerate(t *testing.T) {
+	target := &perfCmd{size: 16, keys: 3, count: 50}
+	out := make(chan message)
+	go target.generate(make(chan struct{}), 4, out)
+
+	keys := map[string]bool{}
+	count := 0
+	for m := range out {
+		count++
+		require.Len(t, *m.Value, 16)
+		require.NotNil(t, m.Timestamp)
+		require.Equal(t, hashCodePartition(*m.Key, 4), *m.Partition)
+		keys[*m.Key] = true
+	}
+	require.Equal(t, 50, count)
+	require.True(t, len(keys) <= 3)
+}
+
+func TestPerfRecordBatch(t *testing.T) {
+	created := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	batch := []message{}
+	for i := int64(1); i <= 3; i++ {
+		m := newMessage("k", "value", 0)
+		m.Timestamp, m.line = &created, i
+		batch = append(batch, m)
+	}
+
+	// the message acked by another broker still counts.
+	target := &perfCmd{}
+	target.recordBatch(batch, []produceFailure{{pendingMessage{msg: batch[1]}, sarama.ErrNotLeaderForPartition}}, created.Add(time.Second))
+	require.Equal(t, int64(2), target.total.messages)
+	require.Equal(t, int64(12), target.total.bytes)
+	require.Equal(t, int64(1), target.total.errors)
+	require.Equal(t, int64(2), target.total.latencies.count)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/Shopify/sarama"
+)
+
+// pipelineResult is sent by a request's goroutine once the request, including
+// its retries, is done.
+type pipelineResult struct {
+	addr       string
+	conn       *sarama.Broker
+	partitions []topicPartition
+	broken     bool
+}
+
+// pipeline keeps up to -inflight produce requests per leader broker in
+// flight. Each request uses its own connection as brokers handle the
+// requests of a connection one after another. A partition is part of at most
+// one request at a time, so messages are written in the order they're read,
+// even when requests are retried.
+type pipeline struct {
+	cmd  *produceCmd
+	out  chan printContext
+	done chan pipelineResult
+
+	queues   map[topicPartition][]message
+	queued   int
+	busy     map[topicPartition]bool
+	inflight map[string]int
+	idle     map[string][]*sarama.Broker
+}
+
+func (cmd *produceCmd) producePipelined(in chan []message, out chan printContext) {
+	p := &pipeline{
+		cmd:      cmd,
+		out:      out,
+		done:     make(chan pipelineResult),
+		queues:   map[topicPartition][]message{},
+		busy:     map[topicPartition]bool{},
+		inflight: map[string]int{},
+		idle:     map[string][]*sarama.Broker{},
+	}
+	defer p.close()
+	p.run(in)
+}
+
+func (p *pipeline) run(in chan []message) {
+	running := 0
+	for in != nil || p.queued > 0 || running > 0 {
+		running += p.schedule()
+
+		// stop reading input while enough messages are queued to keep all
+		// requests in flight busy.
+		input := in
+		if p.queued >= p.capacity() {
+			input = nil
+		}
+
+		select {
+		case batch, ok := <-input:
+			if !ok {
+				in = nil
+				continue
+			}
+			for _, msg := range batch {
+				tp := topicPartition{p.cmd.topicOf(msg), *msg.Partition}
+				p.queues[tp] = append(p.queues[tp], msg)
+			}
+			p.queued += len(batch)
+		case r := <-p.done:
+			running--
+			p.release(r)
+		}
+	}
+}
+
+func (p *pipeline) capacity() int {
+	addrs := map[string]bool{}
+	for _, partitions := range p.cmd.currentLeaders() {
+		for _, b := range partitions {
+			addrs[b.Addr()] = true
+		}
+	}
+	if len(addrs) == 0 {
+		return p.cmd.batch * p.cmd.inflight
+	}
+	return p.cmd.batch * p.cmd.inflight * len(addrs)
+}
+
+// schedule sends a request to each leader that has queued messages for
+// partitions without a request in flight, until the leader has -inflight
+// requests in flight. Each request takes up to -batch messages per
+// partition. It returns the number of requests it sent.
+func (p *pipeline) schedule() int {
+	leaders := p.cmd.currentLeaders()
+
+	free := []topicPartition{}
+	for tp, msgs := range p.queues {
+		if len(msgs) > 0 && !p.busy[tp] {
+			free = append(free, tp)
+		}
+	}
+	sort.Slice(free, func(i, j int) bool {
+		if free[i].topic != free[j].topic {
+			return free[i].topic < free[j].topic
+		}
+		return free[i].partition < free[j].partition
+	})
+
+	// messages for partitions without a leader are sent without a
+	// connection so that they fail like in produceBatch.
+	byAddr := map[string][]topicPartition{}
+	addrs := []string{}
+	for _, tp := range free {
+		addr := ""
+		if b, err := p.cmd.leader(leaders, tp); err == nil {
+			addr = b.Addr()
+		}
+		if _, ok := byAddr[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		byAddr[addr] = append(byAddr[addr], tp)
+	}
+
+	sent := 0
+	for _, addr := range addrs {
+		partitions := byAddr[addr]
+		for len(partitions) > 0 && p.inflight[addr] < p.cmd.inflight {
+			// spread the partitions across the requests that can be sent
+			n := (len(partitions) + p.cmd.inflight - p.inflight[addr] - 1) / (p.cmd.inflight - p.inflight[addr])
+			p.send(addr, partitions[:n])
+			partitions = partitions[n:]
+			sent++
+		}
+	}
+	return sent
+}
+
+func (p *pipeline) send(addr string, partitions []topicPartition) {
+	batch := []message{}
+	for _, tp := range partitions {
+		msgs := p.queues[tp]
+		n := len(msgs)
+		if n > p.cmd.batch {
+			n = p.cmd.batch
+		}
+		batch = append(batch, msgs[:n]...)
+		p.queues[tp] = msgs[n:]
+		if len(p.queues[tp]) == 0 {
+			delete(p.queues, tp)
+		}
+		p.queued -= n
+		p.busy[tp] = true
+	}
+	p.inflight[addr]++
+
+	conn := p.acquire(addr)
+	go func() {
+		broken := p.cmd.produceWithRetries(batch, p.out, conn)
+		p.done <- pipelineResult{addr: addr, conn: conn, partitions: partitions, broken: broken}
+	}()
+}
+
+// acquire returns an idle connection to addr, or opens a new one. Opening is
+// asynchronous, requests wait for the connection to be established.
+func (p *pipeline) acquire(addr string) *sarama.Broker {
+	if addr == "" {
+		return nil
+	}
+	if conns := p.idle[addr]; len(conns) > 0 {
+		p.idle[addr] = conns[:len(conns)-1]
+		return conns[len(conns)-1]
+	}
+
+	conn := sarama.NewBroker(addr)
+	if err := conn.Open(p.cmd.brokerConfig()); err != nil && err != sarama.ErrAlreadyConnected {
+		warnf("Failed to open broker connection to %v. err=%s", addr, err)
+		return nil
+	}
+	return conn
+}
+
+// release frees the partitions and the connection of a finished request.
+// Connections of requests that failed are closed as they may be broken.
+func (p *pipeline) release(r pipelineResult) {
+	p.inflight[r.addr]--
+	for _, tp := range r.partitions {
+		delete(p.busy, tp)
+	}
+	if r.conn == nil {
+		return
+	}
+	if r.broken {
+		closeBroker(r.conn)
+		return
+	}
+	p.idle[r.addr] = append(p.idle[r.addr], r.conn)
+}
+
+func (p *pipeline) close() {
+	for _, conns := range p.idle {
+		for _, conn := range conns {
+			closeBroker(conn)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func newPipelineBroker(t testing.TB, partitions int32) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for p := int32(0); p < partitions; p++ {
+		metadata.SetLeader("hans", p, broker.BrokerID())
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest":  sarama.NewMockProduceResponse(t),
+	})
+	return broker
+}
+
+func newPipelineCmd(broker *sarama.MockBroker, batch, inflight int) *produceCmd {
+	return &produceCmd{
+		topic:       "hans",
+		version:     sarama.V0_10_0_0,
+		brokers:     []string{broker.Addr()},
+		decodeKey:   "string",
+		decodeValue: "string",
+		batch:       batch,
+		inflight:    inflight,
+	}
+}
+
+func discardOutput() chan printContext {
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	return out
+}
+
+func TestPipelineSchedule(t *testing.T) {
+	broker := newPipelineBroker(t, 4)
+	defer broker.Close()
+
+	target := newPipelineCmd(broker, 2, 2)
+	target.findLeaders()
+	defer target.close()
+
+	out := discardOutput()
+	defer close(out)
+
+	p := &pipeline{
+		cmd:      target,
+		out:      out,
+		done:     make(chan pipelineResult),
+		queues:   map[topicPartition][]message{},
+		busy:     map[topicPartition]bool{},
+		inflight: map[string]int{},
+		idle:     map[string][]*sarama.Broker{},
+	}
+	defer p.close()
+
+	tps := []topicPartition{{"hans", 0}, {"hans", 1}, {"hans", 2}}
+	for i := 0; i < 3; i++ {
+		for _, tp := range tps {
+			p.queues[tp] = append(p.queues[tp], newMessage("", fmt.Sprint(i), tp.partition))
+			p.queued++
+		}
+	}
+
+	require.Equal(t, 2, p.schedule())
+	require.Equal(t, 2, p.inflight[broker.Addr()])
+	require.Equal(t, map[topicPartition]bool{tps[0]: true, tps[1]: true, tps[2]: true}, p.busy)
+	require.Equal(t, 3, p.queued)
+	for _, tp := range tps {
+		require.Len(t, p.queues[tp], 1)
+	}
+
+	// all partitions are busy and the broker has -inflight requests.
+	require.Equal(t, 0, p.schedule())
+
+	partitions := []topicPartition{}
+	for i := 0; i < 2; i++ {
+		r := <-p.done
+		require.False(t, r.broken)
+		partitions = append(partitions, r.partitions...)
+		p.release(r)
+	}
+	require.ElementsMatch(t, tps, partitions)
+	require.Empty(t, p.busy)
+	require.Len(t, p.idle[broker.Addr()], 2)
+
+	require.Equal(t, 2, p.schedule())
+	for i := 0; i < 2; i++ {
+		p.release(<-p.done)
+	}
+	require.Equal(t, 0, p.queued)
+}
+
+func TestProducePipelined(t *testing.T) {
+	broker := newPipelineBroker(t, 3)
+	defer broker.Close()
+
+	target := newPipelineCmd(broker, 2, 3)
+	target.findLeaders()
+	defer target.close()
+
+	out := make(chan printContext)
+	counts := map[int32]int64{}
+	done := make(chan struct{})
+	go func() {
+		for ctx := range out {
+			result := ctx.output.(map[string]interface{})
+			counts[result["partition"].(int32)] += result["count"].(int64)
+			close(ctx.done)
+		}
+		close(done)
+	}()
+
+	in := make(chan []message)
+	go func() {
+		for i := 0; i < 10; i++ {
+			batch := []message{}
+			for partition := int32(0); partition < 3; partition++ {
+				batch = append(batch, newMessage("", fmt.Sprint(i), partition))
+			}
+			in <- batch
+		}
+		close(in)
+	}()
+
+	target.producePipelined(in, out)
+	close(out)
+	<-done
+
+	require.Equal(t, map[int32]int64{0: 10, 1: 10, 2: 10}, counts)
+	require.Equal(t, int64(0), target.failed)
+}
+
+func BenchmarkProduce(b *testing.B) {
+	for _, inflight := range []int{1, 5} {
+		b.Run(fmt.Sprintf("inflight=%v", inflight), func(b *testing.B) {
+			broker := newPipelineBroker(b, 10)
+			defer broker.Close()
+			broker.SetLatency(time.Millisecond)
+
+			target := newPipelineCmd(broker, 10, inflight)
+			target.findLeaders()
+			defer target.close()
+
+			out := discardOutput()
+			defer close(out)
+
+			in := make(chan []message)
+			go func() {
+				batch := []message{}
+				for i := 0; i < b.N; i++ {
+					batch = append(batch, newMessage("", "v", int32(i%10)))
+					if len(batch) == 10 {
+						in <- batch
+						batch = []message{}
+					}
+				}
+				if len(batch) > 0 {
+					in <- batch
+				}
+				close(in)
+			}()
+
+			b.ResetTimer()
+			if inflight > 1 {
+				target.producePipelined(in, out)
+			} else {
+				target.produce(in, out)
+			}
+		})
+	}
+}
@@ -2,49 +2,84 @@ package main
 
 import (
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/user"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 )
 
 type produceArgs struct {
-	topic       string
-	partition   int
-	brokers     string
-	tlsCA       string
-	tlsCert     string
-	tlsCertKey  string
-	batch       int
-	timeout     time.Duration
-	verbose     bool
-	pretty      bool
-	version     string
-	compression string
-	literal     bool
-	decodeKey   string
-	decodeValue string
-	partitioner string
-	bufferSize  int
+	topic        string
+	partition    int
+	brokers      string
+	tlsCA        string
+	tlsCert      string
+	tlsCertKey   string
+	batch        int
+	timeout      time.Duration
+	verbose      bool
+	pretty       bool
+	version      string
+	compression  string
+	literal      bool
+	decodeKey    string
+	decodeValue  string
+	partitioner  string
+	bufferSize   int
+	replay       bool
+	replayFile   string
+	replayNow    bool
+	speed        string
+	reports      bool
+	retries      int
+	retryBackoff time.Duration
+	deadLetter   string
+	inflight     int
+	framing      string
+	files        string
+	csv          csvArgs
 }
 
 type message struct {
-	Key       *string `json:"key"`
-	Value     *string `json:"value"`
-	Partition *int32  `json:"partition"`
+	Topic     string            `json:"topic,omitempty"`
+	Key       *string           `json:"key"`
+	Value     *string           `json:"value"`
+	Partition *int32            `json:"partition"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	// line is the message's line of the input, or its position in the
+	// replayed archive, starting at 1.
+	line int64
+}
+
+// deliveryReport is printed per message with -deliveryreports. Offset is nil
+// when the message wasn't written, Error and KafkaError tell why.
+type deliveryReport struct {
+	Line       int64      `json:"line"`
+	Topic      string     `json:"topic"`
+	Key        *string    `json:"key"`
+	Partition  int32      `json:"partition"`
+	Offset     *int64     `json:"offset"`
+	Timestamp  *time.Time `json:"timestamp,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	KafkaError string     `json:"kafkaError,omitempty"`
 }
 
 func (cmd *produceCmd) read(as []string) produceArgs {
 	var args produceArgs
 	flags := flag.NewFlagSet("produce", flag.ContinueOnError)
-	flags.StringVar(&args.topic, "topic", "", "Topic to produce to (required).")
+	flags.StringVar(&args.topic, "topic", "", "Topic to produce messages to that don't name a topic in their input.")
 	flags.IntVar(&args.partition, "partition", 0, "Partition to produce to (defaults to 0).")
 	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
 	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
@@ -57,10 +92,30 @@ func (cmd *produceCmd) read(as []string) produceArgs {
 	flags.BoolVar(&args.literal, "literal", false, "Interpret stdin line literally and pass it as value, key as null.")
 	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
 	flags.StringVar(&args.compression, "compression", "", "Kafka message compression codec [gzip|snappy|lz4] (defaults to none)")
-	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: hashCode")
+	flags.StringVar(&args.partitioner, "partitioner", "", "Optional partitioner to use. Available: hashCode, murmur2, consistent, consistent_random, crc32, random, sticky")
 	flags.StringVar(&args.decodeKey, "decodekey", "string", "Decode message value as (string|hex|base64), defaults to string.")
 	flags.StringVar(&args.decodeValue, "decodevalue", "string", "Decode message value as (string|hex|base64), defaults to string.")
-	flags.IntVar(&args.bufferSize, "buffersize", 16777216, "Buffer size for scanning stdin, defaults to 16777216=16*1024*1024.")
+	flags.IntVar(&args.bufferSize, "buffersize", 16777216, "Max size of an input record, defaults to 16777216=16*1024*1024.")
+	flags.StringVar(&args.framing, "framing", "lines", "How input records are delimited (lines|json-stream|null|length|files|csv|tsv), defaults to lines.")
+	flags.StringVar(&args.files, "files", "", "Directory or glob of files to read one record per file from, with -framing files.")
+	flags.StringVar(&args.csv.topic, "topiccolumn", "", "Column to use as topic, with -framing csv or tsv.")
+	flags.StringVar(&args.csv.key, "keycolumn", "", "Column to use as key, with -framing csv or tsv.")
+	flags.StringVar(&args.csv.value, "valuecolumn", "", "Column to use as value, with -framing csv or tsv.")
+	flags.StringVar(&args.csv.partition, "partitioncolumn", "", "Column to use as partition, with -framing csv or tsv.")
+	flags.StringVar(&args.csv.timestamp, "timestampcolumn", "", "Column to use as timestamp (RFC3339 or unix milliseconds), with -framing csv or tsv.")
+	flags.StringVar(&args.csv.headers, "headercolumns", "", "Comma separated columns to send as message headers, with -framing csv or tsv.")
+	flags.BoolVar(&args.csv.valueJSON, "valuejson", false, "Send the remaining columns as JSON object value, with -framing csv or tsv.")
+	flags.BoolVar(&args.replay, "replay", false, "Replay input at the pace given by the messages' timestamps.")
+	flags.StringVar(&args.replayFile, "replayfile", "", "Replay messages from an archive written by kt backup instead of stdin (implies -replay).")
+	flags.BoolVar(&args.replayNow, "replaynow", false, "Rewrite timestamps of replayed messages to the time they are sent.")
+	flags.StringVar(&args.speed, "speed", "1x", "Speed factor for replaying messages, e.g. 10x or 0.5x.")
+	flags.IntVar(&args.retries, "retries", 3, "Number of times to retry messages that failed with retriable errors, which can write them twice (at-least-once).")
+	flags.DurationVar(&args.retryBackoff, "retrybackoff", 500*time.Millisecond, "Time to wait before the first retry, doubled for each further retry.")
+	flags.StringVar(&args.deadLetter, "deadletter", "", "File to append messages to that failed permanently, as JSON input for produce.")
+	flags.IntVar(&args.inflight, "inflight", 5, "Max number of requests in flight per leader broker (1 sends one request at a time).")
+	flags.BoolVar(&args.reports, "deliveryreports", false, "Print a delivery report per message instead of a summary per partition and batch.")
+
+	addErrorsFlag(flags)
 
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of produce:")
@@ -79,19 +134,13 @@ func (cmd *produceCmd) read(as []string) produceArgs {
 }
 
 func (cmd *produceCmd) failStartup(msg string) {
-	fmt.Fprintln(os.Stderr, msg)
-	failf("use \"kt produce -help\" for more information")
+	failUsage(msg, "use \"kt produce -help\" for more information")
 }
 
 func (cmd *produceCmd) parseArgs(as []string) {
 	args := cmd.read(as)
-	envTopic := os.Getenv("KT_TOPIC")
 	if args.topic == "" {
-		if envTopic == "" {
-			cmd.failStartup("Topic name is required.")
-		} else {
-			args.topic = envTopic
-		}
+		args.topic = os.Getenv("KT_TOPIC")
 	}
 	cmd.topic = args.topic
 	cmd.tlsCA = args.tlsCA
@@ -132,10 +181,68 @@ func (cmd *produceCmd) parseArgs(as []string) {
 	cmd.pretty = args.pretty
 	cmd.literal = args.literal
 	cmd.partition = int32(args.partition)
+	if args.partitioner != "" {
+		if _, err := newPartitioner(args.partitioner, 1); err != nil {
+			cmd.failStartup(err.Error())
+			return
+		}
+	}
 	cmd.partitioner = args.partitioner
 	cmd.version = kafkaVersion(args.version)
 	cmd.compression = kafkaCompression(args.compression)
 	cmd.bufferSize = args.bufferSize
+
+	if !validFraming(args.framing) {
+		cmd.failStartup(fmt.Sprintf("unsupported framing %#v, use one of %v.", args.framing, framingNames))
+		return
+	}
+	if (args.framing == "files") != (args.files != "") {
+		cmd.failStartup("-files is required with and only supported with -framing files.")
+		return
+	}
+	cmd.framing = args.framing
+	cmd.files = args.files
+
+	columns, err := parseCSVArgs(args.csv, args.framing == "csv" || args.framing == "tsv")
+	if err != nil {
+		cmd.failStartup(err.Error())
+		return
+	}
+	cmd.columns = columns
+	if cmd.columns != nil && cmd.literal {
+		cmd.failStartup("-literal is not supported with -framing csv or tsv.")
+		return
+	}
+	cmd.reports = args.reports
+	cmd.retries = args.retries
+	cmd.retryBackoff = args.retryBackoff
+	cmd.deadLetterFile = args.deadLetter
+
+	if args.inflight < 1 {
+		cmd.failStartup("-inflight must be at least 1.")
+		return
+	}
+	cmd.inflight = args.inflight
+
+	cmd.replay = args.replay || args.replayFile != ""
+	cmd.replayFile = args.replayFile
+	cmd.replayNow = args.replayNow
+	speed, err := parseSpeed(args.speed)
+	if err != nil {
+		cmd.failStartup(err.Error())
+		return
+	}
+	cmd.speed = speed
+
+	if cmd.replayFile != "" && (cmd.decodeKey != "string" || cmd.decodeValue != "string") {
+		cmd.failStartup("-decodekey and -decodevalue are not supported with -replayfile, archives contain raw bytes.")
+		return
+	}
+
+	if cmd.replayFile != "" && cmd.framing != "lines" {
+		cmd.failStartup("-framing is not supported with -replayfile.")
+		return
+	}
 }
 
 func kafkaCompression(codecName string) sarama.CompressionCodec {
@@ -154,19 +261,33 @@ func kafkaCompression(codecName string) sarama.CompressionCodec {
 	panic("unreachable")
 }
 
+var errNoTopic = errors.New("no topic given via -topic or the input's topic field")
+
+// findLeaders checks that the -topic exists before reading any input.
 func (cmd *produceCmd) findLeaders() {
+	if cmd.topic == "" {
+		return
+	}
+	if _, err := cmd.leadersFor(cmd.topic); err != nil {
+		failf("%v", err)
+	}
+}
+
+func (cmd *produceCmd) brokerConfig() *sarama.Config {
+	if cmd.cfg != nil {
+		return cmd.cfg
+	}
+
 	var (
 		usr *user.User
 		err error
-		res *sarama.MetadataResponse
-		req = sarama.MetadataRequest{Topics: []string{cmd.topic}}
 		cfg = sarama.NewConfig()
 	)
 
 	cfg.Producer.RequiredAcks = sarama.WaitForAll
 	cfg.Version = cmd.version
 	if usr, err = user.Current(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+		warnf("Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-produce-" + sanitizeUsername(usr.Username)
 	if cmd.verbose {
@@ -181,20 +302,38 @@ func (cmd *produceCmd) findLeaders() {
 		cfg.Net.TLS.Config = tlsConfig
 	}
 
+	cmd.cfg = cfg
+	return cfg
+}
+
+// fetchLeaders asks the first reachable broker for the topic's metadata and
+// connects to the leader of each partition. Connections are shared via conns,
+// which maps broker addresses to open connections.
+func (cmd *produceCmd) fetchLeaders(topic string, conns map[string]*sarama.Broker) (map[int32]*sarama.Broker, error) {
+	var (
+		err      error
+		res      *sarama.MetadataResponse
+		req            = sarama.MetadataRequest{Topics: []string{topic}}
+		cfg            = cmd.brokerConfig()
+		topicErr error = sarama.ErrOutOfBrokers
+	)
+
 loop:
 	for _, addr := range cmd.brokers {
 		broker := sarama.NewBroker(addr)
 		if err = broker.Open(cfg); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open broker connection to %v. err=%s\n", addr, err)
+			warnf("Failed to open broker connection to %v. err=%s", addr, err)
 			continue loop
 		}
 		if connected, err := broker.Connected(); !connected || err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to open broker connection to %v. err=%s\n", addr, err)
+			warnf("Failed to open broker connection to %v. err=%s", addr, err)
 			continue loop
 		}
 
-		if res, err = broker.GetMetadata(&req); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to get metadata from %#v. err=%v\n", addr, err)
+		res, err = broker.GetMetadata(&req)
+		logClose(fmt.Sprintf("broker %v", addr), broker)
+		if err != nil {
+			warnf("Failed to get metadata from %#v. err=%v", addr, err)
 			continue loop
 		}
 
@@ -204,56 +343,172 @@ loop:
 		}
 
 		for _, tm := range res.Topics {
-			if tm.Name == cmd.topic {
+			if tm.Name == topic {
 				if tm.Err != sarama.ErrNoError {
-					fmt.Fprintf(os.Stderr, "Failed to get metadata from %#v. err=%v\n", addr, tm.Err)
+					warnf("Failed to get metadata for topic %v from %#v. err=%v", topic, addr, tm.Err)
+					topicErr = tm.Err
 					continue loop
 				}
 
-				cmd.leaders = map[int32]*sarama.Broker{}
+				leaders := map[int32]*sarama.Broker{}
 				for _, pm := range tm.Partitions {
 					b, ok := brokers[pm.Leader]
 					if !ok {
-						failf("failed to find leader in broker response, giving up")
+						return nil, fmt.Errorf("failed to find leader for partition=%v of topic=%v in broker response err=%w", pm.ID, topic, sarama.ErrLeaderNotAvailable)
+					}
+
+					if conn, ok := conns[b.Addr()]; ok {
+						leaders[pm.ID] = conn
+						continue
 					}
 
 					if err = b.Open(cfg); err != nil && err != sarama.ErrAlreadyConnected {
-						failf("failed to open broker connection err=%s", err)
+						return nil, fmt.Errorf("failed to open broker connection err=%w", err)
 					}
-					if connected, err := broker.Connected(); !connected && err != nil {
-						failf("failed to wait for broker connection to open err=%s", err)
+					if connected, err := b.Connected(); !connected && err != nil {
+						return nil, fmt.Errorf("failed to wait for broker connection to open err=%w", err)
 					}
 
-					cmd.leaders[pm.ID] = b
+					conns[b.Addr()] = b
+					leaders[pm.ID] = b
 				}
-				return
+				return leaders, nil
 			}
 		}
 	}
 
-	failf("failed to find leader for given topic")
+	return nil, fmt.Errorf("failed to find leader for topic %v err=%w", topic, topicErr)
+}
+
+// leadersFor returns the partition leaders of topic, fetching them when the
+// topic is produced to for the first time. Failures are remembered until the
+// next refresh so that messages for missing topics don't cause a metadata
+// request each.
+func (cmd *produceCmd) leadersFor(topic string) (map[int32]*sarama.Broker, error) {
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	if leaders, ok := cmd.leaders[topic]; ok {
+		return leaders, nil
+	}
+	if err, ok := cmd.unknown[topic]; ok {
+		return nil, err
+	}
+	if topic == "" {
+		return nil, errNoTopic
+	}
+	if cmd.conns == nil {
+		cmd.conns = map[string]*sarama.Broker{}
+	}
+
+	leaders, err := cmd.fetchLeaders(topic, cmd.conns)
+	if err != nil {
+		if cmd.unknown == nil {
+			cmd.unknown = map[string]error{}
+		}
+		cmd.unknown[topic] = err
+		return nil, err
+	}
+
+	// requests in flight may read the current map, so it's replaced rather
+	// than modified.
+	all := map[string]map[int32]*sarama.Broker{topic: leaders}
+	for t, l := range cmd.leaders {
+		all[t] = l
+	}
+	cmd.leaders = all
+	return leaders, nil
+}
+
+// refreshLeaders replaces the connections to the partition leaders of all
+// topics after errors like NotLeaderForPartition. It keeps the current
+// leaders of topics whose metadata can't be fetched.
+func (cmd *produceCmd) refreshLeaders() {
+	cmd.Lock()
+	defer cmd.Unlock()
+
+	conns := map[string]*sarama.Broker{}
+	all := map[string]map[int32]*sarama.Broker{}
+	for topic, current := range cmd.leaders {
+		leaders, err := cmd.fetchLeaders(topic, conns)
+		if err != nil {
+			warnf("Failed to refresh leaders of topic %v err=%v", topic, err)
+			leaders = current
+		}
+		all[topic] = leaders
+	}
+
+	// requests in flight may still use the previous connections, they're
+	// closed when producing is done.
+	for _, b := range cmd.conns {
+		cmd.stale = append(cmd.stale, b)
+	}
+	cmd.conns = conns
+	cmd.leaders = all
+	cmd.unknown = nil
+}
+
+func (cmd *produceCmd) currentLeaders() map[string]map[int32]*sarama.Broker {
+	cmd.Lock()
+	defer cmd.Unlock()
+	return cmd.leaders
+}
+
+// partitionCount returns the number of partitions of topic, or 0 when its
+// leaders are unknown. Messages for such topics fail when they're sent.
+func (cmd *produceCmd) partitionCount(topic string) int32 {
+	leaders, _ := cmd.leadersFor(topic)
+	return int32(len(leaders))
+}
+
+// topicOf returns the topic msg is sent to, falling back to -topic.
+func (cmd *produceCmd) topicOf(msg message) string {
+	if msg.Topic != "" {
+		return msg.Topic
+	}
+	return cmd.topic
 }
 
 type produceCmd struct {
-	topic       string
-	brokers     []string
-	tlsCA       string
-	tlsCert     string
-	tlsCertKey  string
-	batch       int
-	timeout     time.Duration
-	verbose     bool
-	pretty      bool
-	literal     bool
-	partition   int32
-	version     sarama.KafkaVersion
-	compression sarama.CompressionCodec
-	partitioner string
-	decodeKey   string
-	decodeValue string
-	bufferSize  int
-
-	leaders map[int32]*sarama.Broker
+	topic          string
+	brokers        []string
+	tlsCA          string
+	tlsCert        string
+	tlsCertKey     string
+	batch          int
+	timeout        time.Duration
+	verbose        bool
+	pretty         bool
+	literal        bool
+	partition      int32
+	version        sarama.KafkaVersion
+	compression    sarama.CompressionCodec
+	partitioner    string
+	decodeKey      string
+	decodeValue    string
+	bufferSize     int
+	replay         bool
+	replayFile     string
+	replayNow      bool
+	speed          float64
+	reports        bool
+	retries        int
+	retryBackoff   time.Duration
+	deadLetterFile string
+	inflight       int
+	framing        string
+	files          string
+	columns        *csvColumns
+	recordBatches  bool
+
+	sync.Mutex
+	cfg        *sarama.Config
+	leaders    map[string]map[int32]*sarama.Broker
+	conns      map[string]*sarama.Broker
+	unknown    map[string]error
+	stale      []*sarama.Broker
+	deadLetter io.WriteCloser
+	failed     int64
 }
 
 func (cmd *produceCmd) run(as []string) {
@@ -264,6 +519,14 @@ func (cmd *produceCmd) run(as []string) {
 
 	defer cmd.close()
 	cmd.findLeaders()
+
+	if cmd.deadLetterFile != "" {
+		var err error
+		if cmd.deadLetter, err = os.OpenFile(cmd.deadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			failf("failed to open dead letter file err=%v", err)
+		}
+		defer logClose("dead letter file", cmd.deadLetter)
+	}
 	stdin := make(chan string)
 	lines := make(chan string)
 	messages := make(chan message)
@@ -271,47 +534,87 @@ func (cmd *produceCmd) run(as []string) {
 	out := make(chan printContext)
 	q := make(chan struct{})
 
-	go readStdinLines(cmd.bufferSize, stdin)
 	go print(out, cmd.pretty)
-
 	go listenForInterrupt(q)
-	go cmd.readInput(q, stdin, lines)
-	go cmd.deserializeLines(lines, messages, int32(len(cmd.leaders)))
+
+	if cmd.replayFile != "" {
+		go cmd.readReplayFile(q, messages)
+	} else {
+		switch cmd.framing {
+		case "csv", "tsv":
+			go cmd.deserializeCSV(q, os.Stdin, messages, cmd.partitionCount)
+		case "files":
+			go readFiles(cmd.files, cmd.bufferSize, stdin)
+		default:
+			go cmd.readRecords(os.Stdin, stdin)
+		}
+		if cmd.columns == nil {
+			go cmd.readInput(q, stdin, lines)
+			go cmd.deserializeLines(lines, messages, cmd.partitionCount)
+		}
+	}
+
+	if cmd.replay {
+		paced := make(chan message)
+		go cmd.replayMessages(messages, paced)
+		messages = paced
+	}
+
 	go cmd.batchRecords(messages, batchedMessages)
-	cmd.produce(batchedMessages, out)
+	if cmd.inflight > 1 {
+		cmd.producePipelined(batchedMessages, out)
+	} else {
+		cmd.produce(batchedMessages, out)
+	}
+
+	if cmd.failed > 0 {
+		cmd.close()
+		if cmd.deadLetter != nil {
+			logClose("dead letter file", cmd.deadLetter)
+		}
+		failPartial("failed to produce messages=%v", cmd.failed)
+	}
 }
 
 func (cmd *produceCmd) close() {
-	for _, b := range cmd.leaders {
-		var (
-			connected bool
-			err       error
-		)
+	for _, b := range cmd.conns {
+		closeBroker(b)
+	}
+	for _, b := range cmd.stale {
+		closeBroker(b)
+	}
+}
 
-		if connected, err = b.Connected(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to check if broker is connected. err=%s\n", err)
-			continue
-		}
+func closeBroker(b *sarama.Broker) {
+	connected, err := b.Connected()
+	if err != nil {
+		warnf("Failed to check if broker is connected. err=%s", err)
+		return
+	}
 
-		if !connected {
-			continue
-		}
+	if !connected {
+		return
+	}
 
-		if err = b.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to close broker %v connection. err=%s\n", b, err)
-		}
+	if err = b.Close(); err != nil {
+		warnf("Failed to close broker %v connection. err=%s", b, err)
 	}
 }
 
-func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partitionCount int32) {
+func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partitionCount func(topic string) int32) {
 	defer func() { close(out) }()
+
+	partitioner := cmd.inputPartitioner()
+
+	var line int64
 	for {
 		select {
 		case l, ok := <-in:
 			if !ok {
 				return
 			}
-			var msg message
+			line++
+			msg := message{line: line}
 
 			switch {
 			case cmd.literal:
@@ -320,29 +623,62 @@ func (cmd *produceCmd) deserializeLines(in chan string, out chan message, partit
 			default:
 				if err := json.Unmarshal([]byte(l), &msg); err != nil {
 					if cmd.verbose {
-						fmt.Fprintf(os.Stderr, "Failed to unmarshal input [%v], falling back to defaults. err=%v\n", l, err)
+						warnf("Failed to unmarshal input [%v], falling back to defaults. err=%v", l, err)
 					}
 					var v *string = &l
 					if len(l) == 0 {
 						v = nil
 					}
-					msg = message{Key: nil, Value: v}
+					msg = message{Key: nil, Value: v, line: line}
 				}
 			}
 
-			var part int32 = 0
-			if msg.Key != nil && cmd.partitioner == "hashCode" {
-				part = hashCodePartition(*msg.Key, partitionCount)
-			}
-			if msg.Partition == nil {
-				msg.Partition = &part
-			}
-
+			cmd.assignPartition(partitioner, &msg, partitionCount)
 			out <- msg
 		}
 	}
 }
 
+// inputPartitioner returns the partitioner given by -partitioner, nil when
+// messages without partition go to partition 0.
+func (cmd *produceCmd) inputPartitioner() partitioner {
+	if cmd.partitioner == "" {
+		return nil
+	}
+	p, _ := newPartitioner(cmd.partitioner, cmd.batch)
+	return p
+}
+
+// assignPartition sets the partition of msg unless the input specified it.
+// partitionCount returns the number of partitions of the message's topic.
+func (cmd *produceCmd) assignPartition(p partitioner, msg *message, partitionCount func(topic string) int32) {
+	if msg.Partition != nil {
+		return
+	}
+
+	var part int32 = 0
+	if p != nil {
+		if count := partitionCount(cmd.topicOf(*msg)); count > 0 {
+			part = p.partition(cmd.partitionKey(*msg), count)
+		}
+	}
+	msg.Partition = &part
+}
+
+// partitionKey returns the decoded key of msg to partition it by, nil when msg
+// has no key. Keys that fail to decode are partitioned by their raw input, the
+// error is reported when the message is sent.
+func (cmd *produceCmd) partitionKey(msg message) []byte {
+	if msg.Key == nil {
+		return nil
+	}
+	key, err := decodeString(*msg.Key, cmd.decodeKey)
+	if err != nil {
+		return []byte(*msg.Key)
+	}
+	return key
+}
+
 func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
 	defer func() { close(out) }()
 
@@ -372,11 +708,6 @@ func (cmd *produceCmd) batchRecords(in chan message, out chan []message) {
 	}
 }
 
-type partitionProduceResult struct {
-	start int64
-	count int64
-}
-
 func (cmd *produceCmd) makeSaramaMessage(msg message) (*sarama.Message, error) {
 	var (
 		err error
@@ -384,103 +715,296 @@ func (cmd *produceCmd) makeSaramaMessage(msg message) (*sarama.Message, error) {
 	)
 
 	if msg.Key != nil {
-		switch cmd.decodeKey {
-		case "hex":
-			if sm.Key, err = hex.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Key, err = base64.StdEncoding.DecodeString(*msg.Key); err != nil {
-				return sm, fmt.Errorf("failed to decode key as base64 string, err=%v", err)
-			}
-		default: // string
-			sm.Key = []byte(*msg.Key)
+		if sm.Key, err = decodeString(*msg.Key, cmd.decodeKey); err != nil {
+			return sm, fmt.Errorf("failed to decode key as %v string, err=%v", cmd.decodeKey, err)
 		}
 	}
 
 	if msg.Value != nil {
-		switch cmd.decodeValue {
-		case "hex":
-			if sm.Value, err = hex.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as hex string, err=%v", err)
-			}
-		case "base64":
-			if sm.Value, err = base64.StdEncoding.DecodeString(*msg.Value); err != nil {
-				return sm, fmt.Errorf("failed to decode value as base64 string, err=%v", err)
-			}
-		default: // string
-			sm.Value = []byte(*msg.Value)
+		if sm.Value, err = decodeString(*msg.Value, cmd.decodeValue); err != nil {
+			return sm, fmt.Errorf("failed to decode value as %v string, err=%v", cmd.decodeValue, err)
 		}
 	}
 
 	if cmd.version.IsAtLeast(sarama.V0_10_0_0) {
 		sm.Version = 1
 		sm.Timestamp = time.Now()
+		if msg.Timestamp != nil {
+			sm.Timestamp = *msg.Timestamp
+		}
 	}
 
 	return sm, nil
 }
 
-func (cmd *produceCmd) produceBatch(leaders map[int32]*sarama.Broker, batch []message, out chan printContext) error {
-	requests := map[*sarama.Broker]*sarama.ProduceRequest{}
+// makeSaramaRecord builds a record for the record batch format used by Kafka
+// 0.11 and later, returning the record's timestamp alongside it.
+func (cmd *produceCmd) makeSaramaRecord(msg message) (*sarama.Record, time.Time, error) {
+	sm, err := cmd.makeSaramaMessage(msg)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ts := time.Now()
+	if msg.Timestamp != nil {
+		ts = *msg.Timestamp
+	}
+
+	r := &sarama.Record{Key: sm.Key, Value: sm.Value}
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.Headers = append(r.Headers, &sarama.RecordHeader{Key: []byte(k), Value: []byte(msg.Headers[k])})
+	}
+
+	return r, ts, nil
+}
+
+// newProduceRequest returns a request that writes message sets, or record
+// batches when records is set.
+func (cmd *produceCmd) newProduceRequest(records bool) *sarama.ProduceRequest {
+	req := &sarama.ProduceRequest{RequiredAcks: sarama.WaitForAll, Timeout: 10000}
+	if records {
+		req.Version = 3
+	}
+	return req
+}
+
+// useRecordBatches reports whether batch is written as record batches, which
+// requires -version 0.11.0.0 or later. kt produce writes message sets like
+// before unless a message of the batch carries headers, which message sets
+// can't hold. perf sets recordBatches to always benchmark the current format.
+func (cmd *produceCmd) useRecordBatches(batch []message) bool {
+	if !cmd.version.IsAtLeast(sarama.V0_11_0_0) {
+		return false
+	}
+	if cmd.recordBatches {
+		return true
+	}
 	for _, msg := range batch {
-		broker, ok := leaders[*msg.Partition]
-		if !ok {
-			return fmt.Errorf("non-configured partition %v", *msg.Partition)
+		if len(msg.Headers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// topicPartition identifies a partition of a topic.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// addRecord appends r to the record batch for the given partition, creating
+// the batch if necessary.
+func (cmd *produceCmd) addRecord(batches map[topicPartition]*sarama.RecordBatch, tp topicPartition, r *sarama.Record, ts time.Time) {
+	b, ok := batches[tp]
+	if !ok {
+		b = &sarama.RecordBatch{
+			Version:          2,
+			Codec:            cmd.compression,
+			CompressionLevel: sarama.CompressionLevelDefault,
+			FirstTimestamp:   ts,
+			MaxTimestamp:     ts,
+			ProducerID:       -1,
+		}
+		batches[tp] = b
+	}
+
+	r.OffsetDelta = int64(len(b.Records))
+	r.TimestampDelta = ts.Sub(b.FirstTimestamp)
+	if ts.After(b.MaxTimestamp) {
+		b.MaxTimestamp = ts
+	}
+	b.Records = append(b.Records, r)
+	b.LastOffsetDelta = int32(len(b.Records) - 1)
+}
+
+// pendingMessage is a message of a produce request awaiting the response,
+// with the timestamp it was sent with.
+type pendingMessage struct {
+	msg message
+	ts  time.Time
+}
+
+// produceFailure is a message that couldn't be written and why.
+type produceFailure struct {
+	pm  pendingMessage
+	err error
+}
+
+// produceBatch sends batch to the partitions' leaders and prints the results
+// of the messages that were written. It returns the messages that failed.
+// The leaders of topics missing in leaders are looked up via leadersFor.
+func (cmd *produceCmd) produceBatch(leaders map[string]map[int32]*sarama.Broker, batch []message, out chan printContext) []produceFailure {
+	var (
+		requests = map[*sarama.Broker]*sarama.ProduceRequest{}
+		batches  = map[*sarama.Broker]map[topicPartition]*sarama.RecordBatch{}
+		pending  = map[*sarama.Broker]map[topicPartition][]pendingMessage{}
+		failed   = []produceFailure{}
+		records  = cmd.useRecordBatches(batch)
+	)
+
+	for _, msg := range batch {
+		tp := topicPartition{cmd.topicOf(msg), *msg.Partition}
+		broker, err := cmd.leader(leaders, tp)
+		if err != nil {
+			failed = append(failed, produceFailure{pendingMessage{msg: msg}, err})
+			continue
 		}
 		req, ok := requests[broker]
 		if !ok {
-			req = &sarama.ProduceRequest{RequiredAcks: sarama.WaitForAll, Timeout: 10000}
+			req = cmd.newProduceRequest(records)
 			requests[broker] = req
+			batches[broker] = map[topicPartition]*sarama.RecordBatch{}
+			pending[broker] = map[topicPartition][]pendingMessage{}
 		}
 
-		sm, err := cmd.makeSaramaMessage(msg)
+		ts, err := cmd.addMessage(req, batches[broker], msg)
 		if err != nil {
-			return err
+			failed = append(failed, produceFailure{pendingMessage{msg: msg}, err})
+			continue
 		}
-		req.AddMessage(cmd.topic, *msg.Partition, sm)
+		pending[broker][tp] = append(pending[broker][tp], pendingMessage{msg, ts})
 	}
 
 	for broker, req := range requests {
+		for tp, b := range batches[broker] {
+			req.AddBatch(tp.topic, tp.partition, b)
+		}
+
 		resp, err := broker.Produce(req)
 		if err != nil {
-			return fmt.Errorf("failed to send request to broker %#v. err=%s", broker, err)
+			err = fmt.Errorf("failed to send request to broker %#v. err=%w", broker.Addr(), err)
+			for _, msgs := range pending[broker] {
+				for _, pm := range msgs {
+					failed = append(failed, produceFailure{pm, err})
+				}
+			}
+			continue
 		}
 
-		offsets, err := readPartitionOffsetResults(resp)
-		if err != nil {
+		failed = append(failed, cmd.readResponse(out, resp, pending[broker])...)
+	}
+
+	return failed
+}
+
+func (cmd *produceCmd) leader(leaders map[string]map[int32]*sarama.Broker, tp topicPartition) (*sarama.Broker, error) {
+	partitions, ok := leaders[tp.topic]
+	if !ok {
+		var err error
+		if partitions, err = cmd.leadersFor(tp.topic); err != nil {
+			return nil, err
+		}
+	}
+
+	broker, ok := partitions[tp.partition]
+	if !ok {
+		return nil, fmt.Errorf("non-configured partition %v of topic %v", tp.partition, tp.topic)
+	}
+	return broker, nil
+}
+
+// readResponse prints the results of the messages of a produce request that
+// were written and returns the ones that failed. The broker assigns
+// consecutive offsets to the messages of each partition, starting at the
+// block's offset.
+func (cmd *produceCmd) readResponse(out chan printContext, resp *sarama.ProduceResponse, pending map[topicPartition][]pendingMessage) []produceFailure {
+	type written struct {
+		pm     pendingMessage
+		offset int64
+	}
+
+	var (
+		failed  = []produceFailure{}
+		results = []written{}
+	)
 
-			return fmt.Errorf("failed to read producer response err=%s", err)
+	for tp, msgs := range pending {
+		block := resp.GetBlock(tp.topic, tp.partition)
+		if block == nil || block.Err != sarama.ErrNoError {
+			var err error = sarama.ErrIncompleteResponse
+			if block != nil {
+				err = block.Err
+			}
+			for _, pm := range msgs {
+				failed = append(failed, produceFailure{pm, err})
+			}
+			continue
 		}
 
-		for p, o := range offsets {
-			result := map[string]interface{}{"partition": p, "startOffset": o.start, "count": o.count}
+		if !cmd.reports {
+			result := map[string]interface{}{"topic": tp.topic, "partition": tp.partition, "startOffset": block.Offset, "count": int64(len(msgs))}
 			ctx := printContext{output: result, done: make(chan struct{})}
 			out <- ctx
 			<-ctx.done
+			continue
+		}
+
+		for i, pm := range msgs {
+			if !block.Timestamp.IsZero() {
+				pm.ts = block.Timestamp // the topic uses LogAppendTime
+			}
+			results = append(results, written{pm, block.Offset + int64(i)})
 		}
 	}
 
-	return nil
-}
+	sort.Slice(results, func(i, j int) bool { return results[i].pm.msg.line < results[j].pm.msg.line })
+	for _, r := range results {
+		offset := r.offset
+		cmd.report(out, r.pm, &offset, nil)
+	}
 
-func readPartitionOffsetResults(resp *sarama.ProduceResponse) (map[int32]partitionProduceResult, error) {
-	offsets := map[int32]partitionProduceResult{}
-	for _, blocks := range resp.Blocks {
-		for partition, block := range blocks {
-			if block.Err != sarama.ErrNoError {
-				fmt.Fprintf(os.Stderr, "Failed to send message. err=%s\n", block.Err.Error())
-				return offsets, block.Err
-			}
+	return failed
+}
 
-			if r, ok := offsets[partition]; ok {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: r.count + 1}
-			} else {
-				offsets[partition] = partitionProduceResult{start: block.Offset, count: 1}
-			}
+// addMessage adds msg to req, or to its record batch for the partition when
+// req uses record batches. It returns the timestamp msg is sent with.
+func (cmd *produceCmd) addMessage(req *sarama.ProduceRequest, batches map[topicPartition]*sarama.RecordBatch, msg message) (time.Time, error) {
+	if req.Version >= 3 {
+		r, ts, err := cmd.makeSaramaRecord(msg)
+		if err != nil {
+			return ts, err
 		}
+		cmd.addRecord(batches, topicPartition{cmd.topicOf(msg), *msg.Partition}, r, ts)
+		return ts, nil
+	}
+
+	if len(msg.Headers) > 0 {
+		return time.Time{}, fmt.Errorf("message headers require -version 0.11.0.0 or later")
+	}
+
+	sm, err := cmd.makeSaramaMessage(msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.AddMessage(cmd.topicOf(msg), *msg.Partition, sm)
+	return sm.Timestamp, nil
+}
+
+func (cmd *produceCmd) report(out chan printContext, pm pendingMessage, offset *int64, err error) {
+	r := deliveryReport{Line: pm.msg.line, Topic: cmd.topicOf(pm.msg), Key: pm.msg.Key, Offset: offset}
+	if pm.msg.Partition != nil {
+		r.Partition = *pm.msg.Partition
+	}
+	if !pm.ts.IsZero() {
+		r.Timestamp = &pm.ts
+	}
+	if err != nil {
+		category, kafkaName := classifyError(err)
+		r.Error, r.KafkaError = category.code, kafkaName
+		cmd.Lock()
+		cmd.failed++
+		cmd.Unlock()
 	}
-	return offsets, nil
+
+	ctx := printContext{output: r, done: make(chan struct{})}
+	out <- ctx
+	<-ctx.done
 }
 
 func (cmd *produceCmd) produce(in chan []message, out chan printContext) {
@@ -490,11 +1014,117 @@ func (cmd *produceCmd) produce(in chan []message, out chan printContext) {
 			if !ok {
 				return
 			}
-			if err := cmd.produceBatch(cmd.leaders, b, out); err != nil {
-				fmt.Fprintln(os.Stderr, err.Error()) // TODO: failf
-				return
+			cmd.produceWithRetries(b, out, nil)
+		}
+	}
+}
+
+// produceWithRetries sends batch, retrying messages that failed with retriable
+// errors up to -retries times. The leaders are refreshed before each retry as
+// the errors are usually caused by leadership moving to another broker. The
+// first attempt is sent via conn, when given, to the partitions it leads. It
+// returns whether any attempt failed. A message that failed with a timeout or
+// broken connection may have been written nonetheless, so retrying it can
+// write it twice.
+func (cmd *produceCmd) produceWithRetries(batch []message, out chan printContext, conn *sarama.Broker) bool {
+	leaders := cmd.currentLeaders()
+	if conn != nil {
+		viaConn := map[string]map[int32]*sarama.Broker{}
+		for topic, partitions := range leaders {
+			viaConn[topic] = map[int32]*sarama.Broker{}
+			for p, b := range partitions {
+				if b.Addr() == conn.Addr() {
+					b = conn
+				}
+				viaConn[topic][p] = b
+			}
+		}
+		leaders = viaConn
+	}
+
+	failed := cmd.produceBatch(leaders, batch, out)
+	hadFailures := len(failed) > 0
+	backoff := cmd.retryBackoff
+
+	for attempt := 1; len(failed) > 0; attempt++ {
+		var (
+			retry []message
+			err   error
+		)
+		for _, f := range failed {
+			if attempt <= cmd.retries && retriable(f.err) {
+				retry = append(retry, f.pm.msg)
+				err = f.err
+				continue
 			}
+			cmd.giveUp(out, f)
+		}
+		if len(retry) == 0 {
+			return hadFailures
+		}
+
+		warnf("Failed to produce messages=%v, retrying in %v attempt=%v err=%v", len(retry), backoff, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		cmd.refreshLeaders()
+		failed = cmd.produceBatch(cmd.currentLeaders(), retry, out)
+	}
+	return hadFailures
+}
+
+// giveUp reports a message that permanently failed and writes it to the dead
+// letter file. Without a dead letter file or delivery reports, kt exits as it
+// can't tell which of the remaining messages were written.
+func (cmd *produceCmd) giveUp(out chan printContext, f produceFailure) {
+	if cmd.reports {
+		cmd.report(out, f.pm, nil, f.err)
+	}
+
+	cmd.Lock()
+	defer cmd.Unlock()
+	if !cmd.reports {
+		cmd.failed++
+	}
+
+	if cmd.deadLetter == nil {
+		if !cmd.reports {
+			failf("failed to produce message line=%v err=%v", f.pm.msg.line, f.err)
 		}
+		return
+	}
+
+	buf, err := json.Marshal(cmd.deadLetterMessage(f.pm.msg))
+	if err != nil {
+		failf("failed to marshal message for dead letter file err=%v", err)
+	}
+	if _, err = fmt.Fprintf(cmd.deadLetter, "%s\n", buf); err != nil {
+		failf("failed to write to dead letter file err=%v", err)
+	}
+	warnf("Wrote message line=%v to dead letter file err=%v", f.pm.msg.line, f.err)
+}
+
+// deadLetterMessage returns msg as it's written to the dead letter file. With
+// -literal values can be binary, which JSON strings can't hold, so they're
+// written base64 encoded to be sent again with -decodevalue base64.
+func (cmd *produceCmd) deadLetterMessage(msg message) message {
+	if cmd.literal && cmd.decodeValue == "string" && msg.Value != nil {
+		v := base64.StdEncoding.EncodeToString([]byte(*msg.Value))
+		msg.Value = &v
+	}
+	return msg
+}
+
+// readRecords sends the records of r according to -framing to out. An error
+// reading r ends the input and counts as a failed message, so that kt exits
+// with 3 once the records read before it are produced.
+func (cmd *produceCmd) readRecords(r io.Reader, out chan string) {
+	defer close(out)
+	if err := readRecords(cmd.framing, r, cmd.bufferSize, out); err != nil {
+		warnf("Failed to read input err=%v", err)
+		cmd.Lock()
+		cmd.failed++
+		cmd.Unlock()
 	}
 }
 
@@ -517,15 +1147,114 @@ var produceDocString = `
 The values for -topic and -brokers can also be set via environment variables KT_TOPIC and KT_BROKERS respectively.
 The values supplied on the command line win over environment variable values.
 
-Input is read from stdin and separated by newlines.
-
-If you want to use the -partitioner keep in mind that the hashCode
-implementation is not the default for Kafka's producer anymore.
-
-To specify the key, value and partition individually pass it as a JSON object
-like the following:
-
-    {"key": "id-23", "value": "message content", "partition": 0}
+Input is read from stdin and separated by newlines by default. Use -framing to
+read records delimited differently:
+
+  lines        one record per line, up to -buffersize bytes.
+  json-stream  concatenated or pretty printed JSON objects, the elements of
+               top-level arrays are read as individual records.
+  null         records terminated by a null byte.
+  length       records prefixed by their length as a 4 byte big endian
+               unsigned integer.
+  files        one record per file of the directory or glob given via -files,
+               in lexical order of the file names.
+  csv, tsv     comma or tab separated rows, see below.
+
+When the input can't be read any further, e.g. because a record exceeds
+-buffersize or is truncated, kt produces the records read before it and exits
+with 3.
+
+Each record is interpreted like an input line, e.g. combine -literal with null,
+length or files to produce binary values:
+
+  kt produce -topic images -literal -framing files -files 'images/*.png'
+
+CSV and TSV input starts with a header row naming the columns. -topiccolumn,
+-keycolumn, -valuecolumn, -partitioncolumn and -timestampcolumn pick the
+columns for the parts of the messages, -headercolumns the columns to send as
+message headers named like the column. Timestamps are RFC3339 or unix
+milliseconds, empty cells leave the topic, key, partition or timestamp unset.
+Instead of -valuecolumn, -valuejson sends the remaining columns as JSON object,
+where cells that are JSON numbers or booleans keep their type and empty cells
+are null. The following sends key 23 with value
+{"name":"ola","age":42,"active":true}:
+
+  $ printf 'id,name,age,active\n23,ola,42,true\n' | kt produce -topic people -framing csv -keycolumn id -valuejson
+
+Malformed rows, e.g. with a wrong number of cells or an invalid partition, are
+reported with their line and skipped, and kt exits with 3.
+
+Messages without a partition go to partition 0 unless you pick a -partitioner:
+
+  hashCode           Kafka's legacy Scala producer, keyless messages go to
+                     partition 0.
+  murmur2            Kafka's DefaultPartitioner of the Java client, keyless
+                     messages are partitioned like sticky.
+  consistent         librdkafka's consistent partitioner, keys are hashed with
+                     CRC32 and keyless messages go to the partition of the
+                     empty key.
+  consistent_random  librdkafka's consistent_random partitioner, like
+                     consistent but messages with a missing or empty key are
+                     partitioned randomly. crc32 is an alias of it.
+  random             a random partition per message, ignoring keys.
+  sticky             -batch messages in a row go to the same partition before
+                     moving on to the next one, ignoring keys.
+
+Use "kt partition" to see where a key lands with each of them.
+
+By default kt prints the offset of the first message and the number of messages
+per partition for each batch. With -deliveryreports it prints a report per
+message instead, including its line of the input (or position in the
+-replayfile), key, partition, offset and timestamp:
+
+    {"line":3,"key":"id-23","partition":0,"offset":17,"timestamp":"2018-10-01T12:00:00Z"}
+
+Messages that couldn't be written have no offset but an error code, e.g.
+"message_too_large", and kt continues with the next batch and exits with 3.
+
+Messages that fail with retriable errors, e.g. because partition leadership
+moved to another broker, are retried up to -retries times with exponential
+backoff, refreshing the partition leaders before each retry. Retries make
+delivery at-least-once: when a request times out or its connection breaks
+after the broker wrote the messages, the retry writes them a second time. With
+-retries 0 kt never sends a message twice, but reports such messages as failed
+although they may have been written. When a message fails permanently kt
+exits, unless -deliveryreports or -deadletter are given.
+With -deadletter the message is appended to the given file as JSON input for kt
+produce, so that it can be sent again later:
+
+  kt produce -topic greetings -deadletter failed.json <input.json
+  kt produce -topic greetings <failed.json
+
+With -literal the values in the dead letter file are base64 encoded, as they
+can be binary, so send them again with -decodevalue base64:
+
+  kt produce -topic images -literal -framing files -files 'images/*.png' -deadletter failed.json
+  kt produce -topic images -decodevalue base64 <failed.json
+
+Up to -inflight requests are sent to each partition leader concurrently, each
+via its own connection. Messages of the same partition are never part of two
+requests in flight, so they're written in the order they're read, also when
+they're retried. Messages of different partitions may be written, and
+reported, in a different order than they're read. With -inflight 1 kt waits
+for each batch to be written before sending the next one.
+
+To specify the key, value, partition, timestamp and headers individually pass
+it as a JSON object like the following:
+
+    {"key": "id-23", "value": "message content", "partition": 0, "timestamp": "2018-10-01T12:00:00Z", "headers": {"source": "crm"}}
+
+The timestamp is optional and defaults to the time the message is sent.
+Headers require -version 0.11.0.0 or later. Batches with headers are written
+in the record batch format of Kafka 0.11, all others as message sets.
+
+A "topic" field sends the message to the named topic instead of -topic, so
+that a single stream, e.g. the output of kt consume across several topics, can
+be fanned out to multiple topics. The leaders of each topic are looked up when
+the first message for it is read, -partitioner uses the topic's number of
+partitions. -topic is only required for messages that don't name a topic:
+
+    {"topic": "greetings-eu", "key": "id-23", "value": "hallo"}
 
 In case the input line cannot be interpeted as a JSON object the key and value
 both default to the input line and partition to 0.
@@ -551,4 +1280,20 @@ Keep reading input from stdin until interrupted (via ^C).
   $ kt consume -topic greetings -timeout 1s -offsets 0:4-
   {"partition":0,"offset":4,"key":"hello.","message":"hello."}
   {"partition":0,"offset":5,"key":"bonjour.","message":"bonjour."}
+
+With -replay, messages are sent at the pace of their original timestamps, as
+found in the output of "kt consume" or in an archive written by "kt backup"
+and passed via -replayfile. The delays between messages are divided by the
+-speed factor, and -replaynow sends messages with the current time instead of
+their original timestamp. When the cluster can't keep up with the schedule,
+the drift is reported as JSON on stderr.
+
+Replay a recorded stream ten times faster than it was recorded:
+
+  $ kt consume -topic greetings -timeout 1s > greetings.json
+  $ kt produce -topic greetings-replay -replay -speed 10x < greetings.json
+
+Replay a backup at its original pace with fresh timestamps:
+
+  $ kt produce -topic greetings-replay -replayfile greetings.ktb -replaynow
 `
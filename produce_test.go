@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/stretchr/testify/require"
 )
@@ -223,6 +225,23 @@ func TestMakeSaramaMessage(t *testing.T) {
 	require.Equal(t, []byte("peter"), actual.Value)
 }
 
+func TestMakeSaramaRecordHeaders(t *testing.T) {
+	target := &produceCmd{decodeKey: "string", decodeValue: "string"}
+	msg := newMessage("key", "value", 0)
+	msg.Headers = map[string]string{"source": "crm", "region": "eu"}
+
+	actual, _, err := target.makeSaramaRecord(msg)
+	require.Nil(t, err)
+	require.Equal(t, []*sarama.RecordHeader{
+		{Key: []byte("region"), Value: []byte("eu")},
+		{Key: []byte("source"), Value: []byte("crm")},
+	}, actual.Headers)
+
+	req := &sarama.ProduceRequest{Version: 2}
+	_, err = target.addMessage(req, nil, msg)
+	require.EqualError(t, err, "message headers require -version 0.11.0.0 or later")
+}
+
 func TestDeserializeLines(t *testing.T) {
 	target := &produceCmd{}
 	target.partitioner = "hashCode"
@@ -258,6 +277,17 @@ func TestDeserializeLines(t *testing.T) {
 			partitionCount: 4,
 			expected:       newMessage("", `{"other":"json","values":"avail"}`, 2),
 		},
+		{
+			in:             `{"key":"hans","value":"123","partition":1,"timestamp":"2018-10-01T12:00:00Z"}`,
+			literal:        false,
+			partitionCount: 3,
+			expected: func() message {
+				m := newMessage("hans", "123", 1)
+				ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+				m.Timestamp = &ts
+				return m
+			}(),
+		},
 		{
 			in:             `so lange schon`,
 			literal:        false,
@@ -271,16 +301,281 @@ func TestDeserializeLines(t *testing.T) {
 		out := make(chan message)
 		target.literal = d.literal
 		target.partition = d.partition
-		go target.deserializeLines(in, out, d.partitionCount)
+		go target.deserializeLines(in, out, func(string) int32 { return d.partitionCount })
 		in <- d.in
 
 		select {
 		case <-time.After(50 * time.Millisecond):
 			t.Errorf("did not receive output in time")
 		case actual := <-out:
+			d.expected.line = 1 // each input is the first line of its own run
 			if !(reflect.DeepEqual(d.expected, actual)) {
 				t.Errorf(spew.Sprintf("\nexpected %#v\nactual   %#v", d.expected, actual))
 			}
 		}
 	}
 }
+
+func TestProduceBatchRecordBatches(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	target := &produceCmd{
+		topic:         "hans",
+		version:       sarama.V2_0_0_0,
+		compression:   sarama.CompressionGZIP,
+		decodeKey:     "string",
+		decodeValue:   "string",
+		recordBatches: true,
+	}
+
+	cfg := sarama.NewConfig()
+	cfg.Version = target.version
+	leader := sarama.NewBroker(broker.Addr())
+	require.NoError(t, leader.Open(cfg))
+	defer leader.Close()
+
+	out := make(chan printContext)
+	results := make(chan map[string]interface{})
+	go func() {
+		for ctx := range out {
+			results <- ctx.output.(map[string]interface{})
+			close(ctx.done)
+		}
+	}()
+
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	batch := []message{newMessage("a", "1", 0), newMessage("b", "2", 0), newMessage("", "3", 1), newMessage("c", "4", 0)}
+	batch[0].Timestamp = &ts
+	batch[3].Topic = "peter"
+
+	leaders := map[string]map[int32]*sarama.Broker{"hans": {0: leader, 1: leader}, "peter": {0: leader}}
+	errs := make(chan []produceFailure)
+	go func() { errs <- target.produceBatch(leaders, batch, out) }()
+
+	counts := map[topicPartition]int64{}
+	for len(counts) < 3 {
+		select {
+		case r := <-results:
+			counts[topicPartition{r["topic"].(string), r["partition"].(int32)}] = r["count"].(int64)
+		case failed := <-errs:
+			t.Fatalf("produce finished early failed=%v", failed)
+		case <-time.After(time.Second):
+			t.Fatalf("did not receive results in time")
+		}
+	}
+	require.Empty(t, <-errs)
+	require.Equal(t, map[topicPartition]int64{{"hans", 0}: 2, {"hans", 1}: 1, {"peter", 0}: 1}, counts)
+
+	var req *sarama.ProduceRequest
+	for _, r := range broker.History() {
+		if pr, ok := r.Request.(*sarama.ProduceRequest); ok {
+			req = pr
+		}
+	}
+	require.NotNil(t, req)
+	require.Equal(t, int16(3), req.Version)
+}
+
+func TestProduceUseRecordBatches(t *testing.T) {
+	plain := []message{newMessage("a", "1", 0)}
+	headers := []message{newMessage("a", "1", 0), newMessage("b", "2", 0)}
+	headers[1].Headers = map[string]string{"source": "crm"}
+
+	data := []struct {
+		version       sarama.KafkaVersion
+		recordBatches bool
+		batch         []message
+		expected      bool
+	}{
+		{version: sarama.V2_0_0_0, batch: plain, expected: false},
+		{version: sarama.V2_0_0_0, batch: headers, expected: true},
+		{version: sarama.V2_0_0_0, recordBatches: true, batch: plain, expected: true},
+		{version: sarama.V0_10_0_0, recordBatches: true, batch: headers, expected: false},
+	}
+
+	for _, d := range data {
+		target := &produceCmd{version: d.version, recordBatches: d.recordBatches}
+		require.Equal(t, d.expected, target.useRecordBatches(d.batch), "version=%v recordBatches=%v", d.version, d.recordBatches)
+		if d.expected {
+			require.Equal(t, int16(3), target.newProduceRequest(true).Version)
+		}
+	}
+	require.Equal(t, int16(0), (&produceCmd{}).newProduceRequest(false).Version)
+}
+
+func TestProduceReadResponse(t *testing.T) {
+	target := &produceCmd{topic: "hans", reports: true}
+
+	resp := &sarama.ProduceResponse{}
+	resp.AddTopicPartition("hans", 0, sarama.ErrNoError)
+	resp.GetBlock("hans", 0).Offset = 10
+	resp.AddTopicPartition("hans", 1, sarama.ErrMessageSizeTooLarge)
+
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	pending := func(key string, partition int32, line int64) pendingMessage {
+		m := newMessage(key, "v", partition)
+		m.line = line
+		return pendingMessage{msg: m, ts: ts}
+	}
+
+	out := make(chan printContext)
+	reports := make(chan deliveryReport, 2)
+	go func() {
+		for ctx := range out {
+			reports <- ctx.output.(deliveryReport)
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	failed := target.readResponse(out, resp, map[topicPartition][]pendingMessage{
+		{"hans", 0}: {pending("a", 0, 1), pending("c", 0, 3)},
+		{"hans", 1}: {pending("b", 1, 2)},
+	})
+
+	key := func(k string) *string { return &k }
+	offset := func(o int64) *int64 { return &o }
+	require.Equal(t, deliveryReport{Line: 1, Topic: "hans", Key: key("a"), Partition: 0, Offset: offset(10), Timestamp: &ts}, <-reports)
+	require.Equal(t, deliveryReport{Line: 3, Topic: "hans", Key: key("c"), Partition: 0, Offset: offset(11), Timestamp: &ts}, <-reports)
+	require.Equal(t, []produceFailure{{pending("b", 1, 2), sarama.ErrMessageSizeTooLarge}}, failed)
+}
+
+type nopWriteCloser struct{ *bytes.Buffer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestProduceWithRetries(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("hans", 0, broker.BrokerID()).
+			SetLeader("hans", 1, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockSequence(
+			sarama.NewMockProduceResponse(t).
+				SetError("hans", 0, sarama.ErrNotLeaderForPartition).
+				SetError("hans", 1, sarama.ErrMessageSizeTooLarge),
+			sarama.NewMockProduceResponse(t),
+		),
+	})
+
+	deadLetter := nopWriteCloser{&bytes.Buffer{}}
+	target := &produceCmd{
+		topic:        "hans",
+		version:      sarama.V0_10_0_0,
+		brokers:      []string{broker.Addr()},
+		decodeKey:    "string",
+		decodeValue:  "string",
+		retries:      2,
+		retryBackoff: time.Millisecond,
+		deadLetter:   deadLetter,
+	}
+	target.findLeaders()
+	defer target.close()
+
+	out := make(chan printContext)
+	results := make(chan map[string]interface{}, 1)
+	go func() {
+		for ctx := range out {
+			results <- ctx.output.(map[string]interface{})
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	target.produceWithRetries([]message{newMessage("a", "1", 0), newMessage("b", "2", 1)}, out, nil)
+
+	result := <-results
+	require.Equal(t, int32(0), result["partition"])
+	require.Equal(t, int64(1), result["count"])
+	require.Equal(t, int64(1), target.failed)
+	require.Equal(t, `{"key":"b","value":"2","partition":1}`+"\n", deadLetter.String())
+
+	produced := 0
+	for _, r := range broker.History() {
+		if _, ok := r.Request.(*sarama.ProduceRequest); ok {
+			produced++
+		}
+	}
+	require.Equal(t, 2, produced)
+}
+
+func TestProduceDeadLetterLiteral(t *testing.T) {
+	deadLetter := nopWriteCloser{&bytes.Buffer{}}
+	target := &produceCmd{
+		literal:     true,
+		decodeValue: "string",
+		reports:     true,
+		deadLetter:  deadLetter,
+	}
+	out := make(chan printContext)
+	go func() {
+		for ctx := range out {
+			close(ctx.done)
+		}
+	}()
+	defer close(out)
+
+	value := "\x89PNG\xff"
+	msg := message{Value: &value, Partition: new(int32)}
+	target.giveUp(out, produceFailure{pendingMessage{msg: msg}, sarama.ErrMessageSizeTooLarge})
+	require.Equal(t, `{"key":null,"value":"iVBOR/8=","partition":0}`+"\n", deadLetter.String())
+
+	decoded, err := decodeString("iVBOR/8=", "base64")
+	require.NoError(t, err)
+	require.Equal(t, []byte(value), decoded)
+}
+
+func TestProduceLeadersFor(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("hans", 0, broker.BrokerID()).
+			SetLeader("hans", 1, broker.BrokerID()).
+			SetLeader("peter", 0, broker.BrokerID()),
+	})
+
+	metadataRequests := func() int {
+		n := 0
+		for _, r := range broker.History() {
+			if _, ok := r.Request.(*sarama.MetadataRequest); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	target := &produceCmd{topic: "hans", version: sarama.V0_10_0_0, brokers: []string{broker.Addr()}}
+	target.findLeaders()
+	defer target.close()
+	require.Equal(t, 1, metadataRequests())
+	require.Equal(t, int32(2), target.partitionCount("hans"))
+
+	peter, err := target.leadersFor("peter")
+	require.NoError(t, err)
+	require.Len(t, peter, 1)
+	require.True(t, peter[0] == target.currentLeaders()["hans"][0], "expected topics to share the connection")
+	require.Len(t, target.conns, 1)
+
+	_, err = target.leadersFor("missing")
+	require.Error(t, err)
+	_, err = target.leadersFor("missing")
+	require.Error(t, err)
+	require.Equal(t, 3, metadataRequests())
+
+	_, err = target.leadersFor("")
+	require.Equal(t, errNoTopic, err)
+
+	target.refreshLeaders()
+	require.Equal(t, 5, metadataRequests())
+	require.Len(t, target.currentLeaders(), 2)
+	require.Len(t, target.stale, 1)
+	require.Nil(t, target.unknown)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayReportInterval is how often the drift from the replay schedule is
+// reported while the cluster can't keep up.
+var replayReportInterval = 5 * time.Second
+
+type replayDrift struct {
+	Replayed int64  `json:"replayed"`
+	Drift    string `json:"drift"`
+	MaxDrift string `json:"maxDrift"`
+	Done     bool   `json:"done"`
+}
+
+// parseSpeed parses a replay speed factor like "10x", "0.5x" or "2".
+func parseSpeed(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "x"), 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid speed %#v, expected a positive factor like 10x or 0.5x", s)
+	}
+	return f, nil
+}
+
+// replaySchedule maps message timestamps to the wall clock time they should
+// be sent at. The first timestamp seen is sent right away, later ones are
+// delayed by their distance to it divided by the speed factor. Timestamps that
+// are older than one seen before are due immediately rather than counted as
+// drift.
+type replaySchedule struct {
+	speed float64
+	start time.Time
+	first time.Time
+	last  time.Time
+}
+
+func (s *replaySchedule) due(now, ts time.Time) time.Time {
+	if s.start.IsZero() {
+		s.start, s.first, s.last = now, ts, ts
+	}
+
+	if ts.After(s.last) {
+		s.last = ts
+	}
+
+	return s.start.Add(time.Duration(float64(s.last.Sub(s.first)) / s.speed))
+}
+
+// replayMessages passes messages from in to out at the pace given by their
+// timestamps. Messages without timestamps are passed on without delay.
+func (cmd *produceCmd) replayMessages(in chan message, out chan message) {
+	defer func() { close(out) }()
+
+	var (
+		schedule   = &replaySchedule{speed: cmd.speed}
+		replayed   int64
+		drift      time.Duration
+		maxDrift   time.Duration
+		lastReport = time.Now()
+	)
+
+	report := func(done bool) {
+		buf, _ := json.Marshal(replayDrift{
+			Replayed: replayed,
+			Drift:    drift.String(),
+			MaxDrift: maxDrift.String(),
+			Done:     done,
+		})
+		fmt.Fprintln(os.Stderr, string(buf))
+		lastReport = time.Now()
+	}
+	defer func() { report(true) }()
+
+	for msg := range in {
+		if msg.Timestamp != nil {
+			now := time.Now()
+			due := schedule.due(now, *msg.Timestamp)
+			if wait := due.Sub(now); wait > 0 {
+				time.Sleep(wait)
+				drift = 0
+			} else {
+				drift = -wait
+				if drift > maxDrift {
+					maxDrift = drift
+				}
+			}
+		}
+
+		if cmd.replayNow {
+			msg.Timestamp = nil
+		}
+
+		out <- msg
+		replayed++
+
+		if drift > 0 && time.Since(lastReport) >= replayReportInterval {
+			report(false)
+		}
+	}
+}
+
+// readReplayFile reads messages from a backup archive, keeping their
+// partitions, timestamps and headers. Keys and values are passed on as raw
+// bytes, which is why replaying archives requires the string decoding.
+func (cmd *produceCmd) readReplayFile(q chan struct{}, out chan message) {
+	defer func() { close(out) }()
+
+	f, err := os.Open(cmd.replayFile)
+	if err != nil {
+		failf("failed to open replay file err=%v", err)
+	}
+	defer logClose("replay file", f)
+
+	br, err := newBackupReader(f)
+	if err != nil {
+		failf("%v", err)
+	}
+	defer logClose("replay archive", br)
+
+	var line int64
+	for {
+		rec, err := br.read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			failf("failed to read record from replay file err=%v", err)
+		}
+
+		partition := rec.Partition
+		line++
+		msg := message{Partition: &partition, Timestamp: rec.Timestamp, line: line}
+		if rec.Key != nil {
+			k := string(rec.Key)
+			msg.Key = &k
+		}
+		if rec.Value != nil {
+			v := string(rec.Value)
+			msg.Value = &v
+		}
+		for _, h := range rec.Headers {
+			if msg.Headers == nil {
+				msg.Headers = map[string]string{}
+			}
+			msg.Headers[string(h.Key)] = string(h.Value)
+		}
+
+		select {
+		case out <- msg:
+		case <-q:
+			return
+		}
+	}
+}
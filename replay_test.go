@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpeed(t *testing.T) {
+	data := []struct {
+		in       string
+		expected float64
+		err      bool
+	}{
+		{in: "1x", expected: 1},
+		{in: "10x", expected: 10},
+		{in: "0.5x", expected: 0.5},
+		{in: "2", expected: 2},
+		{in: "0x", err: true},
+		{in: "-1x", err: true},
+		{in: "fast", err: true},
+	}
+
+	for _, d := range data {
+		actual, err := parseSpeed(d.in)
+		if d.err {
+			require.Error(t, err, d.in)
+			continue
+		}
+		require.NoError(t, err, d.in)
+		require.Equal(t, d.expected, actual, d.in)
+	}
+}
+
+func TestReplaySchedule(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	ts := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &replaySchedule{speed: 10}
+
+	require.Equal(t, now, s.due(now, ts))
+	require.Equal(t, now.Add(time.Second), s.due(now, ts.Add(10*time.Second)))
+	// out of order timestamps are due right away with respect to the latest one
+	require.Equal(t, now.Add(time.Second), s.due(now, ts.Add(5*time.Second)))
+	require.Equal(t, now.Add(2*time.Second), s.due(now, ts.Add(20*time.Second)))
+}
+
+func TestReplayMessages(t *testing.T) {
+	target := &produceCmd{speed: 10, replayNow: true}
+	in := make(chan message, 3)
+	out := make(chan message)
+
+	ts := time.Now().Add(-time.Hour)
+	for _, d := range []time.Duration{0, 500 * time.Millisecond, time.Second} {
+		msgTs := ts.Add(d)
+		in <- message{Timestamp: &msgTs}
+	}
+	close(in)
+
+	start := time.Now()
+	go target.replayMessages(in, out)
+
+	count := 0
+	for msg := range out {
+		require.Nil(t, msg.Timestamp)
+		count++
+	}
+	require.Equal(t, 3, count)
+
+	elapsed := time.Since(start)
+	require.True(t, elapsed >= 100*time.Millisecond, "replay took %v", elapsed)
+	require.True(t, elapsed < time.Second, "replay took %v", elapsed)
+}
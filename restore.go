@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+type restoreCmd struct {
+	topic             string
+	brokers           []string
+	tlsCA             string
+	tlsCert           string
+	tlsCertKey        string
+	file              string
+	batch             int
+	replicationFactor int
+	create            bool
+	verbose           bool
+	version           sarama.KafkaVersion
+
+	admin    sarama.ClusterAdmin
+	producer sarama.SyncProducer
+}
+
+type restoreArgs struct {
+	topic             string
+	brokers           string
+	tlsCA             string
+	tlsCert           string
+	tlsCertKey        string
+	file              string
+	batch             int
+	replicationFactor int
+	create            bool
+	verbose           bool
+	version           string
+}
+
+func (cmd *restoreCmd) parseFlags(as []string) restoreArgs {
+	var args restoreArgs
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.StringVar(&args.topic, "topic", "", "Topic to restore to (defaults to the topic in the archive).")
+	flags.StringVar(&args.brokers, "brokers", "", "Comma separated list of brokers. Port defaults to 9092 when omitted (defaults to localhost:9092).")
+	flags.StringVar(&args.tlsCA, "tlsca", "", "Path to the TLS certificate authority file")
+	flags.StringVar(&args.tlsCert, "tlscert", "", "Path to the TLS client certificate file")
+	flags.StringVar(&args.tlsCertKey, "tlscertkey", "", "Path to the TLS client certificate key file")
+	flags.StringVar(&args.file, "file", "", "Path of the archive to restore (required, - for stdin).")
+	flags.IntVar(&args.batch, "batch", 500, "Max number of messages to send at once.")
+	flags.IntVar(&args.replicationFactor, "replicationfactor", 0, "Replication factor of the created topic (defaults to the archive's).")
+	flags.BoolVar(&args.create, "create", true, "Create the topic before restoring messages.")
+	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
+	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+
+	addErrorsFlag(flags)
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage of restore:")
+		flags.PrintDefaults()
+		fmt.Fprintln(os.Stderr, restoreDocString)
+	}
+
+	err := flags.Parse(as)
+	if err != nil && strings.Contains(err.Error(), "flag: help requested") {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	return args
+}
+
+func (cmd *restoreCmd) failStartup(msg string) {
+	failUsage(msg, "use \"kt restore -help\" for more information")
+}
+
+func (cmd *restoreCmd) parseArgs(as []string) {
+	args := cmd.parseFlags(as)
+
+	if args.file == "" {
+		cmd.failStartup("Archive file is required.")
+		return
+	}
+
+	if args.batch < 1 {
+		cmd.failStartup(fmt.Sprintf("batch size must be positive, got %v", args.batch))
+		return
+	}
+
+	envBrokers := os.Getenv("KT_BROKERS")
+	if args.brokers == "" {
+		if envBrokers != "" {
+			args.brokers = envBrokers
+		} else {
+			args.brokers = "localhost:9092"
+		}
+	}
+
+	cmd.topic = args.topic
+	cmd.brokers = parseBrokers(args.brokers)
+	cmd.tlsCA = args.tlsCA
+	cmd.tlsCert = args.tlsCert
+	cmd.tlsCertKey = args.tlsCertKey
+	cmd.file = args.file
+	cmd.batch = args.batch
+	cmd.replicationFactor = args.replicationFactor
+	cmd.create = args.create
+	cmd.verbose = args.verbose
+	cmd.version = kafkaVersion(args.version)
+}
+
+func (cmd *restoreCmd) saramaConfig() *sarama.Config {
+	var (
+		err error
+		usr *user.User
+		cfg = sarama.NewConfig()
+	)
+
+	cfg.Version = cmd.version
+	if usr, err = user.Current(); err != nil {
+		warnf("Failed to read current user err=%v", err)
+	}
+	cfg.ClientID = "kt-restore-" + sanitizeUsername(usr.Username)
+
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	cfg.Net.MaxOpenRequests = 1 // keeps retries from reordering messages
+
+	tlsConfig, err := setupCerts(cmd.tlsCert, cmd.tlsCA, cmd.tlsCertKey)
+	if err != nil {
+		failf("failed to setup certificates err=%v", err)
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	return cfg
+}
+
+func (cmd *restoreCmd) run(as []string) {
+	var err error
+
+	cmd.parseArgs(as)
+	if cmd.verbose {
+		sarama.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	var r io.Reader = os.Stdin
+	if cmd.file != "-" {
+		f, err := os.Open(cmd.file)
+		if err != nil {
+			failf("failed to open archive file err=%v", err)
+		}
+		defer logClose("archive file", f)
+		r = f
+	}
+
+	br, err := newBackupReader(r)
+	if err != nil {
+		failf("%v", err)
+	}
+	defer logClose("archive", br)
+
+	if cmd.topic == "" {
+		cmd.topic = br.header.Topic
+	}
+
+	cfg := cmd.saramaConfig()
+	if cmd.create {
+		if cmd.admin, err = sarama.NewClusterAdmin(cmd.brokers, cfg); err != nil {
+			failf("failed to create cluster admin err=%v", err)
+		}
+		defer logClose("cluster admin", cmd.admin)
+
+		if err = cmd.createTopic(br.header); err != nil {
+			failf("failed to create topic %v err=%v", cmd.topic, err)
+		}
+	}
+
+	if cmd.producer, err = sarama.NewSyncProducer(cmd.brokers, cfg); err != nil {
+		failf("failed to create producer err=%v", err)
+	}
+	defer logClose("producer", cmd.producer)
+
+	count := cmd.restore(br)
+	fmt.Fprintf(os.Stderr, "restored %v messages to topic %v\n", count, cmd.topic)
+}
+
+// createTopic creates the topic with the archived partition count,
+// replication factor and configs.
+func (cmd *restoreCmd) createTopic(header backupHeader) error {
+	return cmd.admin.CreateTopic(cmd.topic, cmd.topicDetail(header), false)
+}
+
+func (cmd *restoreCmd) topicDetail(header backupHeader) *sarama.TopicDetail {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     header.Partitions,
+		ReplicationFactor: header.ReplicationFactor,
+		ConfigEntries:     header.Configs,
+	}
+
+	if cmd.replicationFactor > 0 {
+		detail.ReplicationFactor = int16(cmd.replicationFactor)
+	}
+
+	return detail
+}
+
+// restore produces all records in the archive to their original partitions
+// and returns the number of messages restored.
+func (cmd *restoreCmd) restore(br *backupReader) int64 {
+	var (
+		count int64
+		batch = make([]*sarama.ProducerMessage, 0, cmd.batch)
+	)
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := cmd.producer.SendMessages(batch); err != nil {
+			failf("failed to restore messages to topic %v err=%v", cmd.topic, err)
+		}
+		count += int64(len(batch))
+		batch = batch[:0]
+	}
+
+	for {
+		rec, err := br.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			failf("failed to read record from archive err=%v", err)
+		}
+
+		batch = append(batch, cmd.producerMessage(rec))
+		if len(batch) >= cmd.batch {
+			send()
+		}
+	}
+	send()
+
+	return count
+}
+
+func (cmd *restoreCmd) producerMessage(rec backupRecord) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic:     cmd.topic,
+		Key:       sarama.ByteEncoder(rec.Key),
+		Value:     sarama.ByteEncoder(rec.Value),
+		Partition: rec.Partition,
+	}
+
+	if rec.Timestamp != nil {
+		pm.Timestamp = *rec.Timestamp
+	}
+
+	for _, h := range rec.Headers {
+		pm.Headers = append(pm.Headers, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+
+	return pm
+}
+
+var restoreDocString = `
+The value for -brokers can also be set via the environment variable KT_BROKERS.
+The value supplied on the command line wins over the environment variable value.
+
+Restore reads an archive written by "kt backup", creates the topic with the
+archived partition count, replication factor and configs, and produces the
+archived messages to their original partitions keeping their keys, values,
+headers and timestamps. Offsets are assigned anew by the cluster.
+
+Pass -create=false to restore into an existing topic, which needs at least as
+many partitions as the archived one.
+
+Example:
+
+  kt restore -file orders.ktb -topic orders-restored -replicationfactor 1
+`
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreParseArgs(t *testing.T) {
+	os.Setenv("KT_BROKERS", "")
+	target := &restoreCmd{}
+
+	target.parseArgs([]string{"-file", "orders.ktb", "-replicationfactor", "1"})
+	require.Equal(t, "orders.ktb", target.file)
+	require.Equal(t, "", target.topic)
+	require.Equal(t, []string{"localhost:9092"}, target.brokers)
+	require.Equal(t, 500, target.batch)
+	require.Equal(t, 1, target.replicationFactor)
+	require.True(t, target.create)
+}
+
+// sentMessages records the messages a SyncProducer sent successfully.
+type sentMessages struct {
+	sarama.SyncProducer
+	sent []*sarama.ProducerMessage
+}
+
+func (p *sentMessages) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if err := p.SyncProducer.SendMessages(msgs); err != nil {
+		return err
+	}
+	p.sent = append(p.sent, msgs...)
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	ts := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	compact := "compact"
+	header := backupHeader{
+		Topic:             "orders",
+		Partitions:        3,
+		ReplicationFactor: 3,
+		Configs:           map[string]*string{"cleanup.policy": &compact},
+		Created:           ts,
+	}
+	records := []backupRecord{
+		{Partition: 2, Offset: 7, Timestamp: &ts, Key: []byte("a"), Value: []byte("1")},
+		{Partition: 0, Offset: 3, Key: []byte("a"), Value: []byte("2")},
+		{Partition: 2, Offset: 8, Key: []byte("b"), Value: nil},
+	}
+
+	var buf bytes.Buffer
+	w, err := newBackupWriter(&buf, header)
+	require.NoError(t, err)
+	for _, r := range records {
+		require.NoError(t, w.write(r))
+	}
+	require.NoError(t, w.Close())
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetController(broker.BrokerID()).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders-restored", 0, broker.BrokerID()).
+			SetLeader("orders-restored", 1, broker.BrokerID()).
+			SetLeader("orders-restored", 2, broker.BrokerID()),
+		"CreateTopicsRequest": sarama.NewMockCreateTopicsResponse(t),
+		"ProduceRequest":      sarama.NewMockProduceResponse(t).SetVersion(2),
+	})
+
+	target := &restoreCmd{
+		topic:             "orders-restored",
+		brokers:           []string{broker.Addr()},
+		batch:             2,
+		replicationFactor: 1,
+		version:           sarama.V0_10_2_0,
+	}
+	cfg := target.saramaConfig()
+
+	br, err := newBackupReader(&buf)
+	require.NoError(t, err)
+	defer br.Close()
+
+	target.admin, err = sarama.NewClusterAdmin(target.brokers, cfg)
+	require.NoError(t, err)
+	defer target.admin.Close()
+	require.NoError(t, target.createTopic(br.header))
+
+	var create *sarama.CreateTopicsRequest
+	for _, r := range broker.History() {
+		if req, ok := r.Request.(*sarama.CreateTopicsRequest); ok {
+			create = req
+		}
+	}
+	require.NotNil(t, create)
+	detail := create.TopicDetails["orders-restored"]
+	require.NotNil(t, detail)
+	require.Equal(t, int32(3), detail.NumPartitions)
+	require.Equal(t, int16(1), detail.ReplicationFactor) // -replicationfactor wins over the archive's
+	require.Equal(t, "compact", *detail.ConfigEntries["cleanup.policy"])
+
+	producer, err := sarama.NewSyncProducer(target.brokers, cfg)
+	require.NoError(t, err)
+	defer producer.Close()
+	sent := &sentMessages{SyncProducer: producer}
+	target.producer = sent
+
+	require.Equal(t, int64(3), target.restore(br))
+	require.Len(t, sent.sent, 3)
+	for i, m := range sent.sent {
+		require.Equal(t, "orders-restored", m.Topic)
+		require.Equal(t, records[i].Partition, m.Partition)
+		require.Equal(t, sarama.ByteEncoder(records[i].Key), m.Key)
+		require.Equal(t, sarama.ByteEncoder(records[i].Value), m.Value)
+	}
+	require.Equal(t, ts, sent.sent[0].Timestamp)
+}
@@ -7,8 +7,8 @@ import (
 	"os"
 	"os/user"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
 
 	"github.com/Shopify/sarama"
 )
@@ -40,21 +40,37 @@ type topicCmd struct {
 	pretty     bool
 	version    sarama.KafkaVersion
 
-	client sarama.Client
+	client  sarama.Client
+	partial bool
 }
 
 type topic struct {
 	Name       string      `json:"name"`
 	Partitions []partition `json:"partitions,omitempty"`
+	Error      string      `json:"error,omitempty"`
 }
 
 type partition struct {
 	Id           int32   `json:"id"`
-	OldestOffset int64   `json:"oldest"`
-	NewestOffset int64   `json:"newest"`
+	OldestOffset *int64  `json:"oldest,omitempty"`
+	NewestOffset *int64  `json:"newest,omitempty"`
 	Leader       string  `json:"leader,omitempty"`
 	Replicas     []int32 `json:"replicas,omitempty"`
 	ISRs         []int32 `json:"isrs,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// failed reports whether top or any of its partitions could not be read.
+func (top topic) failed() bool {
+	if top.Error != "" {
+		return true
+	}
+	for _, p := range top.Partitions {
+		if p.Error != "" {
+			return true
+		}
+	}
+	return false
 }
 
 func (cmd *topicCmd) parseFlags(as []string) topicArgs {
@@ -74,6 +90,8 @@ func (cmd *topicCmd) parseFlags(as []string) topicArgs {
 	flags.BoolVar(&args.verbose, "verbose", false, "More verbose logging to stderr.")
 	flags.BoolVar(&args.pretty, "pretty", true, "Control output pretty printing.")
 	flags.StringVar(&args.version, "version", "", "Kafka protocol version")
+	addErrorsFlag(flags)
+
 	flags.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage of topic:")
 		flags.PrintDefaults()
@@ -138,7 +156,7 @@ func (cmd *topicCmd) connect() {
 	cfg.Version = cmd.version
 
 	if usr, err = user.Current(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read current user err=%v", err)
+		warnf("Failed to read current user err=%v", err)
 	}
 	cfg.ClientID = "kt-topic-" + sanitizeUsername(usr.Username)
 	if cmd.verbose {
@@ -172,7 +190,6 @@ func (cmd *topicCmd) run(as []string) {
 	}
 
 	cmd.connect()
-	defer cmd.client.Close()
 
 	if all, err = cmd.client.Topics(); err != nil {
 		failf("failed to read topics err=%v", err)
@@ -184,86 +201,175 @@ func (cmd *topicCmd) run(as []string) {
 			topics = append(topics, a)
 		}
 	}
+	sort.Strings(topics)
 
 	go print(out, cmd.pretty)
 
-	var wg sync.WaitGroup
+	var offsets topicOffsets
+	if cmd.partitions {
+		offsets = cmd.fetchOffsets(topics)
+	}
+
 	for _, tn := range topics {
-		wg.Add(1)
-		go func(top string) {
-			cmd.print(top, out)
-			wg.Done()
-		}(tn)
+		cmd.print(tn, offsets, out)
+	}
+
+	logClose("client", cmd.client)
+	if cmd.partial {
+		failPartial("failed to read some topics or partitions, see errors in output")
 	}
-	wg.Wait()
 }
 
-func (cmd *topicCmd) print(name string, out chan printContext) {
+// topicOffsets holds the oldest and newest offset per topic and partition,
+// and the errors for topics and partitions they could not be fetched for.
+type topicOffsets struct {
+	oldest          map[string]map[int32]int64
+	newest          map[string]map[int32]int64
+	topicErrors     map[string]error
+	partitionErrors partitionErrors
+}
+
+// fetchOffsets looks up the oldest and newest offsets of all partitions of
+// the given topics with one request per leader broker for each.
+func (cmd *topicCmd) fetchOffsets(topics []string) topicOffsets {
 	var (
-		top topic
-		err error
+		err        error
+		partitions = map[string][]int32{}
+		offsets    = topicOffsets{
+			topicErrors:     map[string]error{},
+			partitionErrors: partitionErrors{},
+		}
 	)
 
-	if top, err = cmd.readTopic(name); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to read info for topic %s. err=%v\n", name, err)
+	for _, t := range topics {
+		ps, err := cmd.client.Partitions(t)
+		if err != nil {
+			offsets.topicErrors[t] = err
+			continue
+		}
+		partitions[t] = ps
+	}
+
+	if offsets.oldest, err = fetchOffsets(cmd.client, partitions, sarama.OffsetOldest); err != nil {
+		offsets.addErrors(err)
+	}
+
+	if offsets.newest, err = fetchOffsets(cmd.client, partitions, sarama.OffsetNewest); err != nil {
+		offsets.addErrors(err)
+	}
+
+	return offsets
+}
+
+func (o topicOffsets) addErrors(err error) {
+	pe, ok := err.(partitionErrors)
+	if !ok {
+		warnf("failed to read offsets. err=%v", err)
 		return
 	}
+	for t, ps := range pe {
+		for p, err := range ps {
+			if _, ok := o.partitionErrors[t][p]; !ok {
+				o.partitionErrors.add(t, p, err)
+			}
+		}
+	}
+}
+
+func (cmd *topicCmd) print(name string, offsets topicOffsets, out chan printContext) {
+	top := cmd.readTopic(name, offsets)
+	if top.failed() {
+		cmd.partial = true
+	}
 
 	ctx := printContext{output: top, done: make(chan struct{})}
 	out <- ctx
 	<-ctx.done
 }
 
-func (cmd *topicCmd) readTopic(name string) (topic, error) {
+// readTopic returns the information for the topic. Errors are attached to
+// the topic or the affected partition rather than failing the whole topic.
+func (cmd *topicCmd) readTopic(name string, offsets topicOffsets) topic {
 	var (
 		err error
 		ps  []int32
-		led *sarama.Broker
 		top = topic{Name: name}
 	)
 
 	if !cmd.partitions {
-		return top, nil
+		return top
+	}
+
+	if err = offsets.topicErrors[name]; err != nil {
+		top.Error = err.Error()
+		return top
 	}
 
 	if ps, err = cmd.client.Partitions(name); err != nil {
-		return top, err
+		top.Error = err.Error()
+		return top
 	}
 
 	for _, p := range ps {
-		np := partition{Id: p}
+		top.Partitions = append(top.Partitions, cmd.readPartition(name, p, offsets))
+	}
 
-		if np.OldestOffset, err = cmd.client.GetOffset(name, p, sarama.OffsetOldest); err != nil {
-			return top, err
-		}
+	return top
+}
 
-		if np.NewestOffset, err = cmd.client.GetOffset(name, p, sarama.OffsetNewest); err != nil {
-			return top, err
-		}
+func (cmd *topicCmd) readPartition(name string, p int32, offsets topicOffsets) partition {
+	var (
+		err error
+		led *sarama.Broker
+		np  = partition{Id: p}
+	)
 
-		if cmd.leaders {
-			if led, err = cmd.client.Leader(name, p); err != nil {
-				return top, err
-			}
-			np.Leader = led.Addr()
-		}
+	if err = offsets.partitionErrors[name][p]; err != nil {
+		np.Error = err.Error()
+		return np
+	}
 
-		if cmd.replicas {
-			if np.Replicas, err = cmd.client.Replicas(name, p); err != nil {
-				return top, err
-			}
+	oldest, ok := offsets.oldest[name][p]
+	if !ok {
+		np.Error = "missing oldest offset"
+		return np
+	}
+	np.OldestOffset = &oldest
 
-			if np.ISRs, err = cmd.client.InSyncReplicas(name, p); err != nil {
-				return top, err
-			}
+	newest, ok := offsets.newest[name][p]
+	if !ok {
+		np.Error = "missing newest offset"
+		return np
+	}
+	np.NewestOffset = &newest
+
+	if cmd.leaders {
+		if led, err = cmd.client.Leader(name, p); err != nil {
+			np.Error = err.Error()
+			return np
+		}
+		np.Leader = led.Addr()
+	}
+
+	if cmd.replicas {
+		if np.Replicas, err = cmd.client.Replicas(name, p); err != nil {
+			np.Error = err.Error()
+			return np
 		}
 
-		top.Partitions = append(top.Partitions, np)
+		if np.ISRs, err = cmd.client.InSyncReplicas(name, p); err != nil {
+			np.Error = err.Error()
+			return np
+		}
 	}
 
-	return top, nil
+	return np
 }
 
 var topicDocString = `
 The values for -brokers can also be set via the environment variable KT_BROKERS respectively.
-The values supplied on the command line win over environment variable values.`
+The values supplied on the command line win over environment variable values.
+
+When some topics or partitions can't be read, e.g. because their leader is
+unavailable, kt prints the remaining information with an "error" field on the
+affected topics and partitions and exits with code 3.`
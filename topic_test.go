@@ -4,6 +4,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTopicParseArgs(t *testing.T) {
@@ -48,3 +51,71 @@ func TestTopicParseArgs(t *testing.T) {
 		return
 	}
 }
+
+func TestTopicReadOffsetsPerLeader(t *testing.T) {
+	leader1 := sarama.NewMockBroker(t, 1)
+	defer leader1.Close()
+	leader2 := sarama.NewMockBroker(t, 2)
+	defer leader2.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(leader1.Addr(), leader1.BrokerID()).
+		SetBroker(leader2.Addr(), leader2.BrokerID()).
+		SetLeader("b", 0, leader1.BrokerID()).
+		SetLeader("b", 1, leader2.BrokerID()).
+		SetLeader("a", 0, leader2.BrokerID())
+	leader1.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("b", 0, sarama.OffsetOldest, 1).
+			SetOffset("b", 0, sarama.OffsetNewest, 10),
+	})
+	leader2.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("b", 1, sarama.OffsetOldest, 2).
+			SetOffset("b", 1, sarama.OffsetNewest, 20).
+			SetOffset("a", 0, sarama.OffsetOldest, 3).
+			SetOffset("a", 0, sarama.OffsetNewest, 30),
+	})
+
+	client, err := sarama.NewClient([]string{leader1.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	defer client.Close()
+
+	target := &topicCmd{client: client, partitions: true}
+	offsets := target.fetchOffsets([]string{"a", "b"})
+
+	countOffsetRequests := func(b *sarama.MockBroker) int {
+		var count int
+		for _, r := range b.History() {
+			if _, ok := r.Request.(*sarama.OffsetRequest); ok {
+				count++
+			}
+		}
+		return count
+	}
+	require.Equal(t, 2, countOffsetRequests(leader1))
+	require.Equal(t, 2, countOffsetRequests(leader2))
+
+	actual := target.readTopic("b", offsets)
+	require.False(t, actual.failed())
+	oldest0, newest0, oldest1, newest1 := int64(1), int64(10), int64(2), int64(20)
+	require.Equal(t, topic{
+		Name: "b",
+		Partitions: []partition{
+			{Id: 0, OldestOffset: &oldest0, NewestOffset: &newest0},
+			{Id: 1, OldestOffset: &oldest1, NewestOffset: &newest1},
+		},
+	}, actual)
+
+	offsets.partitionErrors.add("b", 1, sarama.ErrNotLeaderForPartition)
+	actual = target.readTopic("b", offsets)
+	require.True(t, actual.failed())
+	require.Equal(t, partition{Id: 0, OldestOffset: &oldest0, NewestOffset: &newest0}, actual.Partitions[0])
+	require.Equal(t, partition{Id: 1, Error: sarama.ErrNotLeaderForPartition.Error()}, actual.Partitions[1])
+
+	actual = target.readTopic("c", topicOffsets{topicErrors: map[string]error{"c": sarama.ErrUnknownTopicOrPartition}})
+	require.True(t, actual.failed())
+	require.Equal(t, sarama.ErrUnknownTopicOrPartition.Error(), actual.Error)
+}